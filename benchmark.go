@@ -22,6 +22,7 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	defer indexer.Close()
 
 	numVectors := 1000000
 	vectorDim := 128
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/0xnu/kikiola/pkg/bulk"
+	"github.com/0xnu/kikiola/pkg/db"
+	"github.com/0xnu/kikiola/pkg/index"
+	"github.com/0xnu/kikiola/pkg/snapshot"
+)
+
+func runCommand(name string, args []string) error {
+	switch name {
+	case "snapshot":
+		return runSnapshot(args)
+	case "restore":
+		return runRestore(args)
+	case "import":
+		return runImport(args)
+	case "export":
+		return runExport(args)
+	default:
+		return fmt.Errorf("unknown command %q", name)
+	}
+}
+
+func runSnapshot(args []string) error {
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	serverURL := flags.String("server", "http://localhost:3400", "URL of the running Kikiola server")
+	output := flags.String("o", "", "path of the snapshot archive to write")
+	flags.Parse(args)
+
+	if *output == "" {
+		*output = fmt.Sprintf("kikiola-snapshot-%s.tar", time.Now().UTC().Format("20060102T150405Z"))
+	}
+
+	resp, err := http.Get(strings.TrimRight(*serverURL, "/") + "/admin/snapshot")
+	if err != nil {
+		return fmt.Errorf("failed to request snapshot: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("server returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	file, err := os.Create(*output + ".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %v", err)
+	}
+
+	size, err := io.Copy(file, resp.Body)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to download snapshot: %v", err)
+	}
+	err = file.Close()
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to write snapshot file: %v", err)
+	}
+
+	err = os.Rename(file.Name(), *output)
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot file: %v", err)
+	}
+
+	log.Printf("Wrote snapshot %s (%d bytes)", *output, size)
+	return nil
+}
+
+func runRestore(args []string) error {
+	options := storageOptionsFromEnv()
+
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	input := flags.String("i", "", "path of the snapshot archive to restore")
+	flags.StringVar(&options.DataDir, "data", options.DataDir, "data directory to restore into")
+	flags.Parse(args)
+
+	if *input == "" {
+		return fmt.Errorf("missing snapshot archive, use -i")
+	}
+
+	file, err := os.Open(*input)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot: %v", err)
+	}
+	defer file.Close()
+
+	manifest, err := snapshot.Restore(file, options.DataDir)
+	if err != nil {
+		return err
+	}
+
+	var nodeAddresses []string
+	for _, node := range manifest.Nodes {
+		nodeAddresses = append(nodeAddresses, node.Address)
+	}
+
+	options.Engine = db.EngineBuntDB
+	storage, err := db.NewDistributedStorageWithOptions(nodeAddresses, options)
+	if err != nil {
+		return fmt.Errorf("failed to open restored storage: %v", err)
+	}
+	defer storage.Close()
+
+	index, err := index.NewIndex(storage)
+	if err != nil {
+		return fmt.Errorf("failed to rebuild index: %v", err)
+	}
+	defer index.Close()
+
+	log.Printf("Restored %d nodes from snapshot taken at %s", len(manifest.Nodes), manifest.CreatedAt.Format(time.RFC3339))
+	return nil
+}
+
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	input := flags.String("i", "", "path of the file to import")
+	format := flags.String("format", "", "jsonl, npy, npz, fvecs or ivecs (default: from the file extension)")
+	idsPath := flags.String("ids", "", "sidecar file with one vector ID per line")
+	metadataPath := flags.String("metadata", "", "sidecar JSONL file with one metadata object per line")
+	idPrefix := flags.String("id-prefix", "", "prefix of generated IDs when no IDs are provided")
+	batchSize := flags.Int("batch", bulk.DefaultBatchSize, "number of vectors written per batch")
+	flags.Parse(args)
+
+	if *input == "" {
+		return fmt.Errorf("missing input file, use -i")
+	}
+	if *format == "" {
+		*format = bulk.FormatFromPath(*input)
+	}
+
+	file, err := os.Open(*input)
+	if err != nil {
+		return fmt.Errorf("failed to open input: %v", err)
+	}
+	defer file.Close()
+
+	options := bulk.Options{IDPrefix: *idPrefix}
+	if *idsPath != "" {
+		ids, err := os.Open(*idsPath)
+		if err != nil {
+			return fmt.Errorf("failed to open IDs: %v", err)
+		}
+		defer ids.Close()
+		options.IDs = ids
+	}
+	if *metadataPath != "" {
+		metadata, err := os.Open(*metadataPath)
+		if err != nil {
+			return fmt.Errorf("failed to open metadata: %v", err)
+		}
+		defer metadata.Close()
+		options.Metadata = metadata
+	}
+
+	reader, err := bulk.OpenReader(*format, file, options)
+	if err != nil {
+		return err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	storage, err := db.NewDistributedStorageWithOptions(generateNodeAddresses("localhost", 3401, 3420), storageOptionsFromEnv())
+	if err != nil {
+		return fmt.Errorf("failed to initialize distributed storage: %v", err)
+	}
+	defer storage.Close()
+
+	index, err := index.NewIndex(storage)
+	if err != nil {
+		return fmt.Errorf("failed to initialize index: %v", err)
+	}
+	defer index.Close()
+
+	start := time.Now()
+	count, err := bulk.Import(reader, *batchSize, func(vectors []*db.Vector) []error {
+		return index.WriteVectors(vectors, db.WriteUpsert)
+	})
+	if err != nil {
+		return fmt.Errorf("imported %d vectors before failing: %v", count, err)
+	}
+
+	log.Printf("Imported %d vectors in %s", count, time.Since(start))
+	return nil
+}
+
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	output := flags.String("o", "", "path of the file to write")
+	format := flags.String("format", "", "jsonl, npy, npz or fvecs (default: from the file extension)")
+	idsPath := flags.String("ids", "", "sidecar file receiving one vector ID per line (fvecs)")
+	flags.Parse(args)
+
+	if *output == "" {
+		return fmt.Errorf("missing output file, use -o")
+	}
+	if *format == "" {
+		*format = bulk.FormatFromPath(*output)
+	}
+
+	storage, err := db.NewDistributedStorageWithOptions(generateNodeAddresses("localhost", 3401, 3420), storageOptionsFromEnv())
+	if err != nil {
+		return fmt.Errorf("failed to initialize distributed storage: %v", err)
+	}
+	defer storage.Close()
+
+	// The index loads the embeddings the node databases leave to its
+	// segments.
+	index, err := index.NewIndex(storage)
+	if err != nil {
+		return fmt.Errorf("failed to initialize index: %v", err)
+	}
+	defer index.Close()
+
+	file, err := os.Create(*output)
+	if err != nil {
+		return fmt.Errorf("failed to create output: %v", err)
+	}
+	defer file.Close()
+
+	var ids io.Writer
+	if *idsPath != "" {
+		idsFile, err := os.Create(*idsPath)
+		if err != nil {
+			return fmt.Errorf("failed to create IDs file: %v", err)
+		}
+		defer idsFile.Close()
+		ids = idsFile
+	}
+
+	writer, err := bulk.NewWriter(*format, file, ids)
+	if err != nil {
+		return err
+	}
+
+	count, err := bulk.Export(storage.IterateVectors(db.ListOptions{}), writer)
+	if err != nil {
+		return fmt.Errorf("exported %d vectors before failing: %v", count, err)
+	}
+
+	log.Printf("Exported %d vectors to %s", count, *output)
+	return nil
+}
@@ -2,20 +2,31 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/0xnu/kikiola/pkg/db"
+	"github.com/0xnu/kikiola/pkg/embed"
 	"github.com/0xnu/kikiola/pkg/index"
 	"github.com/0xnu/kikiola/pkg/server"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		err := runCommand(os.Args[1], os.Args[2:])
+		if err != nil {
+			log.Fatalf("%s: %v", os.Args[1], err)
+		}
+		return
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "3400"
@@ -24,19 +35,57 @@ func main() {
 	hostAddress := "localhost"
 	nodeAddresses := generateNodeAddresses(hostAddress, 3401, 3420)
 
-	storage, err := db.NewDistributedStorage(nodeAddresses)
+	storage, err := db.NewDistributedStorageWithOptions(nodeAddresses, storageOptionsFromEnv())
 	if err != nil {
 		log.Fatalf("Failed to initialize distributed storage: %v", err)
 	}
 	defer storage.Close()
 
+	if value := os.Getenv("OBJECT_VERSION_RETENTION"); value != "" {
+		retention, err := strconv.Atoi(value)
+		if err != nil || retention < 0 {
+			log.Fatalf("Invalid OBJECT_VERSION_RETENTION: %s", value)
+		}
+		storage.SetVersionRetention(retention)
+	}
+
+	if url := os.Getenv("CROSS_ENCODER_URL"); url != "" {
+		timeout := 10 * time.Second
+		if value := os.Getenv("CROSS_ENCODER_TIMEOUT"); value != "" {
+			timeout, err = time.ParseDuration(value)
+			if err != nil {
+				log.Fatalf("Invalid CROSS_ENCODER_TIMEOUT: %v", err)
+			}
+		}
+		index.RegisterReranker(index.RerankerCross, index.NewCrossEncoder(url, timeout))
+	}
+
 	index, err := index.NewIndex(storage)
 	if err != nil {
 		log.Fatalf("Failed to initialize index: %v", err)
 	}
+	defer index.Close()
 
 	server := server.NewServer(storage, index)
 
+	embedder, err := embedderFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid embedding provider configuration: %v", err)
+	}
+	if embedder != nil {
+		server.SetEmbedder(embedder)
+	}
+
+	compactionInterval := 24 * time.Hour
+	if interval := os.Getenv("COMPACTION_INTERVAL"); interval != "" {
+		compactionInterval, err = time.ParseDuration(interval)
+		if err != nil {
+			log.Fatalf("Invalid COMPACTION_INTERVAL: %v", err)
+		}
+	}
+	server.Compactor().Start(compactionInterval)
+	defer server.Compactor().Stop()
+
 	log.Printf("Starting server on %s:%s...", hostAddress, port)
 	go func() {
 		if err := server.Start(":" + port); err != nil && err != http.ErrServerClosed {
@@ -58,6 +107,60 @@ func main() {
 	log.Println("Server exited properly")
 }
 
+func storageOptionsFromEnv() db.StorageOptions {
+	options := db.DefaultStorageOptions()
+	if engine := os.Getenv("STORAGE_ENGINE"); engine != "" {
+		options.Engine = engine
+	}
+	if dataDir := os.Getenv("DATA_DIR"); dataDir != "" {
+		options.DataDir = dataDir
+	}
+	return options
+}
+
+func embedderFromEnv() (embed.Provider, error) {
+	provider := os.Getenv("EMBEDDING_PROVIDER")
+	if provider == "" {
+		return nil, nil
+	}
+
+	timeout := 30 * time.Second
+	if value := os.Getenv("EMBEDDING_TIMEOUT"); value != "" {
+		var err error
+		timeout, err = time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("EMBEDDING_TIMEOUT: %v", err)
+		}
+	}
+
+	switch provider {
+	case embed.ProviderOpenAI:
+		url := os.Getenv("EMBEDDING_URL")
+		if url == "" {
+			url = "https://api.openai.com/v1/embeddings"
+		}
+		return embed.NewOpenAI(url, os.Getenv("EMBEDDING_MODEL"), os.Getenv("EMBEDDING_API_KEY"), timeout), nil
+	case embed.ProviderCommand:
+		command := strings.Fields(os.Getenv("EMBEDDING_COMMAND"))
+		if len(command) == 0 {
+			return nil, fmt.Errorf("EMBEDDING_COMMAND is required by the %s provider", provider)
+		}
+		return embed.NewCommand(command[0], command[1:], timeout), nil
+	case embed.ProviderStub:
+		dimensions := embed.DefaultStubDimensions
+		if value := os.Getenv("EMBEDDING_DIMENSIONS"); value != "" {
+			var err error
+			dimensions, err = strconv.Atoi(value)
+			if err != nil || dimensions <= 0 {
+				return nil, fmt.Errorf("invalid EMBEDDING_DIMENSIONS: %s", value)
+			}
+		}
+		return embed.NewStub(dimensions), nil
+	default:
+		return nil, fmt.Errorf("unknown provider: %s", provider)
+	}
+}
+
 func generateNodeAddresses(hostAddress string, startPort, endPort int) []string {
 	var nodeAddresses []string
 	for port := startPort; port <= endPort; port++ {
@@ -1,25 +1,41 @@
 package main
 
 import (
+	"archive/tar"
 	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
+	"math"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/0xnu/kikiola/pkg/blob"
+	"github.com/0xnu/kikiola/pkg/bulk"
+	"github.com/0xnu/kikiola/pkg/compaction"
 	"github.com/0xnu/kikiola/pkg/db"
+	"github.com/0xnu/kikiola/pkg/embed"
 	"github.com/0xnu/kikiola/pkg/index"
+	"github.com/0xnu/kikiola/pkg/segment"
 	"github.com/0xnu/kikiola/pkg/server"
+	"github.com/0xnu/kikiola/pkg/snapshot"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestDistributedVectorDatabase(t *testing.T) {
 	nodeAddresses := generateNodeAddresses("localhost", 3401, 3420)
 
-	storage, err := db.NewDistributedStorage(nodeAddresses)
+	storage, err := db.NewDistributedStorageWithOptions(nodeAddresses, db.StorageOptions{DataDir: t.TempDir()})
 	assert.NoError(t, err)
 	defer storage.Close()
 
@@ -163,3 +179,2302 @@ func TestDistributedVectorDatabase(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 }
+
+func TestMemoryStorageEngine(t *testing.T) {
+	storage, err := db.NewDistributedStorageWithOptions([]string{"node1", "node2"}, db.StorageOptions{Engine: db.EngineMemory, DataDir: t.TempDir()})
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	vector := &db.Vector{ID: "vector1", Embedding: []float64{0.1, 0.2, 0.3}, Metadata: map[string]string{"name": "Vector 1"}}
+	assert.NoError(t, storage.InsertVector(vector))
+
+	retrieved, err := storage.GetVector("vector1")
+	assert.NoError(t, err)
+	assert.Equal(t, vector, retrieved)
+
+	assert.NoError(t, storage.UpdateVectorMetadata("vector1", map[string]string{"name": "Updated"}))
+	retrieved, err = storage.GetVector("vector1")
+	assert.NoError(t, err)
+	assert.Equal(t, "Updated", retrieved.Metadata["name"])
+
+	assert.NoError(t, storage.DeleteVector("vector1"))
+	_, err = storage.GetVector("vector1")
+	assert.ErrorIs(t, err, db.ErrVectorNotFound)
+
+	legacy := &db.Vector{ID: "legacy", Embedding: []float64{0.4, 0.5, 0.6}}
+	assert.NoError(t, storage.InsertVector(legacy))
+
+	idx, err := index.NewIndex(storage)
+	assert.NoError(t, err)
+	retrieved, err = storage.GetVector("legacy")
+	assert.NoError(t, err)
+	assert.Equal(t, legacy.Embedding, retrieved.Embedding)
+	assert.NoError(t, idx.Close())
+	_, err = storage.GetVector("legacy")
+	assert.ErrorIs(t, err, db.ErrEmbeddingsDetached)
+
+	index, err := index.NewIndex(storage)
+	assert.NoError(t, err)
+	defer index.Close()
+	retrieved, err = storage.GetVector("legacy")
+	assert.NoError(t, err)
+	assert.Equal(t, legacy.Embedding, retrieved.Embedding)
+	ts := httptest.NewServer(server.NewServer(storage, index).Router())
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/admin/snapshot")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+	assert.NotEqual(t, "application/x-tar", resp.Header.Get("Content-Type"))
+
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	temporary, err := db.NewDistributedStorageWithOptions([]string{"node1"}, db.StorageOptions{Engine: db.EngineMemory})
+	assert.NoError(t, err)
+	assert.NotEqual(t, wd, filepath.Dir(temporary.DataDir()))
+	assert.DirExists(t, filepath.Join(temporary.DataDir(), db.BlobDir))
+	assert.NoError(t, temporary.Close())
+	assert.NoDirExists(t, temporary.DataDir())
+
+	_, err = db.NewDistributedStorageWithOptions([]string{"node1"}, db.StorageOptions{Engine: db.EngineBuntDB})
+	assert.Error(t, err)
+	assert.NoDirExists(t, filepath.Join(wd, db.BlobDir))
+	assert.NoDirExists(t, filepath.Join(wd, db.UploadDir))
+}
+
+func TestVectorSegments(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := segment.OpenWithMaxSize(dir, 256)
+	assert.NoError(t, err)
+
+	refs := make(map[string]segment.Ref)
+	for n := 0; n < 10; n++ {
+		id := fmt.Sprintf("vector%d", n)
+		ref, err := store.Put(segment.Record{Key: id, Embedding: []float64{float64(n), 0.5, 0.25}})
+		assert.NoError(t, err)
+		refs[id] = ref
+	}
+	for n := 0; n < 5; n++ {
+		assert.NoError(t, store.Delete(fmt.Sprintf("vector%d", n)))
+	}
+	assert.True(t, store.NeedsMerge())
+	assert.NoError(t, store.Close())
+
+	store, err = segment.OpenWithMaxSize(dir, 256)
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.Equal(t, 5, store.Stats().Records)
+
+	result, err := store.Merge()
+	assert.NoError(t, err)
+	assert.Equal(t, 5, result.RecordsPurged)
+	assert.Greater(t, result.BytesReclaimed, int64(0))
+
+	for n := 5; n < 10; n++ {
+		id := fmt.Sprintf("vector%d", n)
+		ref, ok := store.Lookup(id)
+		assert.True(t, ok)
+		if moved, ok := result.Remap[refs[id]]; ok {
+			assert.Equal(t, moved, ref)
+		}
+
+		record, err := store.Get(ref)
+		assert.NoError(t, err)
+		assert.Equal(t, id, record.Key)
+		assert.Equal(t, []float64{float64(n), 0.5, 0.25}, record.Embedding)
+	}
+	assert.Equal(t, 0, store.Stats().Tombstones)
+}
+
+func TestCompaction(t *testing.T) {
+	storage, err := db.NewDistributedStorageWithOptions([]string{"node1", "node2"}, db.StorageOptions{DataDir: t.TempDir()})
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	index, err := index.NewIndex(storage)
+	assert.NoError(t, err)
+	defer index.Close()
+
+	server := server.NewServer(storage, index)
+	ts := httptest.NewServer(server.Router())
+	defer ts.Close()
+
+	for n := 0; n < 10; n++ {
+		vector := &db.Vector{ID: fmt.Sprintf("vector%d", n), Embedding: []float64{0.1, float64(n) / 10, 0.3}}
+		assert.NoError(t, index.Insert(vector))
+	}
+	for n := 0; n < 2; n++ {
+		assert.NoError(t, index.Delete(fmt.Sprintf("vector%d", n)))
+	}
+
+	resp, err := http.Get(ts.URL + "/admin/compact")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = http.Post(ts.URL+"/admin/compact", "application/json", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var report compaction.Report
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	assert.Equal(t, 2, report.TombstonesPurged)
+	assert.Equal(t, report.StorageBytesReclaimed+report.SegmentBytesReclaimed, report.BytesReclaimed)
+
+	results, err := index.Search(&db.Vector{Embedding: []float64{0.1, 0.9, 0.3}}, 10)
+	assert.NoError(t, err)
+	assert.Len(t, results, 8)
+}
+
+func TestSnapshotAndRestore(t *testing.T) {
+	nodeAddresses := []string{"node1", "node2", "node3"}
+
+	storage, err := db.NewDistributedStorageWithOptions(nodeAddresses, db.StorageOptions{DataDir: t.TempDir()})
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	idx, err := index.NewIndex(storage)
+	assert.NoError(t, err)
+	defer idx.Close()
+
+	server := server.NewServer(storage, idx)
+	ts := httptest.NewServer(server.Router())
+	defer ts.Close()
+
+	for n := 0; n < 5; n++ {
+		vector := &db.Vector{ID: fmt.Sprintf("vector%d", n), Embedding: []float64{0.1, float64(n) / 5, 0.3}}
+		assert.NoError(t, idx.Insert(vector))
+	}
+
+	resp, err := http.Get(ts.URL + "/admin/snapshot")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	archive, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	restoreDir := t.TempDir()
+	manifest, err := snapshot.Restore(bytes.NewReader(archive), restoreDir)
+	assert.NoError(t, err)
+	assert.Len(t, manifest.Nodes, len(nodeAddresses))
+	assert.NotEmpty(t, manifest.Segments)
+
+	restored, err := db.NewDistributedStorageWithOptions(nodeAddresses, db.StorageOptions{DataDir: restoreDir})
+	assert.NoError(t, err)
+	defer restored.Close()
+
+	// The node databases keep no embeddings; they come from the restored
+	// segments once an index is opened.
+	_, err = restored.GetVector("vector1")
+	assert.ErrorIs(t, err, db.ErrEmbeddingsDetached)
+	restoredIndex, err := index.NewIndex(restored)
+	assert.NoError(t, err)
+	defer restoredIndex.Close()
+
+	for n := 0; n < 5; n++ {
+		vector, err := restored.GetVector(fmt.Sprintf("vector%d", n))
+		assert.NoError(t, err)
+		assert.Equal(t, []float64{0.1, float64(n) / 5, 0.3}, vector.Embedding)
+	}
+
+	archive[len(archive)/2] ^= 0xff
+	_, err = snapshot.Restore(bytes.NewReader(archive), t.TempDir())
+	assert.Error(t, err)
+}
+
+func TestSnapshotBlobs(t *testing.T) {
+	nodeAddresses := []string{"node1", "node2", "node3"}
+
+	storage, err := db.NewDistributedStorageWithOptions(nodeAddresses, db.StorageOptions{DataDir: t.TempDir()})
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	idx, err := index.NewIndex(storage)
+	assert.NoError(t, err)
+	defer idx.Close()
+
+	assert.NoError(t, storage.PutObject(&db.Object{ID: "doc"}, strings.NewReader("snapshot content")))
+
+	var buf bytes.Buffer
+	manifest, err := snapshot.Create(storage, idx, &buf)
+	assert.NoError(t, err)
+	assert.Len(t, manifest.Chunks, 1)
+	archive := buf.Bytes()
+	staging, err := filepath.Glob(filepath.Join(storage.DataDir(), ".snapshot-*"))
+	assert.NoError(t, err)
+	assert.Empty(t, staging)
+
+	// Chunks listed by a snapshot survive a sweep until they are unpinned.
+	chunks, err := storage.Blobs().PinChunks()
+	assert.NoError(t, err)
+	assert.Equal(t, manifest.Chunks, chunks)
+	assert.NoError(t, storage.DeleteObject("doc"))
+	result, err := storage.SweepBlobs(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.ChunksRemoved)
+	storage.Blobs().Unpin(chunks)
+	result, err = storage.SweepBlobs(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.ChunksRemoved)
+
+	rewrite := func(edit func(header *tar.Header, data []byte) []byte) []byte {
+		var out bytes.Buffer
+		tr := tar.NewReader(bytes.NewReader(archive))
+		tw := tar.NewWriter(&out)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			assert.NoError(t, err)
+			data, _ := io.ReadAll(tr)
+			data = edit(header, data)
+			if data == nil {
+				continue
+			}
+			header.Size = int64(len(data))
+			assert.NoError(t, tw.WriteHeader(header))
+			tw.Write(data)
+		}
+		assert.NoError(t, tw.Close())
+		return out.Bytes()
+	}
+	isChunk := func(header *tar.Header) bool {
+		return strings.HasPrefix(header.Name, "blobs/")
+	}
+	countChunks := func(dataDir string) int {
+		count := 0
+		filepath.Walk(filepath.Join(dataDir, db.BlobDir), func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				count++
+			}
+			return nil
+		})
+		return count
+	}
+
+	restoreDir := t.TempDir()
+	missing := rewrite(func(header *tar.Header, data []byte) []byte {
+		if isChunk(header) {
+			return nil
+		}
+		return data
+	})
+	_, err = snapshot.Restore(bytes.NewReader(missing), restoreDir)
+	assert.Error(t, err)
+
+	corrupt := rewrite(func(header *tar.Header, data []byte) []byte {
+		if isChunk(header) {
+			return []byte("tampered content")
+		}
+		return data
+	})
+	_, err = snapshot.Restore(bytes.NewReader(corrupt), restoreDir)
+	assert.ErrorIs(t, err, snapshot.ErrChecksumMismatch)
+	assert.Equal(t, 0, countChunks(restoreDir))
+
+	escaping := rewrite(func(header *tar.Header, data []byte) []byte {
+		if header.Name == "manifest.json" {
+			return bytes.Replace(data, []byte(`"nodes/node_node1.db"`), []byte(`"nodes/.."`), 1)
+		}
+		return data
+	})
+	_, err = snapshot.Restore(bytes.NewReader(escaping), restoreDir)
+	assert.ErrorContains(t, err, "invalid node file")
+
+	stale := filepath.Join(restoreDir, db.NodeFileName("node4"))
+	assert.NoError(t, os.WriteFile(stale, []byte("stale"), 0644))
+	manifest, err = snapshot.Restore(bytes.NewReader(archive), restoreDir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, countChunks(restoreDir))
+	_, err = os.Stat(stale)
+	assert.True(t, os.IsNotExist(err))
+
+	restored, err := db.NewDistributedStorageWithOptions(nodeAddresses, db.StorageOptions{DataDir: restoreDir})
+	assert.NoError(t, err)
+	defer restored.Close()
+	object, err := restored.GetObject("doc")
+	assert.NoError(t, err)
+	data, err := restored.ReadObject(object)
+	assert.NoError(t, err)
+	assert.Equal(t, "snapshot content", string(data))
+}
+
+func newTestServer(t *testing.T) (*db.DistributedStorage, *httptest.Server) {
+	storage, _, ts := newTestIndex(t)
+	return storage, ts
+}
+
+func newTestIndex(t *testing.T) (*db.DistributedStorage, *index.Index, *httptest.Server) {
+	storage, err := db.NewDistributedStorageWithOptions([]string{"node1", "node2", "node3"}, db.StorageOptions{DataDir: t.TempDir()})
+	assert.NoError(t, err)
+	t.Cleanup(func() { storage.Close() })
+
+	index, err := index.NewIndex(storage)
+	assert.NoError(t, err)
+	t.Cleanup(func() { index.Close() })
+
+	ts := httptest.NewServer(server.NewServer(storage, index).Router())
+	t.Cleanup(ts.Close)
+
+	return storage, index, ts
+}
+
+type importResult struct {
+	Imported int    `json:"imported"`
+	Error    string `json:"error"`
+	Row      *int   `json:"row"`
+}
+
+func TestBulkImportExport(t *testing.T) {
+	storage, ts := newTestServer(t)
+
+	var jsonl bytes.Buffer
+	for n := 0; n < 25; n++ {
+		vector := db.Vector{ID: fmt.Sprintf("vector%d", n), Embedding: []float64{float64(n), 0.5, -0.25}, Metadata: map[string]string{"row": fmt.Sprint(n)}}
+		data, _ := json.Marshal(vector)
+		jsonl.Write(append(data, '\n'))
+	}
+
+	resp, err := http.Post(ts.URL+"/import?format=jsonl&batch=10", "application/x-ndjson", &jsonl)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var imported struct {
+		Imported int `json:"imported"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&imported))
+	assert.Equal(t, 25, imported.Imported)
+
+	resp, err = http.Get(ts.URL + "/export?format=npz")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	npz, err := io.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	restored, ts2 := newTestServer(t)
+	resp, err = http.Post(ts2.URL+"/import?format=npz", "application/zip", bytes.NewReader(npz))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	for n := 0; n < 25; n++ {
+		vector, err := restored.GetVector(fmt.Sprintf("vector%d", n))
+		assert.NoError(t, err)
+		assert.Equal(t, []float64{float64(n), 0.5, -0.25}, vector.Embedding)
+		assert.Equal(t, fmt.Sprint(n), vector.Metadata["row"])
+	}
+
+	var fvecs bytes.Buffer
+	writer := bulk.NewFvecsWriter(&fvecs, nil)
+	for n := 0; n < 3; n++ {
+		assert.NoError(t, writer.Write(&db.Vector{Embedding: []float64{1, float64(n)}}))
+	}
+	assert.NoError(t, writer.Close())
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	part, _ := form.CreateFormFile("ids", "ids.txt")
+	part.Write([]byte("sift0\nsift1\nsift2\n"))
+	part, _ = form.CreateFormFile("file", "base.fvecs")
+	part.Write(fvecs.Bytes())
+	assert.NoError(t, form.Close())
+
+	resp, err = http.Post(ts.URL+"/import?format=fvecs", form.FormDataContentType(), body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	vector, err := storage.GetVector("sift2")
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{1, 2}, vector.Embedding)
+
+	importJSONL := func(batch int, lines ...string) (int, importResult) {
+		url := fmt.Sprintf("%s/import?format=jsonl&batch=%d", ts.URL, batch)
+		resp, err := http.Post(url, "application/x-ndjson", strings.NewReader(strings.Join(lines, "\n")))
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		var result importResult
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		return resp.StatusCode, result
+	}
+
+	status, result := importJSONL(2,
+		`{"ID": "valid0", "Embedding": [1, 2]}`,
+		`{"ID": "valid1", "Embedding": [1, 2]}`,
+		`{"ID": "ragged", "Embeddings": [[1, 2], [1]]}`,
+		`{"ID": "valid3", "Embedding": [1, 2]}`,
+	)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, 2, result.Imported)
+	if assert.NotNil(t, result.Row) {
+		assert.Equal(t, 2, *result.Row)
+	}
+	_, err = storage.GetVector("valid3")
+	assert.ErrorIs(t, err, db.ErrVectorNotFound)
+
+	status, result = importJSONL(10,
+		`{"ID": "linked0", "Embedding": [1, 2]}`,
+		`{"ID": "linked1", "Embedding": [1, 2], "ObjectID": "missing"}`,
+		`{"ID": "linked2", "Embedding": [1, 2]}`,
+	)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, 2, result.Imported)
+	if assert.NotNil(t, result.Row) {
+		assert.Equal(t, 1, *result.Row)
+	}
+	_, err = storage.GetVector("linked2")
+	assert.NoError(t, err)
+
+	unindexable := fmt.Sprintf(`{"ID": "unindexable", "Embedding": [1, 2], "Vectors": {%q: [1, 2]}}`, strings.Repeat("x", 1<<16))
+	status, result = importJSONL(10, `{"ID": "written0", "Embedding": [1, 2]}`, unindexable)
+	assert.Equal(t, http.StatusInternalServerError, status)
+	assert.Equal(t, 1, result.Imported)
+	if assert.NotNil(t, result.Row) {
+		assert.Equal(t, 1, *result.Row)
+	}
+
+	oversized := make([]byte, 4)
+	binary.LittleEndian.PutUint32(oversized, bulk.MaxDimension+1)
+	resp, err = http.Post(ts.URL+"/import?format=fvecs&id_prefix=big", "application/octet-stream", bytes.NewReader(oversized))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	header := fmt.Sprintf("{'descr': '<f4', 'fortran_order': False, 'shape': (1, %d), }\n", bulk.MaxDimension+1)
+	npyData := append([]byte("\x93NUMPY\x01\x00"), byte(len(header)), byte(len(header)>>8))
+	npyData = append(npyData, header...)
+	resp, err = http.Post(ts.URL+"/import?format=npy&id_prefix=big", "application/octet-stream", bytes.NewReader(npyData))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Get(ts.URL + "/export?format=parquet")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// fvecs and npy files cannot carry IDs or metadata in one response.
+	for _, format := range []string{bulk.FormatFvecs, bulk.FormatNPY} {
+		resp, err = http.Get(ts.URL + "/export?format=" + format)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	}
+
+	// A failed export removes the files the writers staged.
+	tempDir := t.TempDir()
+	t.Setenv("TMPDIR", tempDir)
+	for _, format := range []string{bulk.FormatNPY, bulk.FormatNPZ} {
+		writer, err := bulk.NewWriter(format, io.Discard, nil)
+		assert.NoError(t, err)
+		mixed := bulk.NewJSONLReader(strings.NewReader(`{"ID": "a", "Embedding": [1, 2]}` + "\n" + `{"ID": "b", "Embedding": [1]}`))
+		count, err := bulk.Export(mixed, writer)
+		assert.Error(t, err)
+		assert.Equal(t, 1, count)
+		entries, err := os.ReadDir(tempDir)
+		assert.NoError(t, err)
+		assert.Empty(t, entries)
+	}
+}
+
+func TestVectorBatches(t *testing.T) {
+	storage, ts := newTestServer(t)
+
+	doBatch := func(method string, payload interface{}) (int, map[string]int) {
+		jsonData, _ := json.Marshal(payload)
+		req, err := http.NewRequest(method, ts.URL+"/vectors/batch", bytes.NewBuffer(jsonData))
+		assert.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+
+		var response struct {
+			Results []struct {
+				ID     string `json:"id"`
+				Status int    `json:"status"`
+			} `json:"results"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+		statuses := make(map[string]int)
+		for _, result := range response.Results {
+			statuses[result.ID] = result.Status
+		}
+		return resp.StatusCode, statuses
+	}
+
+	vectors := make([]db.Vector, 100)
+	for n := range vectors {
+		vectors[n] = db.Vector{ID: fmt.Sprintf("vector%d", n), Embedding: []float64{0.1, float64(n) / 100, 0.3}}
+	}
+	status, statuses := doBatch(http.MethodPost, map[string]interface{}{"vectors": vectors})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, http.StatusCreated, statuses["vector42"])
+
+	status, statuses = doBatch(http.MethodPost, map[string]interface{}{"vectors": []db.Vector{
+		{ID: "vector1", Embedding: []float64{1, 1, 1}},
+		{ID: "fresh", Embedding: []float64{1, 1, 1}},
+		{ID: "", Embedding: []float64{1, 1, 1}},
+	}})
+	assert.Equal(t, http.StatusMultiStatus, status)
+	assert.Equal(t, http.StatusConflict, statuses["vector1"])
+	assert.Equal(t, http.StatusCreated, statuses["fresh"])
+	assert.Equal(t, http.StatusBadRequest, statuses[""])
+
+	status, statuses = doBatch(http.MethodPut, map[string]interface{}{"vectors": []db.Vector{
+		{ID: "vector1", Embedding: []float64{1, 1, 1}, Metadata: map[string]string{"upserted": "true"}},
+	}})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, http.StatusOK, statuses["vector1"])
+	vector, err := storage.GetVector("vector1")
+	assert.NoError(t, err)
+	assert.Equal(t, "true", vector.Metadata["upserted"])
+
+	status, statuses = doBatch(http.MethodDelete, map[string]interface{}{"ids": []string{"vector2", "vector3", "missing"}})
+	assert.Equal(t, http.StatusMultiStatus, status)
+	assert.Equal(t, http.StatusNoContent, statuses["vector2"])
+	assert.Equal(t, http.StatusNotFound, statuses["missing"])
+	_, err = storage.GetVector("vector2")
+	assert.ErrorIs(t, err, db.ErrVectorNotFound)
+}
+
+func TestUpsertSemantics(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	put := func(method, url string, vector db.Vector, header map[string]string) *http.Response {
+		jsonData, _ := json.Marshal(vector)
+		req, err := http.NewRequest(method, url, bytes.NewBuffer(jsonData))
+		assert.NoError(t, err)
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		return resp
+	}
+
+	original := db.Vector{ID: "vector1", Embedding: []float64{0.1, 0.2, 0.3}}
+	resp := put(http.MethodPost, ts.URL+"/vectors?mode=create", original, nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	resp = put(http.MethodPost, ts.URL+"/vectors?mode=create", original, nil)
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	resp = put(http.MethodPut, ts.URL+"/vectors/vector1", original, map[string]string{"If-None-Match": "*"})
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	resp, err := http.Get(ts.URL + "/vectors/vector1")
+	assert.NoError(t, err)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+
+	replaced := db.Vector{ID: "vector1", Embedding: []float64{0.9, 0.8, 0.7}}
+	resp = put(http.MethodPut, ts.URL+"/vectors/vector1", replaced, map[string]string{"If-Match": `"stale"`})
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	resp = put(http.MethodPut, ts.URL+"/vectors/vector1", replaced, map[string]string{"If-Match": etag})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotEqual(t, etag, resp.Header.Get("ETag"))
+
+	resp = put(http.MethodPut, ts.URL+"/vectors/vector2", db.Vector{Embedding: []float64{0.1, 0.2, 0.3}}, map[string]string{"If-Match": "*"})
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	resp = put(http.MethodPut, ts.URL+"/vectors/vector2", db.Vector{ID: "other", Embedding: []float64{0.1, 0.2, 0.3}}, nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = put(http.MethodPost, ts.URL+"/vectors", replaced, nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	search := func(embedding []float64) []*db.Vector {
+		searchReq := map[string]interface{}{"vector": db.Vector{Embedding: embedding}, "k": 10}
+		jsonData, _ := json.Marshal(searchReq)
+		resp, err := http.Post(ts.URL+"/search", "application/json", bytes.NewBuffer(jsonData))
+		assert.NoError(t, err)
+		var response struct {
+			Results []*db.Vector `json:"results"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+		return response.Results
+	}
+
+	assert.Empty(t, search(original.Embedding))
+	results := search(replaced.Embedding)
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, replaced.Embedding, results[0].Embedding)
+	}
+}
+
+func TestWriteRollback(t *testing.T) {
+	storage, err := db.NewDistributedStorageWithOptions([]string{"node1", "node2", "node3"}, db.StorageOptions{DataDir: t.TempDir()})
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	idx, err := index.NewIndex(storage)
+	assert.NoError(t, err)
+	defer idx.Close()
+
+	// A named embedding whose segment key is too long fails after the
+	// vector has been written to storage.
+	unindexable := func(id string) *db.Vector {
+		return &db.Vector{ID: id, Embedding: []float64{0.9, 0.8, 0.7}, Vectors: map[string][]float64{
+			"a":                        {0.5, 0.5},
+			strings.Repeat("x", 1<<16): {0.5, 0.5},
+		}}
+	}
+	search := func(embedding []float64) []string {
+		vectors, err := idx.Search(&db.Vector{Embedding: embedding}, 10)
+		assert.NoError(t, err)
+		return getResultIDs(vectors)
+	}
+
+	_, err = idx.Put(unindexable("new"), db.WriteUpsert, "")
+	assert.Error(t, err)
+	_, err = storage.GetVector("new")
+	assert.ErrorIs(t, err, db.ErrVectorNotFound)
+	assert.Empty(t, search([]float64{0.9, 0.8, 0.7}))
+
+	original := &db.Vector{ID: "kept", Embedding: []float64{0.1, 0.2, 0.3}, Vectors: map[string][]float64{"a": {1, 0}}}
+	assert.NoError(t, idx.Insert(original))
+	_, err = idx.Put(unindexable("kept"), db.WriteUpsert, "")
+	assert.Error(t, err)
+	stored, err := storage.GetVector("kept")
+	assert.NoError(t, err)
+	assert.Equal(t, original.Embedding, stored.Embedding)
+	assert.Equal(t, []string{"kept"}, search(original.Embedding))
+	assert.Empty(t, search([]float64{0.9, 0.8, 0.7}))
+
+	results, err := idx.Query(&index.Query{Vector: &db.Vector{Vectors: map[string][]float64{"a": {1, 0}}}, Field: "a", K: 10})
+	assert.NoError(t, err)
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, "kept", results[0].ID)
+	}
+
+	errs := idx.WriteVectors([]*db.Vector{unindexable("batch"), {ID: "other", Embedding: []float64{0.4, 0.5, 0.6}}}, db.WriteUpsert)
+	assert.Error(t, errs[0])
+	assert.NoError(t, errs[1])
+	_, err = storage.GetVector("batch")
+	assert.ErrorIs(t, err, db.ErrVectorNotFound)
+
+	assert.NoError(t, idx.Delete("kept"))
+	_, err = storage.GetVector("kept")
+	assert.ErrorIs(t, err, db.ErrVectorNotFound)
+	assert.Empty(t, search(original.Embedding))
+}
+
+func TestSearchBatch(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	vectors := make([]*db.Vector, 20)
+	for n := range vectors {
+		category := "even"
+		if n%2 == 1 {
+			category = "odd"
+		}
+		vectors[n] = &db.Vector{ID: fmt.Sprintf("vector%d", n), Embedding: []float64{0.1, 0.2, float64(n) / 20}, Metadata: map[string]string{"category": category}}
+	}
+	jsonData, _ := json.Marshal(map[string]interface{}{"vectors": vectors})
+	req, err := http.NewRequest(http.MethodPut, ts.URL+"/vectors/batch", bytes.NewBuffer(jsonData))
+	assert.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	batchReq := map[string]interface{}{
+		"queries": []interface{}{
+			map[string]interface{}{"vector": db.Vector{Embedding: []float64{0.1, 0.2, 0.3}}, "k": 3},
+			map[string]interface{}{"vector": db.Vector{Embedding: []float64{0.1, 0.2, 0.3}}, "k": 5, "filter": map[string]string{"category": "odd"}},
+			map[string]interface{}{"vector": db.Vector{Embedding: []float64{0.1, 0.2, 0.3}}, "k": 0},
+		},
+	}
+	jsonData, _ = json.Marshal(batchReq)
+	resp, err = http.Post(ts.URL+"/search/batch", "application/json", bytes.NewBuffer(jsonData))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+
+	var response struct {
+		Results []struct {
+			Results []*db.Vector `json:"results"`
+			Error   string       `json:"error"`
+		} `json:"results"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+	assert.Len(t, response.Results, 3)
+	assert.Len(t, response.Results[0].Results, 3)
+	assert.Len(t, response.Results[1].Results, 5)
+	for _, vector := range response.Results[1].Results {
+		assert.Equal(t, "odd", vector.Metadata["category"])
+	}
+	assert.NotEmpty(t, response.Results[2].Error)
+
+	jsonData, _ = json.Marshal(map[string]interface{}{"vector": db.Vector{Embedding: []float64{0.1, 0.2, 0.3}}, "k": 3})
+	resp, err = http.Post(ts.URL+"/search", "application/json", bytes.NewBuffer(jsonData))
+	assert.NoError(t, err)
+	var single struct {
+		Results []*db.Vector `json:"results"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&single))
+	assert.Equal(t, getResultIDs(single.Results), getResultIDs(response.Results[0].Results))
+}
+
+func getResultIDs(vectors []*db.Vector) []string {
+	ids := make([]string, len(vectors))
+	for n, vector := range vectors {
+		ids[n] = vector.ID
+	}
+	return ids
+}
+
+func TestSimilarVectors(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	for n := 0; n < 10; n++ {
+		category := "even"
+		if n%2 == 1 {
+			category = "odd"
+		}
+		vector := db.Vector{ID: fmt.Sprintf("vector%d", n), Embedding: []float64{0.1, 0.2, float64(n) / 10}, Metadata: map[string]string{"category": category}}
+		jsonData, _ := json.Marshal(vector)
+		resp, err := http.Post(ts.URL+"/vectors", "application/json", bytes.NewBuffer(jsonData))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+
+	similar := func(url string, payload interface{}) (int, []*db.Vector) {
+		jsonData, _ := json.Marshal(payload)
+		resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+		assert.NoError(t, err)
+		var response struct {
+			Results []*db.Vector `json:"results"`
+		}
+		json.NewDecoder(resp.Body).Decode(&response)
+		return resp.StatusCode, response.Results
+	}
+
+	status, results := similar(ts.URL+"/vectors/vector3/similar", map[string]interface{}{"k": 4})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, results, 4)
+	assert.NotContains(t, getResultIDs(results), "vector3")
+
+	status, results = similar(ts.URL+"/vectors/vector3/similar", map[string]interface{}{"k": 4, "filter": map[string]string{"category": "odd"}})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, results, 4)
+	for _, vector := range results {
+		assert.Equal(t, "odd", vector.Metadata["category"])
+		assert.NotEqual(t, "vector3", vector.ID)
+	}
+
+	status, results = similar(ts.URL+"/search", map[string]interface{}{"id": "vector3", "k": 3})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, results, 3)
+	assert.NotContains(t, getResultIDs(results), "vector3")
+
+	status, _ = similar(ts.URL+"/vectors/missing/similar", map[string]interface{}{"k": 3})
+	assert.Equal(t, http.StatusNotFound, status)
+
+	resp, err := http.Post(ts.URL+"/vectors/vector3/similar", "application/json", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestSearchScores(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	for n := 0; n < 5; n++ {
+		vector := db.Vector{ID: fmt.Sprintf("vector%d", n), Embedding: []float64{0.1, 0.2, float64(n) / 10}, Text: fmt.Sprintf("text content for vector%d", n)}
+		jsonData, _ := json.Marshal(vector)
+		resp, err := http.Post(ts.URL+"/vectors", "application/json", bytes.NewBuffer(jsonData))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+
+	type hit struct {
+		ID          string
+		Embedding   []float64
+		Text        string
+		Score       float64  `json:"score"`
+		Distance    float64  `json:"distance"`
+		RerankScore *float64 `json:"rerank_score"`
+		FinalScore  float64  `json:"final_score"`
+	}
+	search := func(payload interface{}) []hit {
+		jsonData, _ := json.Marshal(payload)
+		resp, err := http.Post(ts.URL+"/search", "application/json", bytes.NewBuffer(jsonData))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		var response struct {
+			Results []hit `json:"results"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+		return response.Results
+	}
+
+	hits := search(map[string]interface{}{"vector": db.Vector{Embedding: []float64{0.1, 0.2, 0.3}}, "k": 3})
+	if assert.Len(t, hits, 3) {
+		assert.Equal(t, "vector3", hits[0].ID)
+		assert.InDelta(t, 1.0, hits[0].Score, 1e-9)
+		assert.InDelta(t, 1-hits[1].Score, hits[1].Distance, 1e-9)
+		assert.True(t, hits[0].Score >= hits[1].Score && hits[1].Score >= hits[2].Score)
+		assert.Nil(t, hits[0].RerankScore)
+		assert.Equal(t, hits[0].Score, hits[0].FinalScore)
+		assert.NotEmpty(t, hits[0].Embedding)
+	}
+
+	hits = search(map[string]interface{}{"vector": db.Vector{Embedding: []float64{0.1, 0.2, 0.3}, Text: "text content for vector2"}, "k": 3, "omit_embedding": true, "omit_text": true})
+	if assert.Len(t, hits, 3) {
+		assert.Equal(t, "vector2", hits[0].ID)
+		if assert.NotNil(t, hits[0].RerankScore) {
+			assert.Equal(t, *hits[0].RerankScore, hits[0].FinalScore)
+		}
+		assert.True(t, hits[0].Score > 0)
+		assert.Empty(t, hits[0].Embedding)
+		assert.Empty(t, hits[0].Text)
+	}
+}
+
+func TestRangeSearch(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	vectors := make([]*db.Vector, 50)
+	for n := range vectors {
+		vectors[n] = &db.Vector{ID: fmt.Sprintf("vector%d", n), Embedding: []float64{1, float64(n) / 10}}
+	}
+	jsonData, _ := json.Marshal(map[string]interface{}{"vectors": vectors})
+	req, err := http.NewRequest(http.MethodPut, ts.URL+"/vectors/batch", bytes.NewBuffer(jsonData))
+	assert.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	type hit struct {
+		ID       string
+		Score    float64 `json:"score"`
+		Distance float64 `json:"distance"`
+	}
+	search := func(payload interface{}) []hit {
+		jsonData, _ := json.Marshal(payload)
+		resp, err := http.Post(ts.URL+"/search", "application/json", bytes.NewBuffer(jsonData))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		var response struct {
+			Results []hit `json:"results"`
+		}
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+		return response.Results
+	}
+
+	query := db.Vector{Embedding: []float64{1, 0}}
+	hits := search(map[string]interface{}{"vector": query, "threshold": 0.98})
+	assert.Len(t, hits, 3)
+	for _, hit := range hits {
+		assert.GreaterOrEqual(t, hit.Score, 0.98)
+	}
+
+	hits = search(map[string]interface{}{"vector": query, "threshold": 0.5, "metric": "euclidean"})
+	assert.Len(t, hits, 6)
+	for n, hit := range hits {
+		assert.LessOrEqual(t, hit.Distance, 0.5)
+		if n > 0 {
+			assert.GreaterOrEqual(t, hit.Distance, hits[n-1].Distance)
+		}
+	}
+
+	hits = search(map[string]interface{}{"vector": query, "threshold": 0.5, "metric": "euclidean", "max_results": 2})
+	assert.Equal(t, []string{"vector0", "vector1"}, []string{hits[0].ID, hits[1].ID})
+
+	jsonData, _ = json.Marshal(map[string]interface{}{"vector": query, "threshold": 0.0, "omit_embedding": true})
+	req, err = http.NewRequest(http.MethodPost, ts.URL+"/search", bytes.NewBuffer(jsonData))
+	assert.NoError(t, err)
+	req.Header.Set("Accept", "application/x-ndjson")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+	decoder := json.NewDecoder(resp.Body)
+	streamed := 0
+	for decoder.More() {
+		var h hit
+		assert.NoError(t, decoder.Decode(&h))
+		streamed++
+	}
+	assert.Equal(t, 50, streamed)
+
+	jsonData, _ = json.Marshal(map[string]interface{}{"vector": query, "threshold": 0.5, "metric": "manhattan"})
+	resp, err = http.Post(ts.URL+"/search", "application/json", bytes.NewBuffer(jsonData))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestListVectorsAndObjects(t *testing.T) {
+	storage, idx, ts := newTestIndex(t)
+
+	vectors := make([]*db.Vector, 25)
+	for n := range vectors {
+		category := "even"
+		if n%2 == 1 {
+			category = "odd"
+		}
+		vectors[n] = &db.Vector{ID: fmt.Sprintf("vector%02d", n), Embedding: []float64{0.1, float64(n)}, Metadata: map[string]string{"category": category}}
+	}
+	for _, err := range idx.WriteVectors(vectors, db.WriteUpsert) {
+		assert.NoError(t, err)
+	}
+	for n := 0; n < 3; n++ {
+		assert.NoError(t, storage.InsertObject(&db.Object{ID: fmt.Sprintf("object%d", n), Object: []byte("content"), Metadata: map[string]string{"name": fmt.Sprint(n)}}))
+	}
+
+	type page struct {
+		Vectors    []map[string]interface{} `json:"vectors"`
+		Objects    []map[string]interface{} `json:"objects"`
+		NextCursor string                   `json:"next_cursor"`
+	}
+	list := func(url string) page {
+		resp, err := http.Get(url)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		var p page
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&p))
+		return p
+	}
+
+	var ids []string
+	cursor := ""
+	for pages := 0; pages < 10; pages++ {
+		p := list(ts.URL + "/vectors?limit=10&fields=id,metadata&cursor=" + cursor)
+		for _, vector := range p.Vectors {
+			ids = append(ids, vector["ID"].(string))
+			assert.NotContains(t, vector, "Embedding")
+			assert.Contains(t, vector, "Metadata")
+		}
+		cursor = p.NextCursor
+		if cursor == "" {
+			break
+		}
+	}
+	assert.Len(t, ids, 25)
+	assert.Equal(t, "vector00", ids[0])
+	assert.Equal(t, "vector24", ids[24])
+
+	p := list(ts.URL + "/vectors?filter=category:odd&limit=100")
+	assert.Len(t, p.Vectors, 12)
+	assert.Empty(t, p.NextCursor)
+
+	p = list(ts.URL + "/objects?limit=2")
+	assert.Len(t, p.Objects, 2)
+	assert.Equal(t, "object1", p.NextCursor)
+	p = list(ts.URL + "/objects?limit=2&cursor=" + p.NextCursor)
+	assert.Len(t, p.Objects, 1)
+	assert.Equal(t, "object2", p.Objects[0]["id"])
+
+	resp, err := http.Get(ts.URL + "/vectors?filter=category")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestStreamVectors(t *testing.T) {
+	storage, idx, ts := newTestIndex(t)
+
+	vectors := make([]*db.Vector, 1200)
+	for n := range vectors {
+		vectors[n] = &db.Vector{ID: fmt.Sprintf("vector%d", n), Embedding: []float64{0.1, float64(n)}, Metadata: map[string]string{"shard": fmt.Sprint(n % 3)}}
+	}
+	for _, err := range idx.WriteVectors(vectors, db.WriteUpsert) {
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, storage.InsertObject(&db.Object{ID: "object1", Object: []byte("content")}))
+
+	iterator := storage.IterateVectors(db.ListOptions{Limit: 7})
+	seen := make(map[string]bool)
+	for {
+		vector, err := iterator.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		seen[vector.ID] = true
+	}
+	assert.Len(t, seen, 1200)
+
+	resp, err := http.Get(ts.URL + "/vectors/stream?filter=shard:1&fields=id")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+
+	decoder := json.NewDecoder(resp.Body)
+	streamed := make(map[string]bool)
+	for decoder.More() {
+		var item map[string]interface{}
+		assert.NoError(t, decoder.Decode(&item))
+		assert.Len(t, item, 1)
+		streamed[item["ID"].(string)] = true
+	}
+	assert.Len(t, streamed, 400)
+}
+
+func TestRerankers(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	entries := []db.Vector{
+		{ID: "apple", Embedding: []float64{1, 0.1, 0}, Text: "apple pie recipe", Metadata: map[string]string{"category": "food"}},
+		{ID: "apple-copy", Embedding: []float64{1, 0.1, 0.001}, Text: "apple pie recipe again", Metadata: map[string]string{"category": "food"}},
+		{ID: "banana", Embedding: []float64{1, 0.3, 0}, Text: "banana bread", Metadata: map[string]string{"category": "food"}},
+		{ID: "car", Embedding: []float64{1, 0.5, 0.2}, Text: "fast red car", Metadata: map[string]string{"category": "vehicle"}},
+	}
+	for _, entry := range entries {
+		jsonData, _ := json.Marshal(entry)
+		resp, err := http.Post(ts.URL+"/vectors", "application/json", bytes.NewBuffer(jsonData))
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	}
+
+	type hit struct {
+		ID          string
+		RerankScore *float64 `json:"rerank_score"`
+	}
+	search := func(payload map[string]interface{}) (int, []string, []hit) {
+		jsonData, _ := json.Marshal(payload)
+		resp, err := http.Post(ts.URL+"/search", "application/json", bytes.NewBuffer(jsonData))
+		assert.NoError(t, err)
+		var response struct {
+			Results []hit `json:"results"`
+		}
+		json.NewDecoder(resp.Body).Decode(&response)
+		ids := make([]string, len(response.Results))
+		for n, h := range response.Results {
+			ids[n] = h.ID
+		}
+		return resp.StatusCode, ids, response.Results
+	}
+	query := func(text string) db.Vector {
+		return db.Vector{Embedding: []float64{1, 0.1, 0}, Text: text}
+	}
+
+	status, ids, hits := search(map[string]interface{}{"vector": query(""), "k": 4})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "apple", ids[0])
+	assert.Nil(t, hits[0].RerankScore)
+
+	status, ids, _ = search(map[string]interface{}{"vector": query("red car"), "k": 4, "reranker": "bm25"})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "car", ids[0])
+
+	status, ids, hits = search(map[string]interface{}{"vector": query("red car"), "k": 4, "reranker": "none"})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "apple", ids[0])
+	assert.Nil(t, hits[0].RerankScore)
+
+	status, ids, _ = search(map[string]interface{}{"vector": query(""), "k": 4, "reranker": "metadata", "rerank_params": map[string]interface{}{"boosts": []map[string]interface{}{{"key": "category", "value": "vehicle", "weight": 10}}}})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "car", ids[0])
+
+	boost := func(weight float64) map[string]interface{} {
+		return map[string]interface{}{"boosts": []map[string]interface{}{{"key": "category", "value": "vehicle", "weight": weight}}}
+	}
+	status, _, _ = search(map[string]interface{}{"vector": query(""), "k": 4, "reranker": "metadata", "rerank_params": boost(0)})
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// Boosting a hit with a negative similarity still raises it.
+	opposite := db.Vector{Embedding: []float64{-1, 0.1, 0.2}}
+	status, ids, _ = search(map[string]interface{}{"vector": opposite, "k": 4, "reranker": "none"})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "car", ids[0])
+	status, ids, _ = search(map[string]interface{}{"vector": opposite, "k": 4, "reranker": "metadata", "rerank_params": boost(0.5)})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "car", ids[len(ids)-1])
+
+	status, ids, _ = search(map[string]interface{}{"vector": query(""), "k": 4, "reranker": "mmr", "rerank_params": map[string]interface{}{"lambda": 0.3}})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "apple", ids[0])
+	assert.NotEqual(t, "apple-copy", ids[1])
+
+	crossEncoder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Query     string   `json:"query"`
+			Documents []string `json:"documents"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		scores := make([]float64, len(request.Documents))
+		for n, document := range request.Documents {
+			if strings.Contains(document, "banana") {
+				scores[n] = 1
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"scores": scores})
+	}))
+	defer crossEncoder.Close()
+	index.RegisterReranker("test-cross-encoder", index.NewCrossEncoder(crossEncoder.URL, time.Second))
+
+	status, ids, _ = search(map[string]interface{}{"vector": query("bread"), "k": 4, "reranker": "test-cross-encoder"})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "banana", ids[0])
+
+	status, _, _ = search(map[string]interface{}{"vector": query(""), "k": 4, "reranker": "unknown"})
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _, _ = search(map[string]interface{}{"vector": query(""), "k": 4, "reranker": "bm25"})
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	stream := func(payload map[string]interface{}) (int, []string) {
+		jsonData, _ := json.Marshal(payload)
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/search", bytes.NewBuffer(jsonData))
+		req.Header.Set("Accept", "application/x-ndjson")
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		var ids []string
+		decoder := json.NewDecoder(resp.Body)
+		for resp.StatusCode == http.StatusOK {
+			var h hit
+			if decoder.Decode(&h) != nil {
+				break
+			}
+			ids = append(ids, h.ID)
+		}
+		return resp.StatusCode, ids
+	}
+	for _, payload := range []map[string]interface{}{
+		{"vector": query("red car"), "k": 4, "reranker": "bm25"},
+		{"vector": query("banana bread"), "k": 4},
+		{"vector": query(""), "k": 2, "mmr": map[string]interface{}{"lambda": 0.3}},
+		{"vector": query("bread"), "k": 4, "reranker": "test-cross-encoder"},
+	} {
+		_, expected, _ := search(payload)
+		status, ids := stream(payload)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, expected, ids)
+	}
+	_, ids = stream(map[string]interface{}{"vector": query("red car"), "k": 4, "reranker": "bm25"})
+	assert.Equal(t, "car", ids[0])
+	status, _ = stream(map[string]interface{}{"vector": query(""), "k": 4, "reranker": "bm25"})
+	assert.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestRerankerDoesNotBlockWrites(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	resp, err := http.Post(ts.URL+"/vectors", "application/json", strings.NewReader(`{"ID": "first", "Embedding": [1, 0]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	started := make(chan bool)
+	release := make(chan bool)
+	index.RegisterReranker("test-blocking", index.RerankFunc(func(request *index.RerankRequest) ([]*index.Result, error) {
+		started <- true
+		<-release
+		return request.Results, nil
+	}))
+
+	searched := make(chan int)
+	go func() {
+		resp, err := http.Post(ts.URL+"/search", "application/json", strings.NewReader(`{"vector": {"Embedding": [1, 0]}, "k": 1, "reranker": "test-blocking"}`))
+		if err != nil {
+			searched <- 0
+			return
+		}
+		resp.Body.Close()
+		searched <- resp.StatusCode
+	}()
+	<-started
+
+	written := make(chan int)
+	go func() {
+		resp, err := http.Post(ts.URL+"/vectors", "application/json", strings.NewReader(`{"ID": "second", "Embedding": [0, 1]}`))
+		if err != nil {
+			written <- 0
+			return
+		}
+		resp.Body.Close()
+		written <- resp.StatusCode
+	}()
+
+	select {
+	case status := <-written:
+		assert.Equal(t, http.StatusCreated, status)
+	case <-time.After(5 * time.Second):
+		t.Error("write waited for the reranker")
+	}
+	close(release)
+	assert.Equal(t, http.StatusOK, <-searched)
+}
+
+func TestMMRSearch(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	var vectors []*db.Vector
+	for n := 0; n < 5; n++ {
+		vectors = append(vectors, &db.Vector{ID: fmt.Sprintf("duplicate%d", n), Embedding: []float64{1, 0.1, 0.001 * float64(n)}})
+	}
+	vectors = append(vectors,
+		&db.Vector{ID: "different1", Embedding: []float64{1, 0.1, 0.6}},
+		&db.Vector{ID: "different2", Embedding: []float64{1, 0.1, -0.6}},
+	)
+	jsonData, _ := json.Marshal(map[string]interface{}{"vectors": vectors})
+	req, err := http.NewRequest(http.MethodPut, ts.URL+"/vectors/batch", bytes.NewBuffer(jsonData))
+	assert.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	search := func(payload map[string]interface{}) (int, []string) {
+		jsonData, _ := json.Marshal(payload)
+		resp, err := http.Post(ts.URL+"/search", "application/json", bytes.NewBuffer(jsonData))
+		assert.NoError(t, err)
+		var response struct {
+			Results []*db.Vector `json:"results"`
+		}
+		json.NewDecoder(resp.Body).Decode(&response)
+		return resp.StatusCode, getResultIDs(response.Results)
+	}
+
+	query := db.Vector{Embedding: []float64{1, 0.1, 0}}
+	status, ids := search(map[string]interface{}{"vector": query, "k": 3})
+	assert.Equal(t, http.StatusOK, status)
+	for _, id := range ids {
+		assert.True(t, strings.HasPrefix(id, "duplicate"))
+	}
+
+	status, ids = search(map[string]interface{}{"vector": query, "k": 3, "mmr": map[string]interface{}{"lambda": 0.3, "fetch_k": 7}})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Len(t, ids, 3)
+	assert.Equal(t, "duplicate0", ids[0])
+	assert.ElementsMatch(t, []string{"duplicate0", "different1", "different2"}, ids)
+
+	status, _ = search(map[string]interface{}{"vector": query, "k": 3, "mmr": map[string]interface{}{"lambda": 2}})
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	// Redundancy is measured on the named field the query scored, not on
+	// the default embeddings, which here rank the opposite way.
+	named := []*db.Vector{
+		{ID: "photo1", Embedding: []float64{1, 0, 0}, Vectors: map[string][]float64{"image": {1, 0, 0}}},
+		{ID: "photo2", Embedding: []float64{0, 1, 0}, Vectors: map[string][]float64{"image": {1, 0.1, 0}}},
+		{ID: "photo3", Embedding: []float64{1, 0, 0}, Vectors: map[string][]float64{"image": {1, 0, 0.75}}},
+	}
+	jsonData, _ = json.Marshal(map[string]interface{}{"vectors": named})
+	req, err = http.NewRequest(http.MethodPut, ts.URL+"/vectors/batch", bytes.NewBuffer(jsonData))
+	assert.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	imageQuery := db.Vector{Vectors: map[string][]float64{"image": {1, 0, 0}}}
+	status, ids = search(map[string]interface{}{"vector": imageQuery, "field": "image", "k": 2, "mmr": map[string]interface{}{"lambda": 0.3, "fetch_k": 3}})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"photo1", "photo3"}, ids)
+
+	status, ids = search(map[string]interface{}{"vector": imageQuery, "field": "image", "k": 3, "reranker": "mmr", "rerank_params": map[string]interface{}{"lambda": 0.3}})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"photo1", "photo3", "photo2"}, ids)
+}
+
+func TestGroupedSearch(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	var vectors []*db.Vector
+	for doc := 0; doc < 4; doc++ {
+		for chunk := 0; chunk < 5; chunk++ {
+			vectors = append(vectors, &db.Vector{
+				ID:        fmt.Sprintf("doc%d-chunk%d", doc, chunk),
+				Embedding: []float64{1, 0.1, float64(doc)/10 + float64(chunk)/100},
+				Metadata:  map[string]string{"doc_id": fmt.Sprintf("doc%d", doc)},
+			})
+		}
+	}
+	vectors = append(vectors, &db.Vector{ID: "orphan", Embedding: []float64{1, 0.1, 0}})
+	jsonData, _ := json.Marshal(map[string]interface{}{"vectors": vectors})
+	req, err := http.NewRequest(http.MethodPut, ts.URL+"/vectors/batch", bytes.NewBuffer(jsonData))
+	assert.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	searchReq := map[string]interface{}{
+		"vector":         db.Vector{Embedding: []float64{1, 0.1, 0}},
+		"group_by":       "doc_id",
+		"group_size":     2,
+		"limit":          3,
+		"omit_embedding": true,
+	}
+	jsonData, _ = json.Marshal(searchReq)
+	resp, err = http.Post(ts.URL+"/search", "application/json", bytes.NewBuffer(jsonData))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var response struct {
+		Groups []struct {
+			Group string `json:"group"`
+			Hits  []struct {
+				ID    string
+				Score float64 `json:"score"`
+			} `json:"hits"`
+		} `json:"groups"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+	if assert.Len(t, response.Groups, 3) {
+		assert.Equal(t, []string{"doc0", "doc1", "doc2"}, []string{response.Groups[0].Group, response.Groups[1].Group, response.Groups[2].Group})
+		for _, group := range response.Groups {
+			if assert.Len(t, group.Hits, 2) {
+				assert.Equal(t, group.Group+"-chunk0", group.Hits[0].ID)
+				assert.GreaterOrEqual(t, group.Hits[0].Score, group.Hits[1].Score)
+			}
+		}
+	}
+}
+
+func TestMultiVectorDocuments(t *testing.T) {
+	dataDir := t.TempDir()
+	storage, err := db.NewDistributedStorageWithOptions([]string{"node1", "node2"}, db.StorageOptions{DataDir: dataDir})
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	idx, err := index.NewIndex(storage)
+	assert.NoError(t, err)
+
+	ids := func(results []*index.Result) []string {
+		var ids []string
+		for _, result := range results {
+			ids = append(ids, result.ID)
+		}
+		return ids
+	}
+
+	documents := []*db.Vector{
+		{ID: "cats", Embeddings: [][]float64{{1, 0, 0}, {0.9, 0.1, 0}, {0, 0, 1}}, Text: "cats sleep a lot"},
+		{ID: "dogs", Embeddings: [][]float64{{0, 1, 0}, {0.1, 0.9, 0}}, Text: "dogs bark"},
+		{ID: "single", Embedding: []float64{0.6, 0.4, 0}},
+	}
+	for _, document := range documents {
+		assert.NoError(t, document.Validate())
+		assert.NoError(t, idx.Insert(document))
+	}
+
+	query := &index.Query{Vector: &db.Vector{Embeddings: [][]float64{{1, 0, 0}, {0, 0, 1}}}, K: 3}
+	results, err := idx.Query(query)
+	assert.NoError(t, err)
+	if assert.NotEmpty(t, results) {
+		assert.Equal(t, "cats", results[0].ID)
+		assert.InDelta(t, 1.0, results[0].Score, 1e-9)
+		assert.Len(t, results[0].Embeddings, 3)
+	}
+
+	results, err = idx.Query(&index.Query{Vector: &db.Vector{Embedding: []float64{0, 0.9, 0.1}}, K: 1})
+	assert.NoError(t, err)
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, "dogs", results[0].ID)
+	}
+
+	assert.NoError(t, idx.Insert(&db.Vector{ID: "cats", Embeddings: [][]float64{{0, 0.5, 0.5}}}))
+	results, err = idx.Query(&index.Query{ID: "dogs", K: 5})
+	assert.NoError(t, err)
+	assert.NotContains(t, ids(results), "dogs")
+
+	assert.NoError(t, idx.Close())
+	idx, err = index.NewIndex(storage)
+	assert.NoError(t, err)
+	defer idx.Close()
+
+	results, err = idx.Query(query)
+	assert.NoError(t, err)
+	if assert.NotEmpty(t, results) {
+		assert.NotEqual(t, "cats", results[0].ID)
+	}
+	for _, result := range results {
+		if result.ID == "cats" {
+			assert.InDelta(t, 0.5*(0+0.5/math.Sqrt(0.5)), result.Score, 1e-9)
+		}
+	}
+
+	assert.NoError(t, idx.Delete("dogs"))
+	results, err = idx.Query(&index.Query{Vector: &db.Vector{Embeddings: [][]float64{{0, 1, 0}}}, Threshold: new(float64)})
+	assert.NoError(t, err)
+	assert.NotContains(t, ids(results), "dogs")
+	assert.ElementsMatch(t, []string{"cats", "single"}, ids(results))
+}
+
+func TestNamedEmbeddings(t *testing.T) {
+	dataDir := t.TempDir()
+	storage, err := db.NewDistributedStorageWithOptions([]string{"node1", "node2"}, db.StorageOptions{DataDir: dataDir})
+	assert.NoError(t, err)
+	defer storage.Close()
+
+	idx, err := index.NewIndex(storage)
+	assert.NoError(t, err)
+
+	ids := func(results []*index.Result) []string {
+		var ids []string
+		for _, result := range results {
+			ids = append(ids, result.ID)
+		}
+		return ids
+	}
+
+	records := []*db.Vector{
+		{ID: "a", Vectors: map[string][]float64{"text": {1, 0, 0}, "image": {1, 0, 0}}},
+		{ID: "b", Vectors: map[string][]float64{"text": {0, 1, 0}, "image": {0, 1}}},
+		{ID: "c", Embedding: []float64{1, 0, 0}},
+	}
+	for _, record := range records {
+		assert.NoError(t, record.Validate())
+		assert.NoError(t, idx.Insert(record))
+	}
+
+	results, err := idx.Query(&index.Query{Vector: &db.Vector{Vectors: map[string][]float64{"text": {1, 0, 0}}}, Field: "text", K: 3})
+	assert.NoError(t, err)
+	if assert.NotEmpty(t, results) {
+		assert.Equal(t, "a", results[0].ID)
+		assert.Len(t, results[0].Vectors, 2)
+	}
+	assert.NotContains(t, ids(results), "c")
+
+	results, err = idx.Query(&index.Query{Vector: &db.Vector{Embedding: []float64{1, 0, 0}}, K: 3})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c"}, ids(results))
+
+	fused := &index.Query{
+		Vector: &db.Vector{Vectors: map[string][]float64{"text": {1, 0, 0}, "image": {0, 1}}},
+		Fields: map[string]float64{"text": 0.3, "image": 0.7},
+		K:      2,
+	}
+	results, err = idx.Query(fused)
+	assert.NoError(t, err)
+	if assert.NotEmpty(t, results) {
+		assert.Equal(t, "b", results[0].ID)
+		assert.InDelta(t, 0.7, results[0].Score, 1e-9)
+	}
+
+	_, err = idx.Query(&index.Query{Vector: fused.Vector, Field: "text", Fields: fused.Fields, K: 2})
+	assert.Error(t, err)
+
+	assert.NoError(t, idx.Insert(&db.Vector{ID: "a", Vectors: map[string][]float64{"image": {0.8, 0.2}}}))
+	results, err = idx.Query(&index.Query{Vector: &db.Vector{Embedding: []float64{1, 0, 0}}, Field: "text", Threshold: new(float64)})
+	assert.NoError(t, err)
+	assert.NotContains(t, ids(results), "a")
+
+	assert.NoError(t, idx.Delete("b"))
+
+	assert.NoError(t, idx.Close())
+	idx, err = index.NewIndex(storage)
+	assert.NoError(t, err)
+	defer idx.Close()
+
+	results, err = idx.Query(&index.Query{Vector: &db.Vector{Embedding: []float64{0, 1}}, Field: "image", Threshold: new(float64)})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a"}, ids(results))
+
+	for _, id := range []string{"a\x01image", "image\x00"} {
+		vector := &db.Vector{ID: id, Vectors: map[string][]float64{"image": {1, 0}}}
+		assert.Error(t, vector.Validate(), "%q", id)
+	}
+	assert.NoError(t, (&db.Vector{ID: "a:image", Vectors: map[string][]float64{"image": {1, 0}}}).Validate())
+}
+
+func TestLinkedObjects(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("object", "photo.txt")
+	assert.NoError(t, err)
+	part.Write([]byte("photo bytes"))
+	writer.WriteField("data", `{"id": "photo", "metadata": {"content_type": "text/plain"}}`)
+	assert.NoError(t, writer.Close())
+
+	resp, err := http.Post(ts.URL+"/objects", writer.FormDataContentType(), body)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	post := func(vector db.Vector) int {
+		data, _ := json.Marshal(vector)
+		resp, err := http.Post(ts.URL+"/vectors", "application/json", bytes.NewReader(data))
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusCreated, post(db.Vector{ID: "photo-clip", Embedding: []float64{1, 0, 0}, ObjectID: "photo"}))
+	assert.Equal(t, http.StatusCreated, post(db.Vector{ID: "photo-caption", Embedding: []float64{0.9, 0.1, 0}, ObjectID: "photo"}))
+	assert.Equal(t, http.StatusCreated, post(db.Vector{ID: "unlinked", Embedding: []float64{0.8, 0.2, 0}}))
+	assert.Equal(t, http.StatusBadRequest, post(db.Vector{ID: "dangling", Embedding: []float64{1, 0, 0}, ObjectID: "missing"}))
+
+	resp, err = http.Post(ts.URL+"/search", "application/json", strings.NewReader(`{"vector": {"Embedding": [1, 0, 0]}, "k": 3, "include_object": true}`))
+	assert.NoError(t, err)
+	var searchResp struct {
+		Results []*index.Result `json:"results"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&searchResp))
+	resp.Body.Close()
+	if assert.Len(t, searchResp.Results, 3) {
+		for _, result := range searchResp.Results {
+			if result.ObjectID == "photo" {
+				if assert.NotNil(t, result.LinkedObject) {
+					sum := sha256.Sum256([]byte("photo bytes"))
+					assert.Equal(t, &index.LinkedObject{
+						ID:         "photo",
+						Metadata:   map[string]string{"content_type": "text/plain"},
+						Version:    1,
+						Digest:     hex.EncodeToString(sum[:]),
+						Size:       11,
+						ContentURL: "/objects/photo/content",
+					}, result.LinkedObject)
+					resp, err := http.Get(ts.URL + result.LinkedObject.ContentURL)
+					assert.NoError(t, err)
+					data, _ := io.ReadAll(resp.Body)
+					resp.Body.Close()
+					assert.Equal(t, "photo bytes", string(data))
+				}
+			} else {
+				assert.Nil(t, result.LinkedObject)
+			}
+		}
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/vectors/photo-clip/object", nil)
+	req.Header.Set("Range", "bytes=0-4")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "photo", string(data))
+
+	req, _ = http.NewRequest(http.MethodDelete, ts.URL+"/objects/photo", nil)
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	for id, status := range map[string]int{"photo-clip": http.StatusNotFound, "photo-caption": http.StatusNotFound, "unlinked": http.StatusOK} {
+		resp, err = http.Get(ts.URL + "/vectors/" + id)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, status, resp.StatusCode, id)
+	}
+
+	resp, err = http.Post(ts.URL+"/search", "application/json", strings.NewReader(`{"vector": {"Embedding": [1, 0, 0]}, "k": 3}`))
+	assert.NoError(t, err)
+	searchResp.Results = nil
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&searchResp))
+	resp.Body.Close()
+	if assert.Len(t, searchResp.Results, 1) {
+		assert.Equal(t, "unlinked", searchResp.Results[0].ID)
+	}
+}
+
+func TestStreamingObjects(t *testing.T) {
+	storage, ts := newTestServer(t)
+	storage.SetVersionRetention(0)
+
+	content := make([]byte, 2*blob.DefaultChunkSize+123)
+	for n := range content {
+		content[n] = byte(n % 251)
+	}
+
+	upload := func(method, url string, data []byte) *http.Response {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		writer.WriteField("data", `{"id": "video", "metadata": {"name": "clip"}}`)
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", `form-data; name="object"; filename="clip.mp4"`)
+		header.Set("Content-Type", "video/mp4")
+		part, err := writer.CreatePart(header)
+		assert.NoError(t, err)
+		part.Write(data)
+		assert.NoError(t, writer.Close())
+
+		req, _ := http.NewRequest(method, url, body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+	countChunks := func() int {
+		count := 0
+		assert.NoError(t, storage.Blobs().Each(func(string) error {
+			count++
+			return nil
+		}))
+		return count
+	}
+
+	resp := upload(http.MethodPost, ts.URL+"/objects", content)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, 3, countChunks())
+
+	object, err := storage.GetObject("video")
+	assert.NoError(t, err)
+	assert.Empty(t, object.Object)
+	assert.Equal(t, "video/mp4", object.ContentType)
+	if assert.NotNil(t, object.Blob) {
+		assert.Equal(t, int64(len(content)), object.Blob.Size)
+	}
+
+	resp, err = http.Get(ts.URL + "/objects/video/content")
+	assert.NoError(t, err)
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "video/mp4", resp.Header.Get("Content-Type"))
+	assert.True(t, bytes.Equal(content, data))
+
+	start := blob.DefaultChunkSize - 5
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/objects/video/content", nil)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+9))
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	data, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, content[start:start+10], data)
+
+	resp, err = http.Get(ts.URL + "/admin/snapshot")
+	assert.NoError(t, err)
+	archive, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	restoreDir := t.TempDir()
+	manifest, err := snapshot.Restore(bytes.NewReader(archive), restoreDir)
+	assert.NoError(t, err)
+	assert.Len(t, manifest.Chunks, 3)
+	restored, err := db.NewDistributedStorageWithOptions([]string{"node1", "node2", "node3"}, db.StorageOptions{DataDir: restoreDir})
+	assert.NoError(t, err)
+	defer restored.Close()
+	object, err = restored.GetObject("video")
+	assert.NoError(t, err)
+	data, err = restored.ReadObject(object)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Equal(content, data))
+
+	resp = upload(http.MethodPatch, ts.URL+"/objects/video/content", []byte("replacement"))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, err = http.Get(ts.URL + "/objects/video/content")
+	assert.NoError(t, err)
+	data, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, "replacement", string(data))
+
+	result, err := storage.SweepBlobs(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, result.ChunksRemoved)
+	assert.Equal(t, 1, countChunks())
+
+	req, _ = http.NewRequest(http.MethodDelete, ts.URL+"/objects/video", nil)
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	result, err = storage.SweepBlobs(db.BlobGracePeriod)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.ChunksRemoved)
+	result, err = storage.SweepBlobs(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.ChunksRemoved)
+	assert.Equal(t, 0, countChunks())
+
+	resp = upload(http.MethodPatch, ts.URL+"/objects/missing/content", []byte("orphan"))
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, 0, countChunks())
+
+	corrupt := &blob.Blob{Digest: strings.Repeat("0", 64), Size: 5, Chunks: []string{strings.Repeat("1", 64)}}
+	assert.NoError(t, storage.InsertObject(&db.Object{ID: "corrupt", Blob: corrupt}))
+	resp, err = http.Get(ts.URL + "/objects/corrupt/content")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+}
+
+func TestObjectDeduplication(t *testing.T) {
+	nodeAddresses := []string{"node1", "node2", "node3"}
+	dataDir := t.TempDir()
+
+	storage, err := db.NewDistributedStorageWithOptions(nodeAddresses, db.StorageOptions{DataDir: dataDir})
+	assert.NoError(t, err)
+	storage.SetVersionRetention(0)
+	idx, err := index.NewIndex(storage)
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server.NewServer(storage, idx).Router())
+	defer ts.Close()
+
+	photo := bytes.Repeat([]byte("same photo "), 100)
+	sum := sha256.Sum256(photo)
+	digest := hex.EncodeToString(sum[:])
+
+	type contentResponse struct {
+		Digest     string `json:"digest"`
+		Size       int64  `json:"size"`
+		References int    `json:"references"`
+	}
+	upload := func(method, url, id string, data []byte) contentResponse {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		writer.WriteField("data", fmt.Sprintf(`{"id": %q}`, id))
+		part, _ := writer.CreateFormFile("object", id+".jpg")
+		part.Write(data)
+		assert.NoError(t, writer.Close())
+
+		req, _ := http.NewRequest(method, url, body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Contains(t, []int{http.StatusOK, http.StatusCreated}, resp.StatusCode)
+
+		var response contentResponse
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&response))
+		return response
+	}
+	countChunks := func(store *blob.Store) int {
+		count := 0
+		assert.NoError(t, store.Each(func(string) error {
+			count++
+			return nil
+		}))
+		return count
+	}
+
+	assert.Equal(t, contentResponse{Digest: digest, Size: int64(len(photo)), References: 1}, upload(http.MethodPost, ts.URL+"/objects", "a", photo))
+	assert.Equal(t, 2, upload(http.MethodPost, ts.URL+"/objects", "b", photo).References)
+	other := upload(http.MethodPost, ts.URL+"/objects", "c", []byte("another photo"))
+	assert.NotEqual(t, digest, other.Digest)
+	assert.Equal(t, 1, other.References)
+	assert.Equal(t, 2, countChunks(storage.Blobs()))
+
+	replaced := upload(http.MethodPatch, ts.URL+"/objects/c/content", "c", photo)
+	assert.Equal(t, digest, replaced.Digest)
+	assert.Equal(t, 3, replaced.References)
+	assert.Equal(t, 0, storage.Blobs().Refs(other.Digest))
+
+	assert.NoError(t, storage.InsertObject(&db.Object{ID: "inline", Object: photo}))
+	assert.Equal(t, 4, storage.Blobs().Refs(digest))
+
+	resp, err := http.Get(ts.URL + "/objects/a/content")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, `"`+digest+`"`, resp.Header.Get("ETag"))
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/objects/a/content", nil)
+	req.Header.Set("If-None-Match", `"`+digest+`"`)
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	req, _ = http.NewRequest(http.MethodDelete, ts.URL+"/objects/a", nil)
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, 3, storage.Blobs().Refs(digest))
+
+	idx.Close()
+	storage.Close()
+	storage, err = db.NewDistributedStorageWithOptions(nodeAddresses, db.StorageOptions{DataDir: dataDir})
+	assert.NoError(t, err)
+	defer storage.Close()
+	assert.Equal(t, 3, storage.Blobs().Refs(digest))
+
+	result, err := storage.SweepBlobs(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.ChunksRemoved)
+
+	for _, id := range []string{"b", "c", "inline"} {
+		assert.NoError(t, storage.DeleteObject(id))
+	}
+	assert.Equal(t, 0, storage.Blobs().Refs(digest))
+	result, err = storage.SweepBlobs(db.BlobGracePeriod)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.ChunksRemoved)
+	result, err = storage.SweepBlobs(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, result.ChunksRemoved)
+	assert.Equal(t, 0, countChunks(storage.Blobs()))
+}
+
+func TestResumableUploads(t *testing.T) {
+	nodeAddresses := []string{"node1", "node2", "node3"}
+	dataDir := t.TempDir()
+
+	open := func() (*db.DistributedStorage, *httptest.Server) {
+		storage, err := db.NewDistributedStorageWithOptions(nodeAddresses, db.StorageOptions{DataDir: dataDir})
+		assert.NoError(t, err)
+		idx, err := index.NewIndex(storage)
+		assert.NoError(t, err)
+		ts := httptest.NewServer(server.NewServer(storage, idx).Router())
+		t.Cleanup(func() {
+			ts.Close()
+			idx.Close()
+			storage.Close()
+		})
+		return storage, ts
+	}
+	storage, ts := open()
+
+	do := func(method, url string, body []byte) (*http.Response, []byte) {
+		req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, data
+	}
+	type session struct {
+		UploadID string `json:"upload_id"`
+		ObjectID string `json:"object_id"`
+		Parts    []struct {
+			Part int   `json:"part"`
+			Size int64 `json:"size"`
+		} `json:"parts"`
+	}
+
+	resp, data := do(http.MethodPost, ts.URL+"/objects/uploads", []byte(`{"id": "recording", "metadata": {"name": "Interview"}, "content_type": "audio/wav"}`))
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	var created session
+	assert.NoError(t, json.Unmarshal(data, &created))
+	assert.Equal(t, "recording", created.ObjectID)
+	uploadURL := ts.URL + "/objects/uploads/" + created.UploadID
+
+	first := bytes.Repeat([]byte{1}, blob.DefaultChunkSize+10)
+	second := []byte("second part")
+	third := []byte("third part")
+
+	resp, _ = do(http.MethodPut, uploadURL+"/parts/2", []byte("stale"))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = do(http.MethodPut, uploadURL+"/parts/1", first)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = do(http.MethodPut, uploadURL+"/parts/0", second)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = do(http.MethodPut, uploadURL+"/parts/3", third)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	storage.Close()
+	storage, ts = open()
+	uploadURL = ts.URL + "/objects/uploads/" + created.UploadID
+
+	result, err := storage.SweepBlobs(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, result.ChunksRemoved)
+
+	resp, data = do(http.MethodGet, uploadURL, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var resumed session
+	assert.NoError(t, json.Unmarshal(data, &resumed))
+	if assert.Len(t, resumed.Parts, 3) {
+		assert.Equal(t, 1, resumed.Parts[0].Part)
+		assert.Equal(t, int64(len(first)), resumed.Parts[0].Size)
+	}
+
+	resp, _ = do(http.MethodPut, uploadURL+"/parts/2", second)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = do(http.MethodPost, uploadURL+"/complete", nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, data = do(http.MethodGet, ts.URL+"/objects/recording/content", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "audio/wav", resp.Header.Get("Content-Type"))
+	assert.True(t, bytes.Equal(append(append(append([]byte{}, first...), second...), third...), data))
+
+	object, err := storage.GetObject("recording")
+	assert.NoError(t, err)
+	assert.Equal(t, "Interview", object.Metadata["name"])
+
+	resp, _ = do(http.MethodGet, uploadURL, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, data = do(http.MethodPost, ts.URL+"/objects/uploads", []byte(`{"id": "abandoned"}`))
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	var abandoned session
+	assert.NoError(t, json.Unmarshal(data, &abandoned))
+	abandonedURL := ts.URL + "/objects/uploads/" + abandoned.UploadID
+	resp, _ = do(http.MethodPut, abandonedURL+"/parts/2", []byte("gap"))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = do(http.MethodPost, abandonedURL+"/complete", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp, _ = do(http.MethodDelete, abandonedURL, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = do(http.MethodDelete, abandonedURL, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	_, err = storage.GetObject("abandoned")
+	assert.ErrorIs(t, err, db.ErrObjectNotFound)
+
+	result, err = storage.SweepBlobs(0)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, result.ChunksRemoved)
+	data, err = storage.ReadObject(object)
+	assert.NoError(t, err)
+	assert.Len(t, data, len(first)+len(second)+len(third))
+}
+
+func TestObjectVersions(t *testing.T) {
+	storage, ts := newTestServer(t)
+	storage.SetVersionRetention(2)
+
+	do := func(method, url, contentType string, body io.Reader) (*http.Response, []byte) {
+		req, _ := http.NewRequest(method, url, body)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, data
+	}
+	upload := func(method, url string, content string) int {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		writer.WriteField("data", `{"id": "doc", "metadata": {"name": "draft"}}`)
+		part, _ := writer.CreateFormFile("object", "doc.txt")
+		part.Write([]byte(content))
+		assert.NoError(t, writer.Close())
+		resp, _ := do(method, url, writer.FormDataContentType(), body)
+		return resp.StatusCode
+	}
+	digestOf := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:])
+	}
+	type version struct {
+		Version  int               `json:"version"`
+		Metadata map[string]string `json:"metadata"`
+		Digest   string            `json:"digest"`
+		Size     int64             `json:"size"`
+		Current  bool              `json:"current"`
+	}
+	listVersions := func() []version {
+		resp, data := do(http.MethodGet, ts.URL+"/objects/doc/versions", "", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		var response struct {
+			Versions []version `json:"versions"`
+		}
+		assert.NoError(t, json.Unmarshal(data, &response))
+		return response.Versions
+	}
+
+	assert.Equal(t, http.StatusCreated, upload(http.MethodPost, ts.URL+"/objects", "v1"))
+	assert.Equal(t, http.StatusOK, upload(http.MethodPatch, ts.URL+"/objects/doc/content", "v2"))
+	resp, _ := do(http.MethodPatch, ts.URL+"/objects/doc/metadata", "application/json", strings.NewReader(`{"metadata": {"name": "final"}}`))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	versions := listVersions()
+	if assert.Len(t, versions, 3) {
+		assert.Equal(t, version{Version: 3, Metadata: map[string]string{"name": "final"}, Digest: digestOf("v2"), Size: 2, Current: true}, versions[0])
+		assert.Equal(t, 2, versions[1].Version)
+		assert.Equal(t, version{Version: 1, Metadata: map[string]string{"name": "draft"}, Digest: digestOf("v1"), Size: 2}, versions[2])
+	}
+
+	resp, data := do(http.MethodGet, ts.URL+"/objects/doc", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotContains(t, string(data), "history")
+
+	resp, data = do(http.MethodGet, ts.URL+"/objects/doc/versions/1/content", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "v1", string(data))
+	resp, _ = do(http.MethodGet, ts.URL+"/objects/doc/versions/9", "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = do(http.MethodGet, ts.URL+"/objects/doc/versions/latest", "", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, data = do(http.MethodPost, ts.URL+"/objects/doc/versions/1/restore", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var restored struct {
+		Version int    `json:"version"`
+		Digest  string `json:"digest"`
+	}
+	assert.NoError(t, json.Unmarshal(data, &restored))
+	assert.Equal(t, 4, restored.Version)
+	assert.Equal(t, digestOf("v1"), restored.Digest)
+
+	resp, data = do(http.MethodGet, ts.URL+"/objects/doc/content", "", nil)
+	assert.Equal(t, "v1", string(data))
+	object, err := storage.GetObject("doc")
+	assert.NoError(t, err)
+	assert.Equal(t, "draft", object.Metadata["name"])
+
+	versions = listVersions()
+	if assert.Len(t, versions, 3) {
+		assert.Equal(t, []int{4, 3, 2}, []int{versions[0].Version, versions[1].Version, versions[2].Version})
+	}
+	resp, _ = do(http.MethodGet, ts.URL+"/objects/doc/versions/1", "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, 1, storage.Blobs().Refs(digestOf("v1")))
+	assert.Equal(t, 2, storage.Blobs().Refs(digestOf("v2")))
+
+	resp, _ = do(http.MethodDelete, ts.URL+"/objects/doc", "", nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, 0, storage.Blobs().Refs(digestOf("v1")))
+	assert.Equal(t, 0, storage.Blobs().Refs(digestOf("v2")))
+}
+
+func TestEmbeddingProviders(t *testing.T) {
+	storage, err := db.NewDistributedStorageWithOptions([]string{"node1", "node2", "node3"}, db.StorageOptions{DataDir: t.TempDir()})
+	assert.NoError(t, err)
+	defer storage.Close()
+	idx, err := index.NewIndex(storage)
+	assert.NoError(t, err)
+	defer idx.Close()
+
+	var calls int
+	var lastModel, lastAuth string
+	failing := false
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		lastAuth = r.Header.Get("Authorization")
+		var request struct {
+			Model string   `json:"model"`
+			Input []string `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		lastModel = request.Model
+		if failing {
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		embeddings, _ := embed.NewStub(16).Embed(request.Input)
+		var response struct {
+			Data []map[string]interface{} `json:"data"`
+		}
+		for n := len(embeddings) - 1; n >= 0; n-- {
+			response.Data = append(response.Data, map[string]interface{}{"index": n, "embedding": embeddings[n]})
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer provider.Close()
+
+	srv := server.NewServer(storage, idx)
+	srv.SetEmbedder(embed.NewOpenAI(provider.URL, "test-model", "secret", 5*time.Second))
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	postJSON := func(url, body string) (*http.Response, []byte) {
+		resp, err := http.Post(url, "application/json", strings.NewReader(body))
+		assert.NoError(t, err)
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, data
+	}
+
+	resp, _ := postJSON(ts.URL+"/vectors", `{"ID": "cats", "Text": "cats purr and chase mice"}`)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "test-model", lastModel)
+	assert.Equal(t, "Bearer secret", lastAuth)
+	vector, err := storage.GetVector("cats")
+	assert.NoError(t, err)
+	expected, _ := embed.NewStub(16).Embed([]string{"cats purr and chase mice"})
+	assert.Equal(t, expected[0], vector.Embedding)
+
+	assert.NoError(t, storage.InsertObject(&db.Object{ID: "notes", ContentType: "text/plain", Object: []byte("dogs bark at the mail carrier")}))
+	assert.NoError(t, storage.InsertObject(&db.Object{ID: "photo", ContentType: "image/png", Object: []byte{0x89, 'P', 'N', 'G'}}))
+
+	calls = 0
+	resp, data := postJSON(ts.URL+"/vectors/batch", `{"vectors": [
+		{"ID": "dogs", "ObjectID": "notes"},
+		{"ID": "photo", "ObjectID": "photo"},
+		{"ID": "missing", "ObjectID": "nothing"},
+		{"ID": "given", "Embedding": [1, 0, 0], "Text": "kept as sent"}
+	]}`)
+	assert.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+	assert.Equal(t, 1, calls)
+	var batch struct {
+		Results []struct {
+			ID     string `json:"id"`
+			Status int    `json:"status"`
+		} `json:"results"`
+	}
+	assert.NoError(t, json.Unmarshal(data, &batch))
+	if assert.Len(t, batch.Results, 4) {
+		assert.Equal(t, http.StatusCreated, batch.Results[0].Status)
+		assert.Equal(t, http.StatusBadRequest, batch.Results[1].Status)
+		assert.Equal(t, http.StatusBadRequest, batch.Results[2].Status)
+		assert.Equal(t, http.StatusCreated, batch.Results[3].Status)
+	}
+	vector, err = storage.GetVector("given")
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{1, 0, 0}, vector.Embedding)
+
+	resp, data = postJSON(ts.URL+"/search", `{"vector": {"text": "the dogs bark"}, "k": 1, "reranker": "none"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var search struct {
+		Results []struct {
+			ID string `json:"ID"`
+		} `json:"results"`
+	}
+	assert.NoError(t, json.Unmarshal(data, &search))
+	if assert.Len(t, search.Results, 1) {
+		assert.Equal(t, "dogs", search.Results[0].ID)
+	}
+
+	resp, data = postJSON(ts.URL+"/search/batch", `{"queries": [
+		{"vector": {"text": "cats chase mice"}, "k": 1, "reranker": "none"},
+		{"vector": {"ObjectID": "photo"}, "k": 1}
+	]}`)
+	assert.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+	var searchBatch struct {
+		Results []struct {
+			Results []struct {
+				ID string `json:"ID"`
+			} `json:"results"`
+			Error string `json:"error"`
+		} `json:"results"`
+	}
+	assert.NoError(t, json.Unmarshal(data, &searchBatch))
+	if assert.Len(t, searchBatch.Results, 2) {
+		if assert.Len(t, searchBatch.Results[0].Results, 1) {
+			assert.Equal(t, "cats", searchBatch.Results[0].Results[0].ID)
+		}
+		assert.Contains(t, searchBatch.Results[1].Error, "image/png")
+	}
+
+	failing = true
+	resp, _ = postJSON(ts.URL+"/vectors", `{"ID": "birds", "Text": "birds sing"}`)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	resp, _ = postJSON(ts.URL+"/search", `{"vector": {"text": "birds"}, "k": 1}`)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	_, err = storage.GetVector("birds")
+	assert.ErrorIs(t, err, db.ErrVectorNotFound)
+
+	// Custom providers are checked for the count and shape of embeddings.
+	round := 0
+	statuses := func(provider embed.ProviderFunc) []int {
+		srv.SetEmbedder(provider)
+		round++
+		_, data := postJSON(ts.URL+"/vectors/batch", fmt.Sprintf(`{"vectors": [{"ID": "first%d", "Text": "one"}, {"ID": "second%d", "Text": "two"}]}`, round, round))
+		var batch struct {
+			Results []struct {
+				Status int `json:"status"`
+			} `json:"results"`
+		}
+		assert.NoError(t, json.Unmarshal(data, &batch))
+		var result []int
+		for _, item := range batch.Results {
+			result = append(result, item.Status)
+		}
+		return result
+	}
+	assert.Equal(t, []int{http.StatusBadGateway, http.StatusBadGateway}, statuses(func(texts []string) ([][]float64, error) {
+		return [][]float64{{1, 0}}, nil
+	}))
+	assert.Equal(t, []int{http.StatusCreated, http.StatusBadGateway}, statuses(func(texts []string) ([][]float64, error) {
+		return [][]float64{{1, 0}, {1}}, nil
+	}))
+	assert.Equal(t, []int{http.StatusCreated, http.StatusBadGateway}, statuses(func(texts []string) ([][]float64, error) {
+		return [][]float64{{0, 1}, {}}, nil
+	}))
+}
+
+func TestDocumentIngestion(t *testing.T) {
+	storage, ts := newTestServer(t)
+	resp, err := http.Post(ts.URL+"/documents", "application/json", strings.NewReader(`{"id": "guide", "text": "Hello."}`))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+
+	idx, err := index.NewIndex(storage)
+	assert.NoError(t, err)
+	defer idx.Close()
+	srv := server.NewServer(storage, idx)
+	srv.SetEmbedder(embed.NewStub(32))
+	ts = httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	type documentChunk struct {
+		ID      string `json:"id"`
+		Start   int    `json:"start"`
+		End     int    `json:"end"`
+		Heading string `json:"heading"`
+	}
+	type document struct {
+		ID      string          `json:"id"`
+		Version int             `json:"version"`
+		Chunker string          `json:"chunker"`
+		Chunks  []documentChunk `json:"chunks"`
+	}
+	ingest := func(contentType string, body io.Reader) (int, document) {
+		resp, err := http.Post(ts.URL+"/documents", contentType, body)
+		assert.NoError(t, err)
+		defer resp.Body.Close()
+		var doc document
+		if resp.StatusCode == http.StatusCreated {
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(&doc))
+		}
+		return resp.StatusCode, doc
+	}
+
+	text := "# Guide\nKikiola stores vectors. It is written in Go.\n\n## Install\nRun go build. Then start the server.\n\n## Café\nSearch with text queries."
+	payload, _ := json.Marshal(map[string]interface{}{
+		"id":           "guide",
+		"text":         text,
+		"metadata":     map[string]string{"source": "docs"},
+		"content_type": "text/markdown",
+		"chunker":      "markdown",
+		"size":         10,
+	})
+	status, doc := ingest("application/json", bytes.NewReader(payload))
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, "markdown", doc.Chunker)
+	runes := []rune(text)
+	if assert.Len(t, doc.Chunks, 3) {
+		assert.Equal(t, documentChunk{ID: "guide:0", Start: 0, End: 52, Heading: "Guide"}, doc.Chunks[0])
+		assert.Equal(t, "Guide > Install", doc.Chunks[1].Heading)
+		assert.Equal(t, documentChunk{ID: "guide:2", Start: 103, End: 136, Heading: "Guide > Café"}, doc.Chunks[2])
+		assert.Equal(t, "## Café\nSearch with text queries.", string(runes[103:136]))
+	}
+
+	vector, err := storage.GetVector("guide:2")
+	assert.NoError(t, err)
+	assert.Equal(t, "## Café\nSearch with text queries.", vector.Text)
+	assert.Equal(t, "guide", vector.ObjectID)
+	assert.Len(t, vector.Embedding, 32)
+	assert.Equal(t, map[string]string{
+		"source": "docs", "doc_id": "guide", "chunker": "markdown", "chunk": "2", "chunks": "3",
+		"start": "103", "end": "136", "heading": "Guide > Café",
+	}, vector.Metadata)
+
+	object, err := storage.GetObject("guide")
+	assert.NoError(t, err)
+	assert.Equal(t, "text/markdown", object.ContentType)
+	data, err := storage.ReadObject(object)
+	assert.NoError(t, err)
+	assert.Equal(t, text, string(data))
+
+	resp, err = http.Post(ts.URL+"/search", "application/json", strings.NewReader(`{"vector": {"text": "run go build then start the server"}, "k": 1, "reranker": "none", "include_object": true}`))
+	assert.NoError(t, err)
+	var search struct {
+		Results []struct {
+			ID           string              `json:"ID"`
+			LinkedObject *index.LinkedObject `json:"linked_object"`
+		} `json:"results"`
+	}
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&search))
+	resp.Body.Close()
+	if assert.Len(t, search.Results, 1) {
+		assert.Equal(t, "guide:1", search.Results[0].ID)
+		assert.Equal(t, "guide", search.Results[0].LinkedObject.ID)
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	writer.WriteField("data", `{"id": "guide", "chunker": "fixed", "size": 4, "overlap": 1}`)
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Disposition", `form-data; name="object"; filename="guide.txt"`)
+	header.Set("Content-Type", "text/plain")
+	part, _ := writer.CreatePart(header)
+	part.Write([]byte("one two three four five six seven"))
+	assert.NoError(t, writer.Close())
+	status, doc = ingest(writer.FormDataContentType(), body)
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, 2, doc.Version)
+	if assert.Len(t, doc.Chunks, 2) {
+		assert.Equal(t, documentChunk{ID: "guide:0", Start: 0, End: 18}, doc.Chunks[0])
+		assert.Equal(t, documentChunk{ID: "guide:1", Start: 14, End: 33}, doc.Chunks[1])
+	}
+	assert.Equal(t, []string{"guide:0", "guide:1"}, idx.LinkedVectors("guide"))
+	_, err = storage.GetVector("guide:2")
+	assert.ErrorIs(t, err, db.ErrVectorNotFound)
+
+	assert.NoError(t, storage.InsertObject(&db.Object{ID: "notes", ContentType: "text/plain", Object: []byte("First sentence here. Second one follows! A third?")}))
+	status, doc = ingest("application/json", strings.NewReader(`{"object_id": "notes", "chunker": "sentence", "size": 4}`))
+	assert.Equal(t, http.StatusCreated, status)
+	assert.Equal(t, []documentChunk{{ID: "notes:0", Start: 0, End: 20}, {ID: "notes:1", Start: 21, End: 40}, {ID: "notes:2", Start: 41, End: 49}}, doc.Chunks)
+
+	assert.NoError(t, storage.InsertObject(&db.Object{ID: "scan", ContentType: "application/pdf", Object: []byte("%PDF-1.7")}))
+	status, _ = ingest("application/json", strings.NewReader(`{"object_id": "scan"}`))
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = ingest("application/json", strings.NewReader(`{"object_id": "absent"}`))
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = ingest("application/json", strings.NewReader(`{"id": "other", "text": "words", "chunker": "paragraph"}`))
+	assert.Equal(t, http.StatusBadRequest, status)
+	status, _ = ingest("application/json", strings.NewReader(`{"id": "other", "text": "words", "size": 4, "overlap": 4}`))
+	assert.Equal(t, http.StatusBadRequest, status)
+	_, err = storage.GetObject("other")
+	assert.ErrorIs(t, err, db.ErrObjectNotFound)
+
+	req, _ := http.NewRequest(http.MethodDelete, ts.URL+"/objects/guide", nil)
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	_, err = storage.GetVector("guide:0")
+	assert.ErrorIs(t, err, db.ErrVectorNotFound)
+}
@@ -3,13 +3,13 @@ module github.com/0xnu/kikiola
 go 1.20
 
 require (
+	github.com/agnivade/levenshtein v1.1.1
 	github.com/gorilla/mux v1.8.1
 	github.com/stretchr/testify v1.9.0
 	github.com/tidwall/buntdb v1.3.0
 )
 
 require (
-	github.com/agnivade/levenshtein v1.1.1 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/tidwall/btree v1.4.2 // indirect
@@ -0,0 +1,103 @@
+package blob
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Reader reads a blob back from its chunks, opening one chunk file at a
+// time. It implements io.ReadSeeker so blobs can serve Range requests.
+type Reader struct {
+	store  *Store
+	blob   *Blob
+	offset int64
+	chunk  int
+	file   *os.File
+}
+
+// NewReader opens a reader over a blob, rejecting a record whose chunk
+// size cannot locate its content.
+func (s *Store) NewReader(blob *Blob) (*Reader, error) {
+	if blob.ChunkSize <= 0 {
+		return nil, fmt.Errorf("%w: chunk size %d", ErrCorruptBlob, blob.ChunkSize)
+	}
+	return &Reader{store: s, blob: blob, chunk: -1}, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.blob.Size {
+		return 0, io.EOF
+	}
+
+	chunkSize := int64(r.blob.ChunkSize)
+	chunk := int(r.offset / chunkSize)
+	if chunk >= len(r.blob.Chunks) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if chunk != r.chunk {
+		err := r.closeChunk()
+		if err != nil {
+			return 0, err
+		}
+		file, err := r.store.OpenChunk(r.blob.Chunks[chunk])
+		if err != nil {
+			return 0, err
+		}
+		r.file = file
+		r.chunk = chunk
+	}
+
+	within := r.offset % chunkSize
+	if remaining := chunkSize - within; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	if remaining := r.blob.Size - r.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	n, err := r.file.ReadAt(p, within)
+	r.offset += int64(n)
+	if err == io.EOF {
+		if n < len(p) {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.blob.Size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *Reader) Close() error {
+	return r.closeChunk()
+}
+
+func (r *Reader) closeChunk() error {
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	r.chunk = -1
+	if err != nil {
+		return fmt.Errorf("failed to close blob chunk: %v", err)
+	}
+	return nil
+}
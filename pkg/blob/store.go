@@ -0,0 +1,372 @@
+package blob
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultChunkSize = 4 << 20
+
+	// DefaultGracePeriod protects chunks written by uploads that have not
+	// referenced their blob yet from being removed.
+	DefaultGracePeriod = time.Hour
+
+	chunksDir = "chunks"
+	tempDir   = "tmp"
+)
+
+var (
+	ErrChunkNotFound    = errors.New("blob chunk not found")
+	ErrChecksumMismatch = errors.New("blob chunk checksum mismatch")
+	ErrCorruptBlob      = errors.New("corrupt blob record")
+)
+
+// Store keeps content as immutable chunk files named by the SHA-256 of
+// their bytes, so identical chunks are written once. Blobs are reference
+// counted by the SHA-256 of their whole content, and chunks no blob
+// references are removed once they are older than the grace period.
+type Store struct {
+	dir       string
+	chunkSize int
+	grace     time.Duration
+	refs      map[string]int
+	blobs     map[string]*Blob
+	chunkRefs map[string]int
+	mutex     sync.Mutex
+}
+
+type Blob struct {
+	Digest    string   `json:"digest"`
+	Size      int64    `json:"size"`
+	ChunkSize int      `json:"chunk_size"`
+	Chunks    []string `json:"chunks"`
+}
+
+type SweepResult struct {
+	ChunksRemoved  int
+	BytesReclaimed int64
+}
+
+func Open(dir string) (*Store, error) {
+	return OpenWithChunkSize(dir, DefaultChunkSize)
+}
+
+func OpenWithChunkSize(dir string, chunkSize int) (*Store, error) {
+	for _, sub := range []string{chunksDir, tempDir} {
+		err := os.MkdirAll(filepath.Join(dir, sub), os.ModePerm)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create blob directory: %v", err)
+		}
+	}
+
+	return &Store{
+		dir:       dir,
+		chunkSize: chunkSize,
+		grace:     DefaultGracePeriod,
+		refs:      make(map[string]int),
+		blobs:     make(map[string]*Blob),
+		chunkRefs: make(map[string]int),
+	}, nil
+}
+
+// Put streams r into the store one chunk at a time.
+func (s *Store) Put(r io.Reader) (*Blob, error) {
+	blob := &Blob{ChunkSize: s.chunkSize}
+	buf := make([]byte, s.chunkSize)
+	hash := sha256.New()
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			digest, err := s.writeChunk(buf[:n])
+			if err != nil {
+				return nil, err
+			}
+			hash.Write(buf[:n])
+			blob.Chunks = append(blob.Chunks, digest)
+			blob.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read blob content: %v", err)
+		}
+	}
+
+	blob.Digest = hex.EncodeToString(hash.Sum(nil))
+	return blob, nil
+}
+
+// Ref records one more reference to a blob and returns how many there
+// are now.
+func (s *Store) Ref(blob *Blob) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.refs[blob.Digest] == 0 {
+		s.blobs[blob.Digest] = blob
+		for _, chunk := range blob.Chunks {
+			s.chunkRefs[chunk]++
+		}
+	}
+	s.refs[blob.Digest]++
+	return s.refs[blob.Digest]
+}
+
+func (s *Store) Refs(digest string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.refs[digest]
+}
+
+// Release drops a reference to a blob. When the last one goes, chunks no
+// other blob references are removed unless they were written within the
+// grace period, in which case Sweep removes them later.
+func (s *Store) Release(blob *Blob) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.refs[blob.Digest] == 0 {
+		return nil
+	}
+	s.refs[blob.Digest]--
+	if s.refs[blob.Digest] > 0 {
+		return nil
+	}
+
+	delete(s.refs, blob.Digest)
+	released := s.blobs[blob.Digest]
+	delete(s.blobs, blob.Digest)
+
+	before := time.Now().Add(-s.grace)
+	for _, chunk := range released.Chunks {
+		s.chunkRefs[chunk]--
+		if s.chunkRefs[chunk] > 0 {
+			continue
+		}
+		delete(s.chunkRefs, chunk)
+
+		_, err := s.removeChunk(chunk, before)
+		if err != nil {
+			return fmt.Errorf("failed to remove blob chunk: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// PinChunks lists every stored chunk and protects each from removal until
+// it is unpinned, for readers that copy chunks outside any blob reference.
+func (s *Store) PinChunks() ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var digests []string
+	err := s.Each(func(digest string) error {
+		digests = append(digests, digest)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, digest := range digests {
+		s.chunkRefs[digest]++
+	}
+	return digests, nil
+}
+
+// Unpin drops the pins taken by PinChunks. Chunks left unreferenced are removed
+// by the next Sweep.
+func (s *Store) Unpin(digests []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, digest := range digests {
+		s.chunkRefs[digest]--
+		if s.chunkRefs[digest] <= 0 {
+			delete(s.chunkRefs, digest)
+		}
+	}
+}
+
+// PutChunk stores a chunk under its digest, rejecting content that does
+// not hash to it.
+func (s *Store) PutChunk(digest string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read blob chunk: %v", err)
+	}
+	if chunkDigest(data) != digest {
+		return fmt.Errorf("%w: %s", ErrChecksumMismatch, digest)
+	}
+	_, err = s.writeChunk(data)
+	return err
+}
+
+func (s *Store) writeChunk(data []byte) (string, error) {
+	digest := chunkDigest(data)
+	chunkPath := s.chunkPath(digest)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Touching an existing chunk keeps a concurrent sweep from removing it
+	// before the blob referencing it is recorded.
+	now := time.Now()
+	err := os.Chtimes(chunkPath, now, now)
+	if err == nil {
+		return digest, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to touch blob chunk: %v", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(chunkPath), os.ModePerm)
+	if err != nil {
+		return "", fmt.Errorf("failed to create blob chunk directory: %v", err)
+	}
+
+	file, err := os.CreateTemp(filepath.Join(s.dir, tempDir), "chunk-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create blob chunk: %v", err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to write blob chunk: %v", err)
+	}
+
+	err = os.Rename(file.Name(), chunkPath)
+	if err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to store blob chunk: %v", err)
+	}
+
+	return digest, nil
+}
+
+func (s *Store) chunkPath(digest string) string {
+	return filepath.Join(s.dir, chunksDir, digest[:2], digest)
+}
+
+// OpenChunk opens the file holding a chunk.
+func (s *Store) OpenChunk(digest string) (*os.File, error) {
+	if !validDigest(digest) {
+		return nil, ErrChunkNotFound
+	}
+	file, err := os.Open(s.chunkPath(digest))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrChunkNotFound, digest)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob chunk: %v", err)
+	}
+	return file, nil
+}
+
+// Each calls fn with the digest of every stored chunk.
+func (s *Store) Each(fn func(digest string) error) error {
+	return filepath.Walk(filepath.Join(s.dir, chunksDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !validDigest(info.Name()) {
+			return nil
+		}
+		return fn(info.Name())
+	})
+}
+
+// Sweep removes chunks no blob references that have not been written or
+// touched since before, along with abandoned temporary files.
+func (s *Store) Sweep(before time.Time) (*SweepResult, error) {
+	result := &SweepResult{}
+
+	err := filepath.Walk(filepath.Join(s.dir, chunksDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !validDigest(info.Name()) {
+			return nil
+		}
+		s.mutex.Lock()
+		reclaimed, err := s.removeChunk(info.Name(), before)
+		s.mutex.Unlock()
+		if err != nil {
+			return err
+		}
+		if reclaimed > 0 {
+			result.ChunksRemoved++
+			result.BytesReclaimed += reclaimed
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to sweep blob chunks: %v", err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(s.dir, tempDir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to sweep blob chunks: %v", err)
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(before) {
+			continue
+		}
+		err = os.Remove(filepath.Join(s.dir, tempDir, entry.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove temporary blob file: %v", err)
+		}
+	}
+
+	return result, nil
+}
+
+// removeChunk deletes an unreferenced chunk last written before the given
+// time and reports its size. The caller holds the mutex.
+func (s *Store) removeChunk(digest string, before time.Time) (int64, error) {
+	if s.chunkRefs[digest] > 0 {
+		return 0, nil
+	}
+	chunkPath := s.chunkPath(digest)
+	info, err := os.Stat(chunkPath)
+	if err != nil || !info.ModTime().Before(before) {
+		return 0, nil
+	}
+	err = os.Remove(chunkPath)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func chunkDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func validDigest(digest string) bool {
+	if len(digest) != sha256.Size*2 {
+		return false
+	}
+	return strings.Trim(digest, "0123456789abcdef") == ""
+}
@@ -0,0 +1,320 @@
+package bulk
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/0xnu/kikiola/pkg/db"
+)
+
+const (
+	FormatJSONL = "jsonl"
+	FormatNPY   = "npy"
+	FormatNPZ   = "npz"
+	FormatFvecs = "fvecs"
+	FormatIvecs = "ivecs"
+
+	DefaultBatchSize = 1000
+
+	// MaxDimension bounds the vector dimension readers accept, so a corrupt
+	// header cannot make them allocate arbitrary amounts of memory.
+	MaxDimension = 1 << 16
+)
+
+var ErrUnknownFormat = errors.New("unknown bulk format")
+
+// ImportError reports the row, counted from zero, that could not be read
+// or failed validation.
+type ImportError struct {
+	Row int
+	Err error
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("row %d: %v", e.Row, e.Err)
+}
+
+func (e *ImportError) Unwrap() error {
+	return e.Err
+}
+
+// WriteError reports the row, counted from zero, whose write stopped an
+// import after it was read and validated.
+type WriteError struct {
+	Row int
+	Err error
+}
+
+func (e *WriteError) Error() string {
+	return fmt.Sprintf("row %d: %v", e.Row, e.Err)
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+type Reader interface {
+	Next() (*db.Vector, error)
+}
+
+type Writer interface {
+	Write(vector *db.Vector) error
+	Close() error
+}
+
+// aborter is implemented by writers that stage data in temporary files.
+type aborter interface {
+	Abort()
+}
+
+type Options struct {
+	IDs      io.Reader
+	Metadata io.Reader
+	IDPrefix string
+}
+
+func FormatFromPath(path string) string {
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	switch ext {
+	case "ndjson", "json":
+		return FormatJSONL
+	default:
+		return ext
+	}
+}
+
+// Import reads vectors, validates each one and writes them in batches.
+// write returns an error for each vector of a batch, and the count covers
+// only the vectors it wrote. The first invalid row stops the import with
+// an ImportError, and the first failed write with a WriteError after the
+// rest of its batch is written.
+func Import(reader Reader, batchSize int, write func(vectors []*db.Vector) []error) (int, error) {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+
+	count := 0
+	row := 0
+	batch := make([]*db.Vector, 0, batchSize)
+	flush := func() error {
+		first := row - len(batch)
+		var failed error
+		for n, err := range write(batch) {
+			if err == nil {
+				count++
+			} else if failed == nil {
+				failed = &WriteError{Row: first + n, Err: err}
+			}
+		}
+		batch = make([]*db.Vector, 0, batchSize)
+		return failed
+	}
+
+	for {
+		vector, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = vector.Validate()
+		}
+		if err != nil {
+			return count, &ImportError{Row: row, Err: err}
+		}
+		row++
+
+		batch = append(batch, vector)
+		if len(batch) == batchSize {
+			err := flush()
+			if err != nil {
+				return count, err
+			}
+		}
+	}
+
+	if len(batch) > 0 {
+		err := flush()
+		if err != nil {
+			return count, err
+		}
+	}
+
+	return count, nil
+}
+
+// Export writes every vector and closes the writer. If the export fails,
+// writers that stage data in temporary files discard them instead.
+func Export(reader Reader, writer Writer) (count int, err error) {
+	defer func() {
+		if err != nil {
+			if staged, ok := writer.(aborter); ok {
+				staged.Abort()
+			}
+		}
+	}()
+
+	for {
+		vector, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+
+		err = writer.Write(vector)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	return count, writer.Close()
+}
+
+type sidecar struct {
+	ids      *bufio.Scanner
+	metadata *json.Decoder
+	prefix   string
+	row      int
+}
+
+func newSidecar(options Options) *sidecar {
+	s := &sidecar{prefix: options.IDPrefix}
+	if options.IDs != nil {
+		s.ids = bufio.NewScanner(options.IDs)
+		s.ids.Buffer(make([]byte, 64*1024), 1024*1024)
+	}
+	if options.Metadata != nil {
+		s.metadata = json.NewDecoder(options.Metadata)
+	}
+	return s
+}
+
+func (s *sidecar) fill(vector *db.Vector) error {
+	row := s.row
+	s.row++
+
+	if s.ids != nil {
+		if !s.ids.Scan() {
+			if err := s.ids.Err(); err != nil {
+				return fmt.Errorf("failed to read IDs: %v", err)
+			}
+			return fmt.Errorf("IDs file has fewer entries than vectors (row %d)", row)
+		}
+		vector.ID = strings.TrimSpace(s.ids.Text())
+	} else if vector.ID == "" {
+		vector.ID = fmt.Sprintf("%s%d", s.prefix, row)
+	}
+
+	if s.metadata != nil {
+		var metadata map[string]string
+		err := s.metadata.Decode(&metadata)
+		if err != nil {
+			return fmt.Errorf("failed to read metadata for row %d: %v", row, err)
+		}
+		vector.Metadata = metadata
+	}
+
+	return nil
+}
+
+type jsonlReader struct {
+	decoder *json.Decoder
+}
+
+func NewJSONLReader(r io.Reader) Reader {
+	return &jsonlReader{decoder: json.NewDecoder(r)}
+}
+
+func (r *jsonlReader) Next() (*db.Vector, error) {
+	var vector db.Vector
+	err := r.decoder.Decode(&vector)
+	if err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("failed to decode vector: %v", err)
+	}
+	if vector.ID == "" {
+		return nil, errors.New("vector without an ID")
+	}
+	return &vector, nil
+}
+
+type jsonlWriter struct {
+	writer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+func NewJSONLWriter(w io.Writer) Writer {
+	writer := bufio.NewWriter(w)
+	return &jsonlWriter{writer: writer, encoder: json.NewEncoder(writer)}
+}
+
+func (w *jsonlWriter) Write(vector *db.Vector) error {
+	return w.encoder.Encode(vector)
+}
+
+func (w *jsonlWriter) Close() error {
+	return w.writer.Flush()
+}
+
+func OpenReader(format string, file *os.File, options Options) (Reader, error) {
+	switch format {
+	case FormatJSONL:
+		return NewJSONLReader(file), nil
+	case FormatFvecs:
+		return NewFvecsReader(file, options), nil
+	case FormatIvecs:
+		return NewIvecsReader(file, options), nil
+	case FormatNPY:
+		return NewNPYReader(file, options)
+	case FormatNPZ:
+		info, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		return NewNPZReader(file, info.Size(), options)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownFormat, format)
+	}
+}
+
+func NewWriter(format string, w io.Writer, ids io.Writer) (Writer, error) {
+	switch format {
+	case FormatJSONL:
+		return NewJSONLWriter(w), nil
+	case FormatFvecs:
+		return NewFvecsWriter(w, ids), nil
+	case FormatNPY:
+		return NewNPYWriter(w)
+	case FormatNPZ:
+		return NewNPZWriter(w)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownFormat, format)
+	}
+}
+
+// KeepsIDs reports whether a format stores vector IDs and metadata in the
+// exported file itself rather than dropping them or needing a sidecar.
+func KeepsIDs(format string) bool {
+	return format == FormatJSONL || format == FormatNPZ
+}
+
+func ContentType(format string) string {
+	switch format {
+	case FormatJSONL:
+		return "application/x-ndjson"
+	case FormatNPZ:
+		return "application/zip"
+	default:
+		return "application/octet-stream"
+	}
+}
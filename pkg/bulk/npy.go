@@ -0,0 +1,531 @@
+package bulk
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/0xnu/kikiola/pkg/db"
+)
+
+const (
+	npzEmbeddings = "embeddings.npy"
+	npzIDs        = "ids.npy"
+	npzMetadata   = "metadata.jsonl"
+
+	maxNPYHeaderSize   = 1 << 20
+	maxNPYStringLength = 1 << 12
+)
+
+var (
+	npyMagic        = []byte("\x93NUMPY")
+	npyDescrPattern = regexp.MustCompile(`'descr':\s*'([^']*)'`)
+	npyOrderPattern = regexp.MustCompile(`'fortran_order':\s*(True|False)`)
+	npyShapePattern = regexp.MustCompile(`'shape':\s*\(([^)]*)\)`)
+)
+
+type npyHeader struct {
+	kind     byte
+	itemSize int
+	shape    []int
+}
+
+func readNPYHeader(r io.Reader) (*npyHeader, error) {
+	prefix := make([]byte, 8)
+	_, err := io.ReadFull(r, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read npy header: %v", err)
+	}
+	if !bytes.Equal(prefix[:6], npyMagic) {
+		return nil, errors.New("not an npy file")
+	}
+
+	var headerLen int
+	switch prefix[6] {
+	case 1:
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, fmt.Errorf("failed to read npy header: %v", err)
+		}
+		headerLen = int(binary.LittleEndian.Uint16(buf))
+	case 2, 3:
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, fmt.Errorf("failed to read npy header: %v", err)
+		}
+		headerLen = int(binary.LittleEndian.Uint32(buf))
+	default:
+		return nil, fmt.Errorf("unsupported npy version %d.%d", prefix[6], prefix[7])
+	}
+
+	if headerLen > maxNPYHeaderSize {
+		return nil, fmt.Errorf("npy header of %d bytes is too large", headerLen)
+	}
+	buf := make([]byte, headerLen)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read npy header: %v", err)
+	}
+	header := string(buf)
+
+	descr := npyDescrPattern.FindStringSubmatch(header)
+	order := npyOrderPattern.FindStringSubmatch(header)
+	shape := npyShapePattern.FindStringSubmatch(header)
+	if descr == nil || order == nil || shape == nil {
+		return nil, errors.New("malformed npy header")
+	}
+	if order[1] == "True" {
+		return nil, errors.New("fortran ordered npy arrays are not supported")
+	}
+
+	dtype := descr[1]
+	if len(dtype) < 3 || dtype[0] == '>' {
+		return nil, fmt.Errorf("unsupported npy dtype %q", dtype)
+	}
+	itemSize, err := strconv.Atoi(dtype[2:])
+	if err != nil {
+		return nil, fmt.Errorf("unsupported npy dtype %q", dtype)
+	}
+
+	result := &npyHeader{kind: dtype[1], itemSize: itemSize}
+	switch {
+	case result.kind == 'f' && (itemSize == 4 || itemSize == 8):
+	case result.kind == 'i' && (itemSize == 4 || itemSize == 8):
+	case result.kind == 'U' && itemSize > 0 && itemSize <= maxNPYStringLength:
+		result.itemSize = 4 * itemSize
+	default:
+		return nil, fmt.Errorf("unsupported npy dtype %q", dtype)
+	}
+
+	for _, part := range strings.Split(shape[1], ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("malformed npy shape %q", shape[1])
+		}
+		result.shape = append(result.shape, n)
+	}
+
+	return result, nil
+}
+
+func writeNPYHeader(w io.Writer, descr string, shape []int) error {
+	dims := make([]string, len(shape))
+	for i, n := range shape {
+		dims[i] = strconv.Itoa(n)
+	}
+	shapeText := strings.Join(dims, ", ")
+	if len(shape) == 1 {
+		shapeText += ","
+	}
+
+	header := fmt.Sprintf("{'descr': '%s', 'fortran_order': False, 'shape': (%s), }", descr, shapeText)
+	padding := 64 - (len(npyMagic)+2+2+len(header)+1)%64
+	header += strings.Repeat(" ", padding%64) + "\n"
+
+	buf := make([]byte, 0, len(npyMagic)+4+len(header))
+	buf = append(buf, npyMagic...)
+	buf = append(buf, 1, 0, 0, 0)
+	binary.LittleEndian.PutUint16(buf[len(npyMagic)+2:], uint16(len(header)))
+	buf = append(buf, header...)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+type npyReader struct {
+	reader  *bufio.Reader
+	header  *npyHeader
+	rows    int
+	cols    int
+	row     int
+	sidecar *sidecar
+}
+
+func NewNPYReader(r io.Reader, options Options) (Reader, error) {
+	reader := bufio.NewReader(r)
+	header, err := readNPYHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	if header.kind == 'U' {
+		return nil, errors.New("npy embeddings must be numeric")
+	}
+
+	npy := &npyReader{reader: reader, header: header, sidecar: newSidecar(options)}
+	switch len(header.shape) {
+	case 1:
+		npy.rows, npy.cols = 1, header.shape[0]
+	case 2:
+		npy.rows, npy.cols = header.shape[0], header.shape[1]
+	default:
+		return nil, fmt.Errorf("npy embeddings must be 1 or 2 dimensional, got %d", len(header.shape))
+	}
+	if npy.cols > MaxDimension {
+		return nil, fmt.Errorf("npy embeddings of dimension %d exceed the maximum of %d", npy.cols, MaxDimension)
+	}
+
+	return npy, nil
+}
+
+func (r *npyReader) Next() (*db.Vector, error) {
+	if r.row >= r.rows {
+		return nil, io.EOF
+	}
+	r.row++
+
+	size := r.header.itemSize
+	buf := make([]byte, size*r.cols)
+	_, err := io.ReadFull(r.reader, buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read npy row %d: %v", r.row-1, err)
+	}
+
+	embedding := make([]float64, r.cols)
+	for i := range embedding {
+		item := buf[i*size:]
+		switch {
+		case r.header.kind == 'f' && size == 4:
+			embedding[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(item)))
+		case r.header.kind == 'f':
+			embedding[i] = math.Float64frombits(binary.LittleEndian.Uint64(item))
+		case size == 4:
+			embedding[i] = float64(int32(binary.LittleEndian.Uint32(item)))
+		default:
+			embedding[i] = float64(int64(binary.LittleEndian.Uint64(item)))
+		}
+	}
+
+	vector := &db.Vector{Embedding: embedding}
+	err = r.sidecar.fill(vector)
+	if err != nil {
+		return nil, err
+	}
+	return vector, nil
+}
+
+func readNPYStrings(r io.Reader) ([]string, error) {
+	reader := bufio.NewReader(r)
+	header, err := readNPYHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	if header.kind != 'U' || len(header.shape) != 1 {
+		return nil, errors.New("npy IDs must be a 1 dimensional unicode array")
+	}
+
+	// The strings are appended as they are read rather than allocated
+	// from the shape, which may overstate the data that follows.
+	var values []string
+	buf := make([]byte, header.itemSize)
+	for i := 0; i < header.shape[0]; i++ {
+		_, err := io.ReadFull(reader, buf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read npy string %d: %v", i, err)
+		}
+		var value strings.Builder
+		for offset := 0; offset < len(buf); offset += 4 {
+			char := rune(binary.LittleEndian.Uint32(buf[offset:]))
+			if char == 0 {
+				break
+			}
+			value.WriteRune(char)
+		}
+		values = append(values, value.String())
+	}
+
+	return values, nil
+}
+
+func writeNPYStrings(w io.Writer, values []string) error {
+	width := 1
+	for _, value := range values {
+		if n := utf8.RuneCountInString(value); n > width {
+			width = n
+		}
+	}
+
+	err := writeNPYHeader(w, fmt.Sprintf("<U%d", width), []int{len(values)})
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(w)
+	buf := make([]byte, 4*width)
+	for _, value := range values {
+		for i := range buf {
+			buf[i] = 0
+		}
+		offset := 0
+		for _, char := range value {
+			binary.LittleEndian.PutUint32(buf[offset:], uint32(char))
+			offset += 4
+		}
+		if _, err := writer.Write(buf); err != nil {
+			return err
+		}
+	}
+
+	return writer.Flush()
+}
+
+type npyWriter struct {
+	writer io.Writer
+	temp   *os.File
+	buffer *bufio.Writer
+	rows   int
+	cols   int
+}
+
+func NewNPYWriter(w io.Writer) (Writer, error) {
+	temp, err := os.CreateTemp("", "kikiola-npy-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create npy staging file: %v", err)
+	}
+
+	return &npyWriter{writer: w, temp: temp, buffer: bufio.NewWriter(temp), cols: -1}, nil
+}
+
+func (w *npyWriter) Write(vector *db.Vector) error {
+	if w.cols == -1 {
+		w.cols = len(vector.Embedding)
+	}
+	if len(vector.Embedding) != w.cols {
+		return fmt.Errorf("vector %s has %d dimensions, expected %d", vector.ID, len(vector.Embedding), w.cols)
+	}
+
+	buf := make([]byte, 8*len(vector.Embedding))
+	for i, value := range vector.Embedding {
+		binary.LittleEndian.PutUint64(buf[8*i:], math.Float64bits(value))
+	}
+	_, err := w.buffer.Write(buf)
+	if err != nil {
+		return err
+	}
+	w.rows++
+
+	return nil
+}
+
+func (w *npyWriter) Close() error {
+	defer os.Remove(w.temp.Name())
+	defer w.temp.Close()
+
+	err := w.buffer.Flush()
+	if err != nil {
+		return err
+	}
+
+	cols := w.cols
+	if cols < 0 {
+		cols = 0
+	}
+	err = writeNPYHeader(w.writer, "<f8", []int{w.rows, cols})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.temp.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w.writer, w.temp)
+	return err
+}
+
+// Abort discards the staged rows without writing anything.
+func (w *npyWriter) Abort() {
+	w.temp.Close()
+	os.Remove(w.temp.Name())
+}
+
+type npzWriter struct {
+	zip        *zip.Writer
+	embeddings Writer
+	ids        []string
+	metadata   *os.File
+	buffer     *bufio.Writer
+	encoder    *json.Encoder
+}
+
+func NewNPZWriter(w io.Writer) (Writer, error) {
+	metadata, err := os.CreateTemp("", "kikiola-npz-metadata-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create npz staging file: %v", err)
+	}
+
+	zipWriter := zip.NewWriter(w)
+	entry, err := zipWriter.Create(npzEmbeddings)
+	if err != nil {
+		metadata.Close()
+		os.Remove(metadata.Name())
+		return nil, err
+	}
+	embeddings, err := NewNPYWriter(entry)
+	if err != nil {
+		metadata.Close()
+		os.Remove(metadata.Name())
+		return nil, err
+	}
+
+	buffer := bufio.NewWriter(metadata)
+	return &npzWriter{
+		zip:        zipWriter,
+		embeddings: embeddings,
+		metadata:   metadata,
+		buffer:     buffer,
+		encoder:    json.NewEncoder(buffer),
+	}, nil
+}
+
+func (w *npzWriter) Write(vector *db.Vector) error {
+	err := w.embeddings.Write(vector)
+	if err != nil {
+		return err
+	}
+	w.ids = append(w.ids, vector.ID)
+
+	metadata := vector.Metadata
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	return w.encoder.Encode(metadata)
+}
+
+func (w *npzWriter) Close() error {
+	defer os.Remove(w.metadata.Name())
+	defer w.metadata.Close()
+
+	err := w.embeddings.Close()
+	if err != nil {
+		return err
+	}
+
+	entry, err := w.zip.Create(npzIDs)
+	if err != nil {
+		return err
+	}
+	err = writeNPYStrings(entry, w.ids)
+	if err != nil {
+		return err
+	}
+
+	err = w.buffer.Flush()
+	if err != nil {
+		return err
+	}
+	_, err = w.metadata.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	entry, err = w.zip.Create(npzMetadata)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, w.metadata)
+	if err != nil {
+		return err
+	}
+
+	return w.zip.Close()
+}
+
+// Abort discards the staged embeddings and metadata.
+func (w *npzWriter) Abort() {
+	if staged, ok := w.embeddings.(aborter); ok {
+		staged.Abort()
+	}
+	w.metadata.Close()
+	os.Remove(w.metadata.Name())
+}
+
+type npzReader struct {
+	Reader
+	closers []io.Closer
+}
+
+// NewNPZReader reads embeddings from the embeddings.npy member of an npz
+// archive (or its first numeric array). IDs and metadata are taken from the
+// ids.npy and metadata.jsonl members when present, otherwise from options.
+func NewNPZReader(r io.ReaderAt, size int64, options Options) (Reader, error) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open npz archive: %v", err)
+	}
+
+	members := make(map[string]*zip.File)
+	var embeddingsFile *zip.File
+	for _, file := range archive.File {
+		members[file.Name] = file
+		if embeddingsFile == nil && path.Ext(file.Name) == ".npy" && file.Name != npzIDs {
+			embeddingsFile = file
+		}
+	}
+	if file, ok := members[npzEmbeddings]; ok {
+		embeddingsFile = file
+	}
+	if embeddingsFile == nil {
+		return nil, errors.New("npz archive has no embeddings array")
+	}
+
+	npz := &npzReader{}
+
+	if file, ok := members[npzIDs]; ok && options.IDs == nil {
+		rc, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		ids, err := readNPYStrings(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		options.IDs = strings.NewReader(strings.Join(ids, "\n") + "\n")
+	}
+
+	if file, ok := members[npzMetadata]; ok && options.Metadata == nil {
+		rc, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		npz.closers = append(npz.closers, rc)
+		options.Metadata = rc
+	}
+
+	rc, err := embeddingsFile.Open()
+	if err != nil {
+		npz.Close()
+		return nil, err
+	}
+	npz.closers = append(npz.closers, rc)
+
+	npz.Reader, err = NewNPYReader(rc, options)
+	if err != nil {
+		npz.Close()
+		return nil, err
+	}
+
+	return npz, nil
+}
+
+func (r *npzReader) Close() error {
+	for _, closer := range r.closers {
+		closer.Close()
+	}
+	return nil
+}
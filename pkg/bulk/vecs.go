@@ -0,0 +1,96 @@
+package bulk
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/0xnu/kikiola/pkg/db"
+)
+
+// fvecs and ivecs are the formats of the ANN benchmark datasets: every
+// vector is a little endian int32 dimension followed by that many float32
+// (fvecs) or int32 (ivecs) components.
+
+type vecsReader struct {
+	reader  *bufio.Reader
+	sidecar *sidecar
+	integer bool
+}
+
+func NewFvecsReader(r io.Reader, options Options) Reader {
+	return &vecsReader{reader: bufio.NewReader(r), sidecar: newSidecar(options)}
+}
+
+func NewIvecsReader(r io.Reader, options Options) Reader {
+	return &vecsReader{reader: bufio.NewReader(r), sidecar: newSidecar(options), integer: true}
+}
+
+func (r *vecsReader) Next() (*db.Vector, error) {
+	var dim int32
+	err := binary.Read(r.reader, binary.LittleEndian, &dim)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vector dimension: %v", err)
+	}
+	if dim < 0 || dim > MaxDimension {
+		return nil, fmt.Errorf("invalid vector dimension %d", dim)
+	}
+
+	buf := make([]byte, 4*int(dim))
+	_, err = io.ReadFull(r.reader, buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vector components: %v", err)
+	}
+
+	embedding := make([]float64, dim)
+	for i := range embedding {
+		bits := binary.LittleEndian.Uint32(buf[4*i:])
+		if r.integer {
+			embedding[i] = float64(int32(bits))
+		} else {
+			embedding[i] = float64(math.Float32frombits(bits))
+		}
+	}
+
+	vector := &db.Vector{Embedding: embedding}
+	err = r.sidecar.fill(vector)
+	if err != nil {
+		return nil, err
+	}
+	return vector, nil
+}
+
+type fvecsWriter struct {
+	writer *bufio.Writer
+	ids    io.Writer
+}
+
+func NewFvecsWriter(w io.Writer, ids io.Writer) Writer {
+	return &fvecsWriter{writer: bufio.NewWriter(w), ids: ids}
+}
+
+func (w *fvecsWriter) Write(vector *db.Vector) error {
+	buf := make([]byte, 4+4*len(vector.Embedding))
+	binary.LittleEndian.PutUint32(buf, uint32(len(vector.Embedding)))
+	for i, value := range vector.Embedding {
+		binary.LittleEndian.PutUint32(buf[4+4*i:], math.Float32bits(float32(value)))
+	}
+	_, err := w.writer.Write(buf)
+	if err != nil {
+		return err
+	}
+
+	if w.ids != nil {
+		_, err = fmt.Fprintln(w.ids, vector.ID)
+	}
+	return err
+}
+
+func (w *fvecsWriter) Close() error {
+	return w.writer.Flush()
+}
@@ -0,0 +1,284 @@
+package chunk
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+const (
+	ChunkerFixed    = "fixed"
+	ChunkerSentence = "sentence"
+	ChunkerMarkdown = "markdown"
+
+	DefaultSize = 200
+)
+
+var ErrInvalidOptions = errors.New("invalid chunker options")
+
+// Chunk is a piece of a text. Start and End are character offsets into
+// the text, and Heading is the path of Markdown headings above it.
+type Chunk struct {
+	Text    string `json:"text"`
+	Start   int    `json:"start"`
+	End     int    `json:"end"`
+	Heading string `json:"heading,omitempty"`
+}
+
+type Chunker interface {
+	Split(text string) []Chunk
+}
+
+// Options size chunks in tokens, which are runs of non-space characters.
+type Options struct {
+	Size    int `json:"size,omitempty"`
+	Overlap int `json:"overlap,omitempty"`
+}
+
+func New(name string, options Options) (Chunker, error) {
+	if options.Size == 0 {
+		options.Size = DefaultSize
+	}
+	if options.Size < 0 || options.Overlap < 0 || options.Overlap >= options.Size {
+		return nil, fmt.Errorf("%w: size must be positive and overlap between 0 and size", ErrInvalidOptions)
+	}
+
+	switch name {
+	case "", ChunkerFixed:
+		return &Fixed{options}, nil
+	case ChunkerSentence:
+		return &Sentence{options}, nil
+	case ChunkerMarkdown:
+		return &Markdown{options}, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown chunker %s", ErrInvalidOptions, name)
+	}
+}
+
+// Fixed splits a text into chunks of Size tokens, each starting Overlap
+// tokens before the end of the previous one.
+type Fixed struct {
+	Options
+}
+
+func (f *Fixed) Split(text string) []Chunk {
+	runes := []rune(text)
+	return splitTokens(runes, tokens(runes, 0, len(runes)), f.Options, "")
+}
+
+// Sentence packs whole sentences into chunks of up to Size tokens. A
+// sentence longer than that is split like Fixed.
+type Sentence struct {
+	Options
+}
+
+func (s *Sentence) Split(text string) []Chunk {
+	runes := []rune(text)
+	return groupSentences(runes, 0, len(runes), s.Options, "")
+}
+
+// Markdown splits a text into sections at ATX headings, outside fenced
+// code blocks, then packs each section like Sentence. Every chunk records
+// the headings it falls under.
+type Markdown struct {
+	Options
+}
+
+type heading struct {
+	level int
+	title string
+}
+
+func (m *Markdown) Split(text string) []Chunk {
+	runes := []rune(text)
+
+	var chunks []Chunk
+	var path []heading
+	sectionStart := 0
+	sectionHeading := ""
+	fenced := false
+
+	for lineStart := 0; lineStart < len(runes); {
+		lineEnd := lineStart
+		for lineEnd < len(runes) && runes[lineEnd] != '\n' {
+			lineEnd++
+		}
+		line := strings.TrimSpace(string(runes[lineStart:lineEnd]))
+
+		if strings.HasPrefix(line, "```") || strings.HasPrefix(line, "~~~") {
+			fenced = !fenced
+		} else if level, title := atxHeading(line); level > 0 && !fenced {
+			chunks = append(chunks, groupSentences(runes, sectionStart, lineStart, m.Options, sectionHeading)...)
+
+			for len(path) > 0 && path[len(path)-1].level >= level {
+				path = path[:len(path)-1]
+			}
+			path = append(path, heading{level: level, title: title})
+			sectionStart = lineStart
+			sectionHeading = headingPath(path)
+		}
+
+		lineStart = lineEnd + 1
+	}
+
+	return append(chunks, groupSentences(runes, sectionStart, len(runes), m.Options, sectionHeading)...)
+}
+
+func atxHeading(line string) (int, string) {
+	level := 0
+	for level < len(line) && line[level] == '#' {
+		level++
+	}
+	if level == 0 || level > 6 || (level < len(line) && line[level] != ' ' && line[level] != '\t') {
+		return 0, ""
+	}
+	title := strings.TrimSpace(line[level:])
+	title = strings.TrimSpace(strings.TrimRight(title, "#"))
+	return level, title
+}
+
+func headingPath(path []heading) string {
+	titles := make([]string, 0, len(path))
+	for _, entry := range path {
+		if entry.title != "" {
+			titles = append(titles, entry.title)
+		}
+	}
+	return strings.Join(titles, " > ")
+}
+
+type span struct {
+	start int
+	end   int
+}
+
+func tokens(runes []rune, start, end int) []span {
+	var result []span
+	inToken := false
+	for n := start; n < end; n++ {
+		if unicode.IsSpace(runes[n]) {
+			if inToken {
+				result[len(result)-1].end = n
+				inToken = false
+			}
+			continue
+		}
+		if !inToken {
+			result = append(result, span{start: n})
+			inToken = true
+		}
+	}
+	if inToken {
+		result[len(result)-1].end = end
+	}
+	return result
+}
+
+// sentences finds sentences ending in '.', '!' or '?' before a space,
+// allowing closing quotes and brackets, and breaks at blank lines.
+func sentences(runes []rune, start, end int) []span {
+	var result []span
+	begin := -1
+	for n := start; n < end; n++ {
+		r := runes[n]
+		if begin < 0 {
+			if !unicode.IsSpace(r) {
+				begin = n
+			}
+			continue
+		}
+
+		stop := -1
+		if r == '.' || r == '!' || r == '?' {
+			next := n + 1
+			for next < end && strings.ContainsRune(`"')]”’`, runes[next]) {
+				next++
+			}
+			if next == end || unicode.IsSpace(runes[next]) {
+				stop = next
+			}
+		} else if r == '\n' && blankLineFollows(runes, n+1, end) {
+			stop = n
+		}
+
+		if stop >= 0 {
+			result = append(result, trimSpan(runes, begin, stop))
+			begin = -1
+			n = stop - 1
+		}
+	}
+	if begin >= 0 {
+		result = append(result, trimSpan(runes, begin, end))
+	}
+	return result
+}
+
+func blankLineFollows(runes []rune, start, end int) bool {
+	for n := start; n < end; n++ {
+		if runes[n] == '\n' {
+			return true
+		}
+		if !unicode.IsSpace(runes[n]) {
+			return false
+		}
+	}
+	return false
+}
+
+func trimSpan(runes []rune, start, end int) span {
+	for end > start && unicode.IsSpace(runes[end-1]) {
+		end--
+	}
+	return span{start: start, end: end}
+}
+
+func groupSentences(runes []rune, start, end int, options Options, heading string) []Chunk {
+	var chunks []Chunk
+	var current []span
+	count := 0
+
+	flush := func() {
+		if len(current) > 0 {
+			chunks = append(chunks, newChunk(runes, current[0].start, current[len(current)-1].end, heading))
+		}
+		current = nil
+		count = 0
+	}
+
+	for _, sentence := range sentences(runes, start, end) {
+		words := tokens(runes, sentence.start, sentence.end)
+		if len(words) > options.Size {
+			flush()
+			chunks = append(chunks, splitTokens(runes, words, options, heading)...)
+			continue
+		}
+		if count+len(words) > options.Size {
+			flush()
+		}
+		current = append(current, sentence)
+		count += len(words)
+	}
+	flush()
+
+	return chunks
+}
+
+func splitTokens(runes []rune, words []span, options Options, heading string) []Chunk {
+	var chunks []Chunk
+	for first := 0; first < len(words); first += options.Size - options.Overlap {
+		last := first + options.Size
+		if last > len(words) {
+			last = len(words)
+		}
+		chunks = append(chunks, newChunk(runes, words[first].start, words[last-1].end, heading))
+		if last == len(words) {
+			break
+		}
+	}
+	return chunks
+}
+
+func newChunk(runes []rune, start, end int, heading string) Chunk {
+	return Chunk{Text: string(runes[start:end]), Start: start, End: end, Heading: heading}
+}
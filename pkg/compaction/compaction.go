@@ -0,0 +1,132 @@
+package compaction
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/0xnu/kikiola/pkg/db"
+	"github.com/0xnu/kikiola/pkg/index"
+)
+
+type Compactor struct {
+	storage    *db.DistributedStorage
+	index      *index.Index
+	lastReport *Report
+	stop       chan struct{}
+	done       chan struct{}
+	runMutex   sync.Mutex
+	mutex      sync.Mutex
+}
+
+type Report struct {
+	StartedAt             time.Time `json:"started_at"`
+	Duration              string    `json:"duration"`
+	StorageBytesReclaimed int64     `json:"storage_bytes_reclaimed"`
+	SegmentBytesReclaimed int64     `json:"segment_bytes_reclaimed"`
+	BlobBytesReclaimed    int64     `json:"blob_bytes_reclaimed"`
+	BytesReclaimed        int64     `json:"bytes_reclaimed"`
+	SegmentsMerged        int       `json:"segments_merged"`
+	TombstonesPurged      int       `json:"tombstones_purged"`
+	BucketsRemoved        int       `json:"buckets_removed"`
+	BlobChunksRemoved     int       `json:"blob_chunks_removed"`
+}
+
+func NewCompactor(storage *db.DistributedStorage, index *index.Index) *Compactor {
+	return &Compactor{
+		storage: storage,
+		index:   index,
+	}
+}
+
+func (c *Compactor) Run() (*Report, error) {
+	c.runMutex.Lock()
+	defer c.runMutex.Unlock()
+
+	report := &Report{StartedAt: time.Now()}
+
+	indexResult, err := c.index.Compact()
+	if err != nil {
+		return nil, fmt.Errorf("failed to compact index: %v", err)
+	}
+	report.SegmentBytesReclaimed = indexResult.BytesReclaimed
+	report.SegmentsMerged = indexResult.SegmentsMerged
+	report.TombstonesPurged = indexResult.RecordsPurged
+	report.BucketsRemoved = indexResult.BucketsRemoved
+
+	storageReclaimed, err := c.storage.Compact()
+	if err != nil {
+		return nil, fmt.Errorf("failed to compact storage: %v", err)
+	}
+	report.StorageBytesReclaimed = storageReclaimed
+
+	sweepResult, err := c.storage.SweepBlobs(db.BlobGracePeriod)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sweep blobs: %v", err)
+	}
+	report.BlobBytesReclaimed = sweepResult.BytesReclaimed
+	report.BlobChunksRemoved = sweepResult.ChunksRemoved
+
+	report.BytesReclaimed = report.StorageBytesReclaimed + report.SegmentBytesReclaimed + report.BlobBytesReclaimed
+	report.Duration = time.Since(report.StartedAt).String()
+
+	c.mutex.Lock()
+	c.lastReport = report
+	c.mutex.Unlock()
+
+	return report, nil
+}
+
+func (c *Compactor) LastReport() *Report {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.lastReport
+}
+
+func (c *Compactor) Start(interval time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.stop != nil || interval <= 0 {
+		return
+	}
+
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+
+	go func(stop, done chan struct{}) {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				report, err := c.Run()
+				if err != nil {
+					log.Printf("Error running compaction: %v", err)
+					continue
+				}
+				log.Printf("Compaction reclaimed %d bytes in %s", report.BytesReclaimed, report.Duration)
+			case <-stop:
+				return
+			}
+		}
+	}(c.stop, c.done)
+}
+
+func (c *Compactor) Stop() {
+	c.mutex.Lock()
+	stop, done := c.stop, c.done
+	c.stop, c.done = nil, nil
+	c.mutex.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
@@ -0,0 +1,224 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+var (
+	ErrEmbeddingsDetached = errors.New("vector embeddings are kept by the index")
+	ErrEmbeddingsMismatch = errors.New("vector embeddings do not match the record")
+)
+
+// EmbeddingStore keeps the embeddings that vector records leave out, so the
+// node databases hold only IDs, metadata and text. The index implements it
+// with its vector segments.
+type EmbeddingStore interface {
+	// ViewEmbeddings calls fn while no write can change the embeddings,
+	// so records read inside it agree with the embeddings loaded for them.
+	ViewEmbeddings(fn func() error) error
+	// LoadEmbeddings fills in the embeddings a record left out.
+	LoadEmbeddings(vector *Vector, detached *DetachedEmbeddings) error
+}
+
+// DetachedEmbeddings describes the embeddings a vector record leaves to
+// the embedding store: how many token embeddings and which named
+// embeddings the vector has, and a digest of all of them.
+type DetachedEmbeddings struct {
+	Tokens int
+	Fields []string
+	Digest string
+}
+
+// storedVector is a vector record without its embeddings.
+type storedVector struct {
+	Vector
+	Tokens int      `json:",omitempty"`
+	Fields []string `json:",omitempty"`
+	Digest string   `json:",omitempty"`
+}
+
+// SetEmbeddingStore makes the node databases leave embeddings out of the
+// vector records they write and load them from store when read. Records
+// written before keep their embeddings until they are rewritten.
+func (ds *DistributedStorage) SetEmbeddingStore(store EmbeddingStore) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	ds.embeddings = store
+	for _, node := range ds.nodes {
+		node.detach = store != nil
+	}
+}
+
+// EachVectorRecord calls fn with every vector as its node database keeps
+// it. Detached is nil for records that still hold their embeddings.
+func (ds *DistributedStorage) EachVectorRecord(fn func(vector *Vector, detached *DetachedEmbeddings) error) error {
+	iterator := ds.IterateVectors(ListOptions{})
+	iterator.records = true
+	for {
+		vector, err := iterator.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		detached := vector.detached
+		vector.detached = nil
+		err = fn(vector, detached)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// loadVectors calls read, which returns vectors from the node databases,
+// and fills in the embeddings their records left to the embedding store.
+func (ds *DistributedStorage) loadVectors(read func() ([]*Vector, error)) ([]*Vector, error) {
+	ds.mutex.RLock()
+	store := ds.embeddings
+	ds.mutex.RUnlock()
+
+	if store == nil {
+		vectors, err := read()
+		if err != nil {
+			return nil, err
+		}
+		for _, vector := range vectors {
+			if vector.detached != nil {
+				return nil, fmt.Errorf("%w: %s", ErrEmbeddingsDetached, vector.ID)
+			}
+		}
+		return vectors, nil
+	}
+
+	var vectors []*Vector
+	err := store.ViewEmbeddings(func() error {
+		var err error
+		vectors, err = read()
+		if err != nil {
+			return err
+		}
+		for _, vector := range vectors {
+			if vector.detached == nil {
+				continue
+			}
+			err = store.LoadEmbeddings(vector, vector.detached)
+			if err != nil {
+				return fmt.Errorf("failed to load embeddings of vector %s: %v", vector.ID, err)
+			}
+			digest, err := embeddingsDigest(vector)
+			if err != nil {
+				return err
+			}
+			if digest != vector.detached.Digest {
+				return fmt.Errorf("%w: %s", ErrEmbeddingsMismatch, vector.ID)
+			}
+			vector.detached = nil
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vectors, nil
+}
+
+// detachEmbeddings returns the record of a vector without its embeddings.
+func detachEmbeddings(vector *Vector) (*storedVector, error) {
+	digest, err := embeddingsDigest(vector)
+	if err != nil {
+		return nil, err
+	}
+
+	stripped := *vector
+	stripped.Embedding = nil
+	stripped.Embeddings = nil
+	stripped.Vectors = nil
+	stripped.detached = nil
+
+	fields := make([]string, 0, len(vector.Vectors))
+	for name := range vector.Vectors {
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+
+	return &storedVector{
+		Vector: stripped,
+		Tokens: len(vector.Embeddings),
+		Fields: fields,
+		Digest: digest,
+	}, nil
+}
+
+// embeddingsDigest hashes the embeddings of a vector as they read back
+// from the embedding store, where empty embeddings are absent.
+func embeddingsDigest(vector *Vector) (string, error) {
+	embeddings := struct {
+		Embedding  []float64            `json:",omitempty"`
+		Embeddings [][]float64          `json:",omitempty"`
+		Vectors    map[string][]float64 `json:",omitempty"`
+	}{vector.Embedding, vector.Embeddings, vector.Vectors}
+
+	data, err := json.Marshal(embeddings)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal embeddings: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// encodeVector serializes a vector record, leaving out the embeddings when
+// the node keeps them in the embedding store.
+func (s *Storage) encodeVector(vector *Vector) (string, error) {
+	var data []byte
+	var err error
+	if s.detach {
+		var record *storedVector
+		record, err = detachEmbeddings(vector)
+		if err != nil {
+			return "", err
+		}
+		data, err = json.Marshal(record)
+	} else {
+		data, err = json.Marshal(vector)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal vector: %v", err)
+	}
+	return string(data), nil
+}
+
+func decodeVector(data string) (*Vector, error) {
+	var record storedVector
+	err := json.Unmarshal([]byte(data), &record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal vector: %v", err)
+	}
+
+	vector := record.Vector
+	if record.Digest != "" {
+		vector.detached = &DetachedEmbeddings{Tokens: record.Tokens, Fields: record.Fields, Digest: record.Digest}
+	}
+	return &vector, nil
+}
+
+// recordVersion returns the version of the vector a record holds. A
+// detached record is serialized the way Version serializes the vector, so
+// its own hash is the version.
+func recordVersion(data string) (string, error) {
+	vector, err := decodeVector(data)
+	if err != nil {
+		return "", err
+	}
+	if vector.detached != nil {
+		return versionOf([]byte(data)), nil
+	}
+	return vector.Version()
+}
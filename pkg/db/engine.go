@@ -0,0 +1,49 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	EngineBuntDB = "buntdb"
+	EngineMemory = "memory"
+)
+
+var ErrKeyNotFound = errors.New("key not found")
+var ErrSnapshotUnsupported = errors.New("storage engine does not support snapshots")
+
+type Engine interface {
+	Get(key string) (string, error)
+	Set(key, value string) error
+	Delete(key string) error
+	Scan(pivot string, iterator func(key, value string) bool) error
+	Batch(fn func(batch Batch) error) error
+	Close() error
+}
+
+type Batch interface {
+	Get(key string) (string, error)
+	Set(key, value string) error
+	Delete(key string) error
+}
+
+type Compactor interface {
+	Compact() (int64, error)
+}
+
+type Snapshotter interface {
+	Save(w io.Writer) error
+}
+
+func OpenEngine(kind, path string) (Engine, error) {
+	switch kind {
+	case "", EngineBuntDB:
+		return openBuntEngine(path)
+	case EngineMemory:
+		return newMemoryEngine(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage engine: %s", kind)
+	}
+}
@@ -0,0 +1,126 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/tidwall/buntdb"
+)
+
+type buntEngine struct {
+	db   *buntdb.DB
+	path string
+}
+
+type buntBatch struct {
+	tx *buntdb.Tx
+}
+
+func openBuntEngine(path string) (*buntEngine, error) {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %v", err)
+	}
+
+	db, err := buntdb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+
+	return &buntEngine{db: db, path: path}, nil
+}
+
+func (e *buntEngine) Get(key string) (string, error) {
+	var value string
+	err := e.db.View(func(tx *buntdb.Tx) error {
+		var err error
+		value, err = (&buntBatch{tx: tx}).Get(key)
+		return err
+	})
+	return value, err
+}
+
+func (e *buntEngine) Set(key, value string) error {
+	return e.db.Update(func(tx *buntdb.Tx) error {
+		return (&buntBatch{tx: tx}).Set(key, value)
+	})
+}
+
+func (e *buntEngine) Delete(key string) error {
+	return e.db.Update(func(tx *buntdb.Tx) error {
+		return (&buntBatch{tx: tx}).Delete(key)
+	})
+}
+
+func (e *buntEngine) Scan(pivot string, iterator func(key, value string) bool) error {
+	return e.db.View(func(tx *buntdb.Tx) error {
+		if pivot == "" {
+			return tx.Ascend("", iterator)
+		}
+		return tx.AscendGreaterOrEqual("", pivot, iterator)
+	})
+}
+
+func (e *buntEngine) Batch(fn func(batch Batch) error) error {
+	return e.db.Update(func(tx *buntdb.Tx) error {
+		return fn(&buntBatch{tx: tx})
+	})
+}
+
+func (e *buntEngine) Compact() (int64, error) {
+	before, err := e.fileSize()
+	if err != nil {
+		return 0, err
+	}
+
+	err = e.db.Shrink()
+	if err != nil {
+		return 0, fmt.Errorf("failed to shrink database: %v", err)
+	}
+
+	after, err := e.fileSize()
+	if err != nil {
+		return 0, err
+	}
+
+	return before - after, nil
+}
+
+func (e *buntEngine) Save(w io.Writer) error {
+	return e.db.Save(w)
+}
+
+func (e *buntEngine) fileSize() (int64, error) {
+	info, err := os.Stat(e.path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat database: %v", err)
+	}
+	return info.Size(), nil
+}
+
+func (e *buntEngine) Close() error {
+	return e.db.Close()
+}
+
+func (b *buntBatch) Get(key string) (string, error) {
+	value, err := b.tx.Get(key)
+	if err == buntdb.ErrNotFound {
+		return "", ErrKeyNotFound
+	}
+	return value, err
+}
+
+func (b *buntBatch) Set(key, value string) error {
+	_, _, err := b.tx.Set(key, value, nil)
+	return err
+}
+
+func (b *buntBatch) Delete(key string) error {
+	_, err := b.tx.Delete(key)
+	if err == buntdb.ErrNotFound {
+		return ErrKeyNotFound
+	}
+	return err
+}
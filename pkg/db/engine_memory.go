@@ -0,0 +1,148 @@
+package db
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+type memoryEngine struct {
+	data   map[string]string
+	closed bool
+	mutex  sync.RWMutex
+}
+
+type memoryBatch struct {
+	engine  *memoryEngine
+	writes  map[string]string
+	deletes map[string]bool
+}
+
+var errEngineClosed = errors.New("engine closed")
+
+func newMemoryEngine() *memoryEngine {
+	return &memoryEngine{
+		data: make(map[string]string),
+	}
+}
+
+func (e *memoryEngine) Get(key string) (string, error) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+
+	if e.closed {
+		return "", errEngineClosed
+	}
+
+	value, ok := e.data[key]
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	return value, nil
+}
+
+func (e *memoryEngine) Set(key, value string) error {
+	return e.Batch(func(batch Batch) error {
+		return batch.Set(key, value)
+	})
+}
+
+func (e *memoryEngine) Delete(key string) error {
+	return e.Batch(func(batch Batch) error {
+		return batch.Delete(key)
+	})
+}
+
+func (e *memoryEngine) Scan(pivot string, iterator func(key, value string) bool) error {
+	e.mutex.RLock()
+	if e.closed {
+		e.mutex.RUnlock()
+		return errEngineClosed
+	}
+
+	keys := make([]string, 0, len(e.data))
+	for key := range e.data {
+		if key >= pivot {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		values[i] = e.data[key]
+	}
+	e.mutex.RUnlock()
+
+	for i, key := range keys {
+		if !iterator(key, values[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+func (e *memoryEngine) Batch(fn func(batch Batch) error) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.closed {
+		return errEngineClosed
+	}
+
+	batch := &memoryBatch{
+		engine:  e,
+		writes:  make(map[string]string),
+		deletes: make(map[string]bool),
+	}
+	err := fn(batch)
+	if err != nil {
+		return err
+	}
+
+	for key := range batch.deletes {
+		delete(e.data, key)
+	}
+	for key, value := range batch.writes {
+		e.data[key] = value
+	}
+	return nil
+}
+
+func (e *memoryEngine) Close() error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.closed = true
+	e.data = nil
+	return nil
+}
+
+func (b *memoryBatch) Get(key string) (string, error) {
+	if b.deletes[key] {
+		return "", ErrKeyNotFound
+	}
+	if value, ok := b.writes[key]; ok {
+		return value, nil
+	}
+	value, ok := b.engine.data[key]
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	return value, nil
+}
+
+func (b *memoryBatch) Set(key, value string) error {
+	delete(b.deletes, key)
+	b.writes[key] = value
+	return nil
+}
+
+func (b *memoryBatch) Delete(key string) error {
+	if _, err := b.Get(key); err != nil {
+		return err
+	}
+	delete(b.writes, key)
+	b.deletes[key] = true
+	return nil
+}
@@ -0,0 +1,224 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	DefaultListLimit    = 100
+	MaxListLimit        = 1000
+	DefaultIteratorPage = 500
+)
+
+type ListOptions struct {
+	After  string
+	Limit  int
+	Filter map[string]string
+}
+
+func (o ListOptions) limit() int {
+	if o.Limit <= 0 {
+		return DefaultListLimit
+	}
+	return o.Limit
+}
+
+func (ds *DistributedStorage) ListVectors(options ListOptions) ([]*Vector, string, error) {
+	limit := options.limit()
+	if limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+	nodeOptions := ListOptions{After: options.After, Limit: limit + 1, Filter: options.Filter}
+
+	cursor := ""
+	vectors, err := ds.loadVectors(func() ([]*Vector, error) {
+		ds.mutex.RLock()
+		defer ds.mutex.RUnlock()
+
+		var vectors []*Vector
+		for _, node := range ds.nodes {
+			nodeVectors, err := node.ListVectors(nodeOptions)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list vectors from node: %v", err)
+			}
+			vectors = append(vectors, nodeVectors...)
+		}
+
+		sort.Slice(vectors, func(i, j int) bool {
+			return vectors[i].ID < vectors[j].ID
+		})
+
+		if len(vectors) > limit {
+			vectors = vectors[:limit]
+			cursor = vectors[limit-1].ID
+		}
+		return vectors, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return vectors, cursor, nil
+}
+
+func (ds *DistributedStorage) ListObjects(options ListOptions) ([]*Object, string, error) {
+	ds.mutex.RLock()
+	defer ds.mutex.RUnlock()
+
+	limit := options.limit()
+	if limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+	nodeOptions := ListOptions{After: options.After, Limit: limit + 1, Filter: options.Filter}
+
+	var objects []*Object
+	for _, node := range ds.nodes {
+		nodeObjects, err := node.ListObjects(nodeOptions)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to list objects from node: %v", err)
+		}
+		objects = append(objects, nodeObjects...)
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].ID < objects[j].ID
+	})
+
+	cursor := ""
+	if len(objects) > limit {
+		objects = objects[:limit]
+		cursor = objects[limit-1].ID
+	}
+
+	return objects, cursor, nil
+}
+
+type VectorIterator struct {
+	storage  *DistributedStorage
+	options  ListOptions
+	node     int
+	buffered []*Vector
+
+	// records leaves detached embeddings unloaded.
+	records bool
+}
+
+func (ds *DistributedStorage) IterateVectors(options ListOptions) *VectorIterator {
+	if options.Limit <= 0 {
+		options.Limit = DefaultIteratorPage
+	}
+	return &VectorIterator{storage: ds, options: options}
+}
+
+func (it *VectorIterator) Next() (*Vector, error) {
+	for len(it.buffered) == 0 {
+		if it.node >= len(it.storage.nodes) {
+			return nil, io.EOF
+		}
+
+		read := func() ([]*Vector, error) {
+			it.storage.mutex.RLock()
+			defer it.storage.mutex.RUnlock()
+
+			return it.storage.nodes[it.node].ListVectors(it.options)
+		}
+		var vectors []*Vector
+		var err error
+		if it.records {
+			vectors, err = read()
+		} else {
+			vectors, err = it.storage.loadVectors(read)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(vectors) < it.options.Limit {
+			it.node++
+			it.options.After = ""
+		} else {
+			it.options.After = vectors[len(vectors)-1].ID
+		}
+		it.buffered = vectors
+	}
+
+	vector := it.buffered[0]
+	it.buffered = it.buffered[1:]
+	return vector, nil
+}
+
+func (s *Storage) ListVectors(options ListOptions) ([]*Vector, error) {
+	var vectors []*Vector
+	err := s.scanAfter(options.After, func(key, value string) (bool, error) {
+		if !isVectorRecord(value) {
+			return true, nil
+		}
+		vector, err := decodeVector(value)
+		if err != nil {
+			return false, err
+		}
+		if MatchesMetadata(vector.Metadata, options.Filter) {
+			vectors = append(vectors, vector)
+		}
+		return len(vectors) < options.limit(), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list vectors: %v", err)
+	}
+
+	return vectors, nil
+}
+
+func (s *Storage) ListObjects(options ListOptions) ([]*Object, error) {
+	var objects []*Object
+	err := s.scanAfter(options.After, func(key, value string) (bool, error) {
+		if isVectorRecord(value) {
+			return true, nil
+		}
+		var object Object
+		err := json.Unmarshal([]byte(value), &object)
+		if err != nil {
+			return false, fmt.Errorf("failed to unmarshal object: %v", err)
+		}
+		if MatchesMetadata(object.Metadata, options.Filter) {
+			objects = append(objects, &object)
+		}
+		return len(objects) < options.limit(), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %v", err)
+	}
+
+	return objects, nil
+}
+
+func (s *Storage) scanAfter(after string, fn func(key, value string) (bool, error)) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var scanErr error
+	err := s.engine.Scan(after, func(key, value string) bool {
+		if after != "" && key <= after {
+			return true
+		}
+		var next bool
+		next, scanErr = fn(key, value)
+		return next && scanErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	return scanErr
+}
+
+func MatchesMetadata(metadata, filter map[string]string) bool {
+	for key, value := range filter {
+		if metadata[key] != value {
+			return false
+		}
+	}
+	return true
+}
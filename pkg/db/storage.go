@@ -1,49 +1,151 @@
 package db
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
-	"github.com/tidwall/buntdb"
+	"github.com/0xnu/kikiola/pkg/blob"
 )
 
 type DistributedStorage struct {
-	nodes []*Storage
-	mutex sync.RWMutex
+	nodes     []*Storage
+	addresses []string
+	dataDir   string
+	tempDir   bool
+	blobs     *blob.Store
+	mutex     sync.RWMutex
+
+	embeddings EmbeddingStore
+
+	versionRetention int
+
+	uploadMutex sync.Mutex
+}
+
+type StorageOptions struct {
+	DataDir string
+	Engine  string
 }
 
 type Object struct {
-	ID       string            `json:"id"`
-	Object   []byte            `json:"object"`
-	Metadata map[string]string `json:"metadata"`
+	ID          string            `json:"id"`
+	Object      []byte            `json:"object,omitempty"`
+	Metadata    map[string]string `json:"metadata"`
+	ContentType string            `json:"content_type,omitempty"`
+	Blob        *blob.Blob        `json:"blob,omitempty"`
+	Version     int               `json:"version,omitempty"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+	History     []*ObjectVersion  `json:"history,omitempty"`
 }
 
 var ErrNotFound = errors.New("object not found")
 var ErrObjectNotFound = errors.New("object not found")
 var ErrVectorNotFound = errors.New("vector not found")
+var ErrVectorExists = errors.New("vector already exists")
+var ErrVersionMismatch = errors.New("vector version does not match")
+
+type WriteMode int
+
+const (
+	WriteUpsert WriteMode = iota
+	WriteCreate
+)
+
+func DefaultStorageOptions() StorageOptions {
+	return StorageOptions{
+		DataDir: "data",
+		Engine:  EngineBuntDB,
+	}
+}
 
 func NewDistributedStorage(nodeAddresses []string) (*DistributedStorage, error) {
+	return NewDistributedStorageWithOptions(nodeAddresses, DefaultStorageOptions())
+}
+
+// NewDistributedStorageWithOptions opens the node databases, blob store
+// and upload sessions under options.DataDir. The memory engine may leave
+// DataDir empty, in which case a temporary directory is used and removed
+// on Close.
+func NewDistributedStorageWithOptions(nodeAddresses []string, options StorageOptions) (*DistributedStorage, error) {
 	var nodes []*Storage
 
+	tempDir := false
+	opened := false
+	if options.DataDir == "" {
+		if options.Engine != EngineMemory {
+			return nil, errors.New("storage requires a data directory")
+		}
+		dir, err := os.MkdirTemp("", "kikiola-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create temporary data directory: %v", err)
+		}
+		options.DataDir = dir
+		tempDir = true
+		defer func() {
+			if !opened {
+				os.RemoveAll(dir)
+			}
+		}()
+	}
+
+	blobs, err := blob.Open(filepath.Join(options.DataDir, BlobDir))
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filepath.Join(options.DataDir, UploadDir), os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %v", err)
+	}
+
 	for _, address := range nodeAddresses {
-		dbPath := fmt.Sprintf("data/node_%s.db", address)
-		storage, err := NewStorage(dbPath)
+		dbPath := filepath.Join(options.DataDir, NodeFileName(address))
+		engine, err := OpenEngine(options.Engine, dbPath)
 		if err != nil {
 			return nil, fmt.Errorf("failed to create storage for node %s: %v", address, err)
 		}
-		nodes = append(nodes, storage)
+		nodes = append(nodes, NewStorageWithEngine(engine))
+	}
+
+	ds := &DistributedStorage{
+		nodes:     nodes,
+		addresses: nodeAddresses,
+		dataDir:   options.DataDir,
+		tempDir:   tempDir,
+		blobs:     blobs,
+
+		versionRetention: DefaultVersionRetention,
 	}
+	err = ds.loadBlobRefs()
+	if err != nil {
+		ds.Close()
+		return nil, err
+	}
+	opened = true
+	return ds, nil
+}
+
+func NodeFileName(address string) string {
+	return fmt.Sprintf("node_%s.db", address)
+}
+
+func (ds *DistributedStorage) DataDir() string {
+	return ds.dataDir
+}
 
-	return &DistributedStorage{
-		nodes: nodes,
-	}, nil
+func (ds *DistributedStorage) NodeAddresses() []string {
+	addresses := make([]string, len(ds.addresses))
+	copy(addresses, ds.addresses)
+	return addresses
 }
 
 func (ds *DistributedStorage) InsertVector(vector *Vector) error {
@@ -54,12 +156,84 @@ func (ds *DistributedStorage) InsertVector(vector *Vector) error {
 	return ds.nodes[nodeIndex].InsertVector(vector)
 }
 
+func (ds *DistributedStorage) InsertVectors(vectors []*Vector) error {
+	for _, err := range ds.WriteVectors(vectors, WriteUpsert) {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ds *DistributedStorage) PutVector(vector *Vector, mode WriteMode, ifMatch string) (bool, error) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	nodeIndex := ds.getNodeIndex(vector.ID)
+	return ds.nodes[nodeIndex].PutVector(vector, mode, ifMatch)
+}
+
+func (ds *DistributedStorage) WriteVectors(vectors []*Vector, mode WriteMode) []error {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	ids := make([]string, len(vectors))
+	for i, vector := range vectors {
+		ids[i] = vector.ID
+	}
+
+	results := make([]error, len(vectors))
+	for nodeIndex, positions := range ds.groupByNode(ids) {
+		nodeVectors := make([]*Vector, len(positions))
+		for i, position := range positions {
+			nodeVectors[i] = vectors[position]
+		}
+
+		nodeResults := ds.nodes[nodeIndex].WriteVectors(nodeVectors, mode)
+		for i, position := range positions {
+			results[position] = nodeResults[i]
+		}
+	}
+
+	return results
+}
+
+func (ds *DistributedStorage) DeleteVectors(ids []string) []error {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	results := make([]error, len(ids))
+	for nodeIndex, positions := range ds.groupByNode(ids) {
+		nodeIDs := make([]string, len(positions))
+		for i, position := range positions {
+			nodeIDs[i] = ids[position]
+		}
+
+		nodeResults := ds.nodes[nodeIndex].DeleteVectors(nodeIDs)
+		for i, position := range positions {
+			results[position] = nodeResults[i]
+		}
+	}
+
+	return results
+}
+
 func (ds *DistributedStorage) GetVector(id string) (*Vector, error) {
-	ds.mutex.RLock()
-	defer ds.mutex.RUnlock()
+	vectors, err := ds.loadVectors(func() ([]*Vector, error) {
+		ds.mutex.RLock()
+		defer ds.mutex.RUnlock()
 
-	nodeIndex := ds.getNodeIndex(id)
-	return ds.nodes[nodeIndex].GetVector(id)
+		nodeIndex := ds.getNodeIndex(id)
+		vector, err := ds.nodes[nodeIndex].GetVector(id)
+		if err != nil {
+			return nil, err
+		}
+		return []*Vector{vector}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return vectors[0], nil
 }
 
 func (ds *DistributedStorage) DeleteVector(id string) error {
@@ -71,19 +245,21 @@ func (ds *DistributedStorage) DeleteVector(id string) error {
 }
 
 func (ds *DistributedStorage) GetAllVectors() ([]*Vector, error) {
-	ds.mutex.RLock()
-	defer ds.mutex.RUnlock()
+	return ds.loadVectors(func() ([]*Vector, error) {
+		ds.mutex.RLock()
+		defer ds.mutex.RUnlock()
 
-	var vectors []*Vector
-	for _, node := range ds.nodes {
-		nodeVectors, err := node.GetAllVectors()
-		if err != nil {
-			return nil, fmt.Errorf("failed to get vectors from node: %v", err)
+		var vectors []*Vector
+		for _, node := range ds.nodes {
+			nodeVectors, err := node.GetAllVectors()
+			if err != nil {
+				return nil, fmt.Errorf("failed to get vectors from node: %v", err)
+			}
+			vectors = append(vectors, nodeVectors...)
 		}
-		vectors = append(vectors, nodeVectors...)
-	}
 
-	return vectors, nil
+		return vectors, nil
+	})
 }
 
 func (ds *DistributedStorage) UpdateVectorMetadata(id string, metadata map[string]string) error {
@@ -94,12 +270,28 @@ func (ds *DistributedStorage) UpdateVectorMetadata(id string, metadata map[strin
 	return ds.nodes[nodeIndex].UpdateVectorMetadata(id, metadata)
 }
 
+// InsertObject records an object, moving inline content into the blob
+// store. An object it replaces becomes an earlier version.
 func (ds *DistributedStorage) InsertObject(object *Object) error {
+	if object.Blob == nil && len(object.Object) > 0 {
+		stored, err := ds.StoreContent(bytes.NewReader(object.Object))
+		if err != nil {
+			return err
+		}
+		object.Object = nil
+		object.Blob = stored
+	}
+
 	ds.mutex.Lock()
 	defer ds.mutex.Unlock()
 
-	nodeIndex := ds.getNodeIndex(object.ID)
-	return ds.nodes[nodeIndex].InsertObject(object)
+	node := ds.nodes[ds.getNodeIndex(object.ID)]
+	previous, err := node.GetObject(object.ID)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return err
+	}
+
+	return ds.replaceObject(node, previous, object)
 }
 
 func (ds *DistributedStorage) GetObject(id string) (*Object, error) {
@@ -114,8 +306,26 @@ func (ds *DistributedStorage) DeleteObject(id string) error {
 	ds.mutex.Lock()
 	defer ds.mutex.Unlock()
 
-	nodeIndex := ds.getNodeIndex(id)
-	return ds.nodes[nodeIndex].DeleteObject(id)
+	node := ds.nodes[ds.getNodeIndex(id)]
+	object, err := node.GetObject(id)
+	if err != nil {
+		return err
+	}
+
+	err = node.DeleteObject(id)
+	if err != nil {
+		return err
+	}
+
+	for _, version := range object.Versions() {
+		if version.Blob != nil {
+			err = ds.blobs.Release(version.Blob)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func (ds *DistributedStorage) GetAllObjects() ([]*Object, error) {
@@ -138,8 +348,77 @@ func (ds *DistributedStorage) UpdateObjectMetadata(id string, metadata map[strin
 	ds.mutex.Lock()
 	defer ds.mutex.Unlock()
 
-	nodeIndex := ds.getNodeIndex(id)
-	return ds.nodes[nodeIndex].UpdateObjectMetadata(id, metadata)
+	node := ds.nodes[ds.getNodeIndex(id)]
+	previous, err := node.GetObject(id)
+	if err != nil {
+		return err
+	}
+
+	object := &Object{
+		ID:          id,
+		Object:      previous.Object,
+		Metadata:    copyMetadata(previous.Metadata),
+		ContentType: previous.ContentType,
+		Blob:        previous.Blob,
+	}
+	if object.Metadata == nil {
+		object.Metadata = make(map[string]string)
+	}
+	for key, value := range metadata {
+		object.Metadata[key] = value
+	}
+
+	return ds.replaceObject(node, previous, object)
+}
+
+func (ds *DistributedStorage) Compact() (int64, error) {
+	ds.mutex.RLock()
+	defer ds.mutex.RUnlock()
+
+	var reclaimed int64
+	for _, node := range ds.nodes {
+		nodeReclaimed, err := node.Compact()
+		if err != nil {
+			return reclaimed, fmt.Errorf("failed to compact node: %v", err)
+		}
+		reclaimed += nodeReclaimed
+	}
+
+	return reclaimed, nil
+}
+
+// Snapshot saves every node and lists the blob chunks at the same point.
+// The chunks are pinned so a sweep cannot remove them while they are
+// copied, and the caller unpins them with Blobs().Unpin when done.
+func (ds *DistributedStorage) Snapshot(open func(address string) (io.WriteCloser, error)) ([]string, error) {
+	ds.mutex.RLock()
+	defer ds.mutex.RUnlock()
+
+	for i, node := range ds.nodes {
+		address := ds.addresses[i]
+
+		w, err := open(address)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open snapshot for node %s: %v", address, err)
+		}
+
+		err = node.Save(w)
+		if err != nil {
+			w.Close()
+			return nil, fmt.Errorf("failed to snapshot node %s: %w", address, err)
+		}
+
+		err = w.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to finish snapshot for node %s: %v", address, err)
+		}
+	}
+
+	chunks, err := ds.blobs.PinChunks()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blob chunks: %v", err)
+	}
+	return chunks, nil
 }
 
 func (ds *DistributedStorage) Close() error {
@@ -149,9 +428,24 @@ func (ds *DistributedStorage) Close() error {
 			return fmt.Errorf("failed to close node storage: %v", err)
 		}
 	}
+	if ds.tempDir {
+		err := os.RemoveAll(ds.dataDir)
+		if err != nil {
+			return fmt.Errorf("failed to remove temporary data directory: %v", err)
+		}
+	}
 	return nil
 }
 
+func (ds *DistributedStorage) groupByNode(ids []string) map[int][]int {
+	groups := make(map[int][]int)
+	for position, id := range ids {
+		nodeIndex := ds.getNodeIndex(id)
+		groups[nodeIndex] = append(groups[nodeIndex], position)
+	}
+	return groups
+}
+
 func (ds *DistributedStorage) getNodeIndex(id string) int {
 	hash := sha256.New()
 
@@ -188,41 +482,36 @@ func (ds *DistributedStorage) getNodeIndex(id string) int {
 }
 
 type Storage struct {
-	db    *buntdb.DB
-	mutex sync.RWMutex
+	engine Engine
+	detach bool
+	mutex  sync.RWMutex
 }
 
 func NewStorage(dbPath string) (*Storage, error) {
-	err := os.MkdirAll(filepath.Dir(dbPath), os.ModePerm)
+	engine, err := OpenEngine(EngineBuntDB, dbPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create data directory: %v", err)
+		return nil, err
 	}
 
-	db, err := buntdb.Open(dbPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %v", err)
-	}
+	return NewStorageWithEngine(engine), nil
+}
 
-	storage := &Storage{
-		db: db,
+func NewStorageWithEngine(engine Engine) *Storage {
+	return &Storage{
+		engine: engine,
 	}
-
-	return storage, nil
 }
 
 func (s *Storage) InsertVector(vector *Vector) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	serializedData, err := json.Marshal(vector)
+	serializedData, err := s.encodeVector(vector)
 	if err != nil {
-		return fmt.Errorf("failed to marshal vector: %v", err)
+		return err
 	}
 
-	err = s.db.Update(func(tx *buntdb.Tx) error {
-		_, _, err := tx.Set(vector.ID, string(serializedData), nil)
-		return err
-	})
+	err = s.engine.Set(vector.ID, serializedData)
 	if err != nil {
 		return fmt.Errorf("failed to insert vector: %v", err)
 	}
@@ -230,50 +519,160 @@ func (s *Storage) InsertVector(vector *Vector) error {
 	return nil
 }
 
-func (s *Storage) GetVector(id string) (*Vector, error) {
-	s.mutex.RLock()
-	defer s.mutex.RUnlock()
-
-	var data string
-	err := s.db.View(func(tx *buntdb.Tx) error {
-		val, err := tx.Get(id)
+func (s *Storage) InsertVectors(vectors []*Vector) error {
+	for _, err := range s.WriteVectors(vectors, WriteUpsert) {
 		if err != nil {
-			if err == buntdb.ErrNotFound {
-				return ErrVectorNotFound
-			}
 			return err
 		}
-		data = val
-		return nil
+	}
+	return nil
+}
+
+func (s *Storage) PutVector(vector *Vector, mode WriteMode, ifMatch string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	serializedData, err := s.encodeVector(vector)
+	if err != nil {
+		return false, err
+	}
+
+	created := false
+	err = s.engine.Batch(func(batch Batch) error {
+		existing, err := batch.Get(vector.ID)
+		if err != nil && err != ErrKeyNotFound {
+			return err
+		}
+		created = err == ErrKeyNotFound
+
+		if !created && mode == WriteCreate {
+			return ErrVectorExists
+		}
+		if ifMatch != "" {
+			if created {
+				return ErrVersionMismatch
+			}
+			if ifMatch != "*" {
+				version, err := recordVersion(existing)
+				if err != nil {
+					return err
+				}
+				if ifMatch != version {
+					return ErrVersionMismatch
+				}
+			}
+		}
+
+		return batch.Set(vector.ID, serializedData)
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get vector: %v", err)
+		if err == ErrVectorExists || err == ErrVersionMismatch {
+			return false, err
+		}
+		return false, fmt.Errorf("failed to insert vector: %v", err)
+	}
+
+	return created, nil
+}
+
+func (s *Storage) WriteVectors(vectors []*Vector, mode WriteMode) []error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	results := make([]error, len(vectors))
+	serialized := make([]string, len(vectors))
+	for i, vector := range vectors {
+		serialized[i], results[i] = s.encodeVector(vector)
 	}
 
-	var vector Vector
-	err = json.Unmarshal([]byte(data), &vector)
+	err := s.engine.Batch(func(batch Batch) error {
+		for i, vector := range vectors {
+			if results[i] != nil {
+				continue
+			}
+			if mode == WriteCreate {
+				_, err := batch.Get(vector.ID)
+				if err == nil {
+					results[i] = ErrVectorExists
+					continue
+				}
+				if err != ErrKeyNotFound {
+					return err
+				}
+			}
+			err := batch.Set(vector.ID, serialized[i])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal vector: %v", err)
+		err = fmt.Errorf("failed to insert vectors: %v", err)
+		for i := range results {
+			if results[i] == nil {
+				results[i] = err
+			}
+		}
 	}
 
-	return &vector, nil
+	return results
 }
 
-func (s *Storage) DeleteVector(id string) error {
+func (s *Storage) DeleteVectors(ids []string) []error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	err := s.db.Update(func(tx *buntdb.Tx) error {
-		_, err := tx.Delete(id)
-		if err != nil {
-			if err == buntdb.ErrNotFound {
-				return ErrVectorNotFound
+	results := make([]error, len(ids))
+	err := s.engine.Batch(func(batch Batch) error {
+		for i, id := range ids {
+			err := batch.Delete(id)
+			if err == ErrKeyNotFound {
+				results[i] = ErrVectorNotFound
+				continue
+			}
+			if err != nil {
+				return err
 			}
-			return err
 		}
 		return nil
 	})
 	if err != nil {
+		err = fmt.Errorf("failed to delete vectors: %v", err)
+		for i := range results {
+			if results[i] == nil {
+				results[i] = err
+			}
+		}
+	}
+
+	return results
+}
+
+func (s *Storage) GetVector(id string) (*Vector, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	data, err := s.engine.Get(id)
+	if err != nil {
+		if err == ErrKeyNotFound {
+			return nil, ErrVectorNotFound
+		}
+		return nil, fmt.Errorf("failed to get vector: %v", err)
+	}
+
+	return decodeVector(data)
+}
+
+func (s *Storage) DeleteVector(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := s.engine.Delete(id)
+	if err != nil {
+		if err == ErrKeyNotFound {
+			return ErrVectorNotFound
+		}
 		return fmt.Errorf("failed to delete vector: %v", err)
 	}
 
@@ -285,17 +684,16 @@ func (s *Storage) GetAllVectors() ([]*Vector, error) {
 	defer s.mutex.RUnlock()
 
 	var vectors []*Vector
-	err := s.db.View(func(tx *buntdb.Tx) error {
-		err := tx.Ascend("", func(key, value string) bool {
-			var vector Vector
-			err := json.Unmarshal([]byte(value), &vector)
-			if err != nil {
-				return false
-			}
-			vectors = append(vectors, &vector)
+	err := s.engine.Scan("", func(key, value string) bool {
+		if !isVectorRecord(value) {
 			return true
-		})
-		return err
+		}
+		vector, err := decodeVector(value)
+		if err != nil {
+			return false
+		}
+		vectors = append(vectors, vector)
+		return true
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to get all vectors: %v", err)
@@ -308,42 +706,41 @@ func (s *Storage) UpdateVectorMetadata(id string, metadata map[string]string) er
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	var vector Vector
-	err := s.db.View(func(tx *buntdb.Tx) error {
-		val, err := tx.Get(id)
+	err := s.engine.Batch(func(batch Batch) error {
+		val, err := batch.Get(id)
 		if err != nil {
-			if err == buntdb.ErrNotFound {
+			if err == ErrKeyNotFound {
 				return ErrVectorNotFound
 			}
 			return fmt.Errorf("failed to get vector: %v", err)
 		}
 
-		err = json.Unmarshal([]byte(val), &vector)
+		var record storedVector
+		err = json.Unmarshal([]byte(val), &record)
 		if err != nil {
 			return fmt.Errorf("failed to unmarshal vector: %v", err)
 		}
 
-		return nil
-	})
-	if err != nil {
-		return err
-	}
-
-	for key, value := range metadata {
-		vector.Metadata[key] = value
-	}
+		if record.Metadata == nil {
+			record.Metadata = make(map[string]string)
+		}
+		for key, value := range metadata {
+			record.Metadata[key] = value
+		}
 
-	data, err := json.Marshal(vector)
-	if err != nil {
-		return fmt.Errorf("failed to marshal vector: %v", err)
-	}
+		data, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to marshal vector: %v", err)
+		}
 
-	err = s.db.Update(func(tx *buntdb.Tx) error {
-		_, _, err := tx.Set(id, string(data), nil)
-		return err
+		err = batch.Set(id, string(data))
+		if err != nil {
+			return fmt.Errorf("failed to update vector: %v", err)
+		}
+		return nil
 	})
 	if err != nil {
-		return fmt.Errorf("failed to update vector: %v", err)
+		return err
 	}
 
 	return nil
@@ -358,10 +755,7 @@ func (s *Storage) InsertObject(object *Object) error {
 		return fmt.Errorf("failed to marshal object: %v", err)
 	}
 
-	err = s.db.Update(func(tx *buntdb.Tx) error {
-		_, _, err := tx.Set(object.ID, string(serializedData), nil)
-		return err
-	})
+	err = s.engine.Set(object.ID, string(serializedData))
 	if err != nil {
 		return fmt.Errorf("failed to insert object: %v", err)
 	}
@@ -373,19 +767,11 @@ func (s *Storage) GetObject(id string) (*Object, error) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
-	var data string
-	err := s.db.View(func(tx *buntdb.Tx) error {
-		val, err := tx.Get(id)
-		if err != nil {
-			if err == buntdb.ErrNotFound {
-				return ErrObjectNotFound
-			}
-			return err
-		}
-		data = val
-		return nil
-	})
+	data, err := s.engine.Get(id)
 	if err != nil {
+		if err == ErrKeyNotFound {
+			return nil, ErrObjectNotFound
+		}
 		return nil, fmt.Errorf("failed to get object: %v", err)
 	}
 
@@ -402,17 +788,11 @@ func (s *Storage) DeleteObject(id string) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	err := s.db.Update(func(tx *buntdb.Tx) error {
-		_, err := tx.Delete(id)
-		if err != nil {
-			if err == buntdb.ErrNotFound {
-				return ErrObjectNotFound
-			}
-			return err
-		}
-		return nil
-	})
+	err := s.engine.Delete(id)
 	if err != nil {
+		if err == ErrKeyNotFound {
+			return ErrObjectNotFound
+		}
 		return fmt.Errorf("failed to delete object: %v", err)
 	}
 
@@ -424,17 +804,17 @@ func (s *Storage) GetAllObjects() ([]*Object, error) {
 	defer s.mutex.RUnlock()
 
 	var objects []*Object
-	err := s.db.View(func(tx *buntdb.Tx) error {
-		err := tx.Ascend("", func(key, value string) bool {
-			var object Object
-			err := json.Unmarshal([]byte(value), &object)
-			if err != nil {
-				return false
-			}
-			objects = append(objects, &object)
+	err := s.engine.Scan("", func(key, value string) bool {
+		if isVectorRecord(value) {
 			return true
-		})
-		return err
+		}
+		var object Object
+		err := json.Unmarshal([]byte(value), &object)
+		if err != nil {
+			return false
+		}
+		objects = append(objects, &object)
+		return true
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to get all objects: %v", err)
@@ -447,42 +827,41 @@ func (s *Storage) UpdateObjectMetadata(id string, metadata map[string]string) er
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	var object Object
-	err := s.db.View(func(tx *buntdb.Tx) error {
-		val, err := tx.Get(id)
+	err := s.engine.Batch(func(batch Batch) error {
+		val, err := batch.Get(id)
 		if err != nil {
-			if err == buntdb.ErrNotFound {
+			if err == ErrKeyNotFound {
 				return ErrObjectNotFound
 			}
 			return fmt.Errorf("failed to get object: %v", err)
 		}
 
+		var object Object
 		err = json.Unmarshal([]byte(val), &object)
 		if err != nil {
 			return fmt.Errorf("failed to unmarshal object: %v", err)
 		}
 
-		return nil
-	})
-	if err != nil {
-		return err
-	}
-
-	for key, value := range metadata {
-		object.Metadata[key] = value
-	}
+		if object.Metadata == nil {
+			object.Metadata = make(map[string]string)
+		}
+		for key, value := range metadata {
+			object.Metadata[key] = value
+		}
 
-	data, err := json.Marshal(object)
-	if err != nil {
-		return fmt.Errorf("failed to marshal object: %v", err)
-	}
+		data, err := json.Marshal(object)
+		if err != nil {
+			return fmt.Errorf("failed to marshal object: %v", err)
+		}
 
-	err = s.db.Update(func(tx *buntdb.Tx) error {
-		_, _, err := tx.Set(id, string(data), nil)
-		return err
+		err = batch.Set(id, string(data))
+		if err != nil {
+			return fmt.Errorf("failed to update object: %v", err)
+		}
+		return nil
 	})
 	if err != nil {
-		return fmt.Errorf("failed to update object: %v", err)
+		return err
 	}
 
 	return nil
@@ -493,56 +872,70 @@ func (s *Storage) GetVectors(ids []string) ([]*Vector, error) {
 	defer s.mutex.RUnlock()
 
 	var results []string
-	err := s.db.View(func(tx *buntdb.Tx) error {
-		for _, id := range ids {
-			val, err := tx.Get(id)
-			if err != nil {
-				if err == buntdb.ErrNotFound {
-					continue
-				}
-				return fmt.Errorf("failed to get vector with ID %s: %v", id, err)
+	for _, id := range ids {
+		val, err := s.engine.Get(id)
+		if err != nil {
+			if err == ErrKeyNotFound {
+				continue
 			}
-			results = append(results, val)
+			return nil, fmt.Errorf("failed to get vector with ID %s: %v", id, err)
 		}
-		return nil
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to get vectors: %v", err)
+		results = append(results, val)
 	}
 
 	vectors := make([]*Vector, 0, len(results))
 	for _, data := range results {
-		var vector Vector
-		err := json.Unmarshal([]byte(data), &vector)
+		vector, err := decodeVector(data)
 		if err != nil {
-			return nil, fmt.Errorf("failed to unmarshal vector: %v", err)
+			return nil, err
 		}
-		vectors = append(vectors, &vector)
+		vectors = append(vectors, vector)
 	}
 
 	return vectors, nil
 }
 
 func (ds *DistributedStorage) GetVectors(ids []string) ([]*Vector, error) {
-	ds.mutex.RLock()
-	defer ds.mutex.RUnlock()
+	return ds.loadVectors(func() ([]*Vector, error) {
+		ds.mutex.RLock()
+		defer ds.mutex.RUnlock()
 
-	var vectors []*Vector
-	for _, id := range ids {
-		nodeIndex := ds.getNodeIndex(id)
-		vector, err := ds.nodes[nodeIndex].GetVector(id)
-		if err != nil {
-			if errors.Is(err, ErrVectorNotFound) {
-				continue
+		var vectors []*Vector
+		for _, id := range ids {
+			nodeIndex := ds.getNodeIndex(id)
+			vector, err := ds.nodes[nodeIndex].GetVector(id)
+			if err != nil {
+				if errors.Is(err, ErrVectorNotFound) {
+					continue
+				}
+				return nil, fmt.Errorf("failed to get vector with ID %s: %v", id, err)
 			}
-			return nil, fmt.Errorf("failed to get vector with ID %s: %v", id, err)
+			vectors = append(vectors, vector)
 		}
-		vectors = append(vectors, vector)
+
+		return vectors, nil
+	})
+}
+
+func (s *Storage) Compact() (int64, error) {
+	compactor, ok := s.engine.(Compactor)
+	if !ok {
+		return 0, nil
 	}
+	return compactor.Compact()
+}
 
-	return vectors, nil
+func (s *Storage) Save(w io.Writer) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	snapshotter, ok := s.engine.(Snapshotter)
+	if !ok {
+		return ErrSnapshotUnsupported
+	}
+	return snapshotter.Save(w)
 }
 
 func (s *Storage) Close() error {
-	return s.db.Close()
+	return s.engine.Close()
 }
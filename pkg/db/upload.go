@@ -0,0 +1,337 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/0xnu/kikiola/pkg/blob"
+)
+
+const (
+	UploadDir      = "uploads"
+	MaxUploadParts = 10000
+
+	// UploadExpiry is how long an upload session may sit without new parts
+	// before the blob sweep aborts it.
+	UploadExpiry = 7 * 24 * time.Hour
+)
+
+var (
+	ErrUploadNotFound   = errors.New("upload not found")
+	ErrUploadIncomplete = errors.New("upload is missing parts")
+	ErrUploadConflict   = errors.New("upload parts changed during completion")
+	ErrInvalidPart      = errors.New("invalid part number")
+)
+
+// Upload is a resumable upload session. Its parts are kept in the blob
+// store and the session is saved under the data directory, so parts
+// survive restarts until the upload is completed or aborted.
+type Upload struct {
+	ID        string             `json:"id"`
+	Object    *Object            `json:"object"`
+	Parts     map[int]*blob.Blob `json:"parts"`
+	CreatedAt time.Time          `json:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+func (u *Upload) PartNumbers() []int {
+	numbers := make([]int, 0, len(u.Parts))
+	for number := range u.Parts {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+func (ds *DistributedStorage) CreateUpload(object *Object) (*Upload, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate upload ID: %v", err)
+	}
+
+	now := time.Now().UTC()
+	upload := &Upload{
+		ID:        hex.EncodeToString(id),
+		Object:    &Object{ID: object.ID, Metadata: object.Metadata, ContentType: object.ContentType},
+		Parts:     make(map[int]*blob.Blob),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	ds.uploadMutex.Lock()
+	defer ds.uploadMutex.Unlock()
+
+	err = ds.saveUpload(upload)
+	if err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (ds *DistributedStorage) GetUpload(id string) (*Upload, error) {
+	ds.uploadMutex.Lock()
+	defer ds.uploadMutex.Unlock()
+
+	return ds.loadUpload(id)
+}
+
+// PutUploadPart streams one part into the blob store, replacing any part
+// previously uploaded under the same number.
+func (ds *DistributedStorage) PutUploadPart(id string, number int, content io.Reader) (*blob.Blob, error) {
+	if number < 1 || number > MaxUploadParts {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidPart, number)
+	}
+
+	_, err := ds.GetUpload(id)
+	if err != nil {
+		return nil, err
+	}
+
+	part, err := ds.StoreContent(content)
+	if err != nil {
+		return nil, err
+	}
+
+	ds.uploadMutex.Lock()
+	defer ds.uploadMutex.Unlock()
+
+	upload, err := ds.loadUpload(id)
+	if err != nil {
+		return nil, err
+	}
+
+	previous := upload.Parts[number]
+	upload.Parts[number] = part
+	upload.UpdatedAt = time.Now().UTC()
+
+	ds.blobs.Ref(part)
+	err = ds.saveUpload(upload)
+	if err != nil {
+		ds.blobs.Release(part)
+		return nil, err
+	}
+
+	if previous != nil {
+		err = ds.blobs.Release(previous)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return part, nil
+}
+
+// CompleteUpload joins the parts in order into the object's content and
+// records the object. Parts must be numbered from 1 without gaps.
+func (ds *DistributedStorage) CompleteUpload(id string) (*Object, error) {
+	upload, err := ds.GetUpload(id)
+	if err != nil {
+		return nil, err
+	}
+
+	numbers := upload.PartNumbers()
+	if len(numbers) == 0 || numbers[len(numbers)-1] != len(numbers) {
+		return nil, fmt.Errorf("%w: have %d parts numbered up to %d", ErrUploadIncomplete, len(numbers), lastPart(numbers))
+	}
+
+	readers := make([]io.Reader, len(numbers))
+	for n, number := range numbers {
+		reader, err := ds.blobs.NewReader(upload.Parts[number])
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		readers[n] = reader
+	}
+	content, err := ds.StoreContent(io.MultiReader(readers...))
+	if err != nil {
+		return nil, err
+	}
+
+	ds.uploadMutex.Lock()
+	defer ds.uploadMutex.Unlock()
+
+	current, err := ds.loadUpload(id)
+	if err != nil {
+		return nil, err
+	}
+	if !sameParts(current, upload) {
+		return nil, ErrUploadConflict
+	}
+
+	object := upload.Object
+	object.Blob = content
+	err = ds.InsertObject(object)
+	if err != nil {
+		return nil, err
+	}
+
+	return object, ds.removeUpload(current)
+}
+
+func (ds *DistributedStorage) AbortUpload(id string) error {
+	ds.uploadMutex.Lock()
+	defer ds.uploadMutex.Unlock()
+
+	upload, err := ds.loadUpload(id)
+	if err != nil {
+		return err
+	}
+	return ds.removeUpload(upload)
+}
+
+func (ds *DistributedStorage) abortExpiredUploads(before time.Time) error {
+	uploads, err := ds.loadUploads()
+	if err != nil {
+		return err
+	}
+
+	ds.uploadMutex.Lock()
+	defer ds.uploadMutex.Unlock()
+
+	for _, upload := range uploads {
+		if !upload.UpdatedAt.Before(before) {
+			continue
+		}
+		current, err := ds.loadUpload(upload.ID)
+		if errors.Is(err, ErrUploadNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !current.UpdatedAt.Before(before) {
+			continue
+		}
+		err = ds.removeUpload(current)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ds *DistributedStorage) removeUpload(upload *Upload) error {
+	err := os.Remove(ds.uploadPath(upload.ID))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove upload: %v", err)
+	}
+
+	for _, part := range upload.Parts {
+		err := ds.blobs.Release(part)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ds *DistributedStorage) uploadPath(id string) string {
+	return filepath.Join(ds.dataDir, UploadDir, id+".json")
+}
+
+func (ds *DistributedStorage) loadUpload(id string) (*Upload, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return nil, ErrUploadNotFound
+	}
+
+	data, err := os.ReadFile(ds.uploadPath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload: %v", err)
+	}
+
+	var upload Upload
+	err = json.Unmarshal(data, &upload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal upload: %v", err)
+	}
+	if upload.Parts == nil {
+		upload.Parts = make(map[int]*blob.Blob)
+	}
+	return &upload, nil
+}
+
+func (ds *DistributedStorage) loadUploads() ([]*Upload, error) {
+	entries, err := os.ReadDir(filepath.Join(ds.dataDir, UploadDir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list uploads: %v", err)
+	}
+
+	var uploads []*Upload
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		if entry.IsDir() || id == entry.Name() {
+			continue
+		}
+		upload, err := ds.GetUpload(id)
+		if errors.Is(err, ErrUploadNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, upload)
+	}
+	return uploads, nil
+}
+
+func (ds *DistributedStorage) saveUpload(upload *Upload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal upload: %v", err)
+	}
+
+	dir := filepath.Join(ds.dataDir, UploadDir)
+	file, err := os.CreateTemp(dir, ".upload-")
+	if err != nil {
+		return fmt.Errorf("failed to save upload: %v", err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), ds.uploadPath(upload.ID))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("failed to save upload: %v", err)
+	}
+	return nil
+}
+
+func sameParts(a, b *Upload) bool {
+	if len(a.Parts) != len(b.Parts) {
+		return false
+	}
+	for number, part := range a.Parts {
+		other, ok := b.Parts[number]
+		if !ok || other.Digest != part.Digest {
+			return false
+		}
+	}
+	return true
+}
+
+func lastPart(numbers []int) int {
+	if len(numbers) == 0 {
+		return 0
+	}
+	return numbers[len(numbers)-1]
+}
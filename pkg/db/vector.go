@@ -1,8 +1,13 @@
 package db
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"math"
+	"strings"
 )
 
 type Vector struct {
@@ -15,7 +20,95 @@ type Vector struct {
 	QuantizationParams *QuantizationParams
 	PruningMask        []bool
 	SparseIndices      []int
-	Relevance          float64 `json:"relevance"`
+	Relevance          float64              `json:"relevance"`
+	Embeddings         [][]float64          `json:",omitempty"`
+	Vectors            map[string][]float64 `json:",omitempty"`
+	ObjectID           string               `json:",omitempty"`
+
+	// detached is set on vectors read from a record that left its
+	// embeddings to the embedding store, until they are loaded.
+	detached *DetachedEmbeddings
+}
+
+func (v *Vector) Validate() error {
+	if v.ID == "" {
+		return errors.New("missing vector ID")
+	}
+	if strings.ContainsAny(v.ID, "\x00\x01") {
+		return errors.New("vector ID must not contain control characters \\x00 or \\x01")
+	}
+	for _, value := range v.Embedding {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return errors.New("embedding contains NaN or infinite values")
+		}
+	}
+	for _, embedding := range v.Embeddings {
+		if len(embedding) == 0 || len(embedding) != len(v.Embeddings[0]) {
+			return errors.New("token embeddings must be non-empty and share the same dimensions")
+		}
+		for _, value := range embedding {
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				return errors.New("token embeddings contain NaN or infinite values")
+			}
+		}
+	}
+	for name, embedding := range v.Vectors {
+		if name == "" || strings.ContainsAny(name, "\x00\x01") {
+			return errors.New("named embeddings need a name without control characters")
+		}
+		if len(embedding) == 0 {
+			return fmt.Errorf("named embedding %s is empty", name)
+		}
+		for _, value := range embedding {
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				return fmt.Errorf("named embedding %s contains NaN or infinite values", name)
+			}
+		}
+	}
+	if len(v.Embeddings) > 0 && v.Compressed {
+		return errors.New("compressed vectors cannot have token embeddings")
+	}
+	if len(v.PruningMask) > 0 && len(v.PruningMask) != len(v.Embedding) {
+		return errors.New("pruning mask length does not match embedding dimensions")
+	}
+	if v.QuantizationParams != nil {
+		if v.QuantizationParams.Max <= v.QuantizationParams.Min {
+			return errors.New("quantization max must be greater than min")
+		}
+		if v.QuantizationParams.Bits <= 0 || v.QuantizationParams.Bits > 32 {
+			return errors.New("quantization bits must be between 1 and 32")
+		}
+	} else if v.Compressed && len(v.Embedding) > 0 && len(v.PruningMask) == 0 && len(v.SparseIndices) == 0 {
+		return errors.New("compressed vector requires quantization params, a pruning mask or sparse indices")
+	}
+	return nil
+}
+
+// Version identifies the content of a vector. The embeddings are folded
+// into a digest, so a record kept without them has the same version.
+func (v *Vector) Version() (string, error) {
+	record, err := detachEmbeddings(v)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal vector: %v", err)
+	}
+	return versionOf(data), nil
+}
+
+func versionOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:16])
+}
+
+func isVectorRecord(value string) bool {
+	var probe struct {
+		Embedding json.RawMessage `json:"Embedding"`
+	}
+	err := json.Unmarshal([]byte(value), &probe)
+	return err == nil && probe.Embedding != nil
 }
 
 func (v Vector) Distance(other Vector) (float64, error) {
@@ -0,0 +1,202 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/0xnu/kikiola/pkg/blob"
+)
+
+const DefaultVersionRetention = 10
+
+var ErrObjectVersionNotFound = errors.New("object version not found")
+
+// ObjectVersion is the content and metadata an object had at one version.
+type ObjectVersion struct {
+	Version     int               `json:"version"`
+	Metadata    map[string]string `json:"metadata"`
+	ContentType string            `json:"content_type,omitempty"`
+	Object      []byte            `json:"object,omitempty"`
+	Blob        *blob.Blob        `json:"blob,omitempty"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+}
+
+func (v *ObjectVersion) AsObject(id string) *Object {
+	return &Object{
+		ID:          id,
+		Object:      v.Object,
+		Metadata:    v.Metadata,
+		ContentType: v.ContentType,
+		Blob:        v.Blob,
+		Version:     v.Version,
+		UpdatedAt:   v.UpdatedAt,
+	}
+}
+
+func (o *Object) version() int {
+	if o.Version == 0 {
+		return 1
+	}
+	return o.Version
+}
+
+func (o *Object) currentVersion() *ObjectVersion {
+	return &ObjectVersion{
+		Version:     o.version(),
+		Metadata:    o.Metadata,
+		ContentType: o.ContentType,
+		Object:      o.Object,
+		Blob:        o.Blob,
+		UpdatedAt:   o.UpdatedAt,
+	}
+}
+
+// Versions returns every retained version of the object, newest first.
+func (o *Object) Versions() []*ObjectVersion {
+	return append([]*ObjectVersion{o.currentVersion()}, o.History...)
+}
+
+func (o *Object) findVersion(version int) (*ObjectVersion, error) {
+	for _, entry := range o.Versions() {
+		if entry.Version == version {
+			return entry, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s version %d", ErrObjectVersionNotFound, o.ID, version)
+}
+
+// SetVersionRetention sets how many earlier versions are kept per object;
+// 0 keeps none.
+func (ds *DistributedStorage) SetVersionRetention(retention int) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	if retention < 0 {
+		retention = 0
+	}
+	ds.versionRetention = retention
+}
+
+func (ds *DistributedStorage) GetObjectVersion(id string, version int) (*ObjectVersion, error) {
+	object, err := ds.GetObject(id)
+	if err != nil {
+		return nil, err
+	}
+	return object.findVersion(version)
+}
+
+// RestoreObjectVersion records the content and metadata of an earlier
+// version as a new version of the object.
+func (ds *DistributedStorage) RestoreObjectVersion(id string, version int) (*Object, error) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	node := ds.nodes[ds.getNodeIndex(id)]
+	previous, err := node.GetObject(id)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := previous.findVersion(version)
+	if err != nil {
+		return nil, err
+	}
+
+	object := &Object{
+		ID:          id,
+		Object:      entry.Object,
+		Metadata:    copyMetadata(entry.Metadata),
+		ContentType: entry.ContentType,
+		Blob:        entry.Blob,
+	}
+	err = ds.replaceObject(node, previous, object)
+	if err != nil {
+		return nil, err
+	}
+	return object, nil
+}
+
+// replaceObject writes object over previous, which may be nil, keeping
+// previous in the history up to the retention count. Blob references move
+// with the versions that hold them. The caller holds the mutex.
+func (ds *DistributedStorage) replaceObject(node *Storage, previous, object *Object) error {
+	var acquired []*blob.Blob
+
+	if object.Blob == nil && len(object.Object) > 0 {
+		stored, err := ds.StoreContent(bytes.NewReader(object.Object))
+		if err != nil {
+			return err
+		}
+		object.Object = nil
+		object.Blob = stored
+	}
+	if object.Blob != nil {
+		ds.blobs.Ref(object.Blob)
+		acquired = append(acquired, object.Blob)
+	}
+
+	object.Version = 1
+	object.History = nil
+	object.UpdatedAt = time.Now().UTC()
+
+	var released []*blob.Blob
+	if previous != nil {
+		object.Version = previous.version() + 1
+
+		entry := previous.currentVersion()
+		if entry.Blob == nil && len(entry.Object) > 0 && ds.versionRetention > 0 {
+			stored, err := ds.StoreContent(bytes.NewReader(entry.Object))
+			if err != nil {
+				ds.releaseAll(acquired)
+				return err
+			}
+			ds.blobs.Ref(stored)
+			acquired = append(acquired, stored)
+			entry.Object = nil
+			entry.Blob = stored
+		}
+
+		history := append([]*ObjectVersion{entry}, previous.History...)
+		if len(history) > ds.versionRetention {
+			for _, dropped := range history[ds.versionRetention:] {
+				if dropped.Blob != nil {
+					released = append(released, dropped.Blob)
+				}
+			}
+			history = history[:ds.versionRetention]
+		}
+		if len(history) > 0 {
+			object.History = history
+		}
+	}
+
+	err := node.InsertObject(object)
+	if err != nil {
+		ds.releaseAll(acquired)
+		return err
+	}
+
+	return ds.releaseAll(released)
+}
+
+func (ds *DistributedStorage) releaseAll(blobs []*blob.Blob) error {
+	for _, released := range blobs {
+		err := ds.blobs.Release(released)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyMetadata(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		copied[key] = value
+	}
+	return copied
+}
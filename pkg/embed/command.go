@@ -0,0 +1,69 @@
+package embed
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Command runs a local model runner, such as an ONNX or gguf wrapper
+// script, once per request. It writes {"input": [...]} to the process's
+// standard input and reads {"embeddings": [[...], ...]} from its standard
+// output.
+type Command struct {
+	path    string
+	args    []string
+	timeout time.Duration
+}
+
+func NewCommand(path string, args []string, timeout time.Duration) *Command {
+	return &Command{path: path, args: args, timeout: timeout}
+}
+
+func (c *Command) Embed(texts []string) ([][]float64, error) {
+	payload := struct {
+		Input []string `json:"input"`
+	}{
+		Input: texts,
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal embedding request: %v", err)
+	}
+
+	ctx := context.Background()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.path, c.args...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("embedding command failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var response struct {
+		Embeddings [][]float64 `json:"embeddings"`
+	}
+	err = json.Unmarshal(stdout.Bytes(), &response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode embedding command output: %v", err)
+	}
+
+	err = checkEmbeddings("embedding command", response.Embeddings, texts)
+	if err != nil {
+		return nil, err
+	}
+	return response.Embeddings, nil
+}
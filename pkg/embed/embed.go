@@ -0,0 +1,50 @@
+package embed
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+const (
+	ProviderOpenAI  = "openai"
+	ProviderCommand = "command"
+	ProviderStub    = "stub"
+)
+
+var (
+	ErrInvalidInput = errors.New("invalid embedding input")
+	ErrProvider     = errors.New("embedding provider failed")
+)
+
+// Provider turns texts into embeddings, returning one embedding per text
+// in the same order.
+type Provider interface {
+	Embed(texts []string) ([][]float64, error)
+}
+
+type ProviderFunc func(texts []string) ([][]float64, error)
+
+func (f ProviderFunc) Embed(texts []string) ([][]float64, error) {
+	return f(texts)
+}
+
+func checkEmbeddings(provider string, embeddings [][]float64, texts []string) error {
+	if len(embeddings) != len(texts) {
+		return fmt.Errorf("%s returned %d embeddings for %d texts", provider, len(embeddings), len(texts))
+	}
+	for n, embedding := range embeddings {
+		if len(embedding) == 0 {
+			return fmt.Errorf("%s returned an empty embedding for text %d", provider, n)
+		}
+		if len(embedding) != len(embeddings[0]) {
+			return fmt.Errorf("%s returned embeddings of different dimensions", provider)
+		}
+		for _, value := range embedding {
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				return fmt.Errorf("%s returned NaN or infinite values", provider)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package embed
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const openAIBatchSize = 256
+
+// OpenAI calls an OpenAI-compatible embeddings endpoint. Local runners
+// such as llama.cpp's server or text-embeddings-inference expose the same
+// API, so they are configured the same way.
+type OpenAI struct {
+	url    string
+	model  string
+	apiKey string
+	client *http.Client
+}
+
+func NewOpenAI(url, model, apiKey string, timeout time.Duration) *OpenAI {
+	return &OpenAI{url: url, model: model, apiKey: apiKey, client: &http.Client{Timeout: timeout}}
+}
+
+func (o *OpenAI) Embed(texts []string) ([][]float64, error) {
+	embeddings := make([][]float64, 0, len(texts))
+	for start := 0; start < len(texts); start += openAIBatchSize {
+		end := start + openAIBatchSize
+		if end > len(texts) {
+			end = len(texts)
+		}
+		batch, err := o.embedBatch(texts[start:end])
+		if err != nil {
+			return nil, err
+		}
+		embeddings = append(embeddings, batch...)
+	}
+
+	err := checkEmbeddings("embedding provider", embeddings, texts)
+	if err != nil {
+		return nil, err
+	}
+	return embeddings, nil
+}
+
+func (o *OpenAI) embedBatch(texts []string) ([][]float64, error) {
+	payload := struct {
+		Model string   `json:"model,omitempty"`
+		Input []string `json:"input"`
+	}{
+		Model: o.model,
+		Input: texts,
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal embedding request: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, o.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create embedding request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if o.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+o.apiKey)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call embedding provider: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("embedding provider returned status %d", resp.StatusCode)
+	}
+
+	var response struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode embedding response: %v", err)
+	}
+	if len(response.Data) != len(texts) {
+		return nil, fmt.Errorf("embedding provider returned %d embeddings for %d texts", len(response.Data), len(texts))
+	}
+
+	embeddings := make([][]float64, len(texts))
+	for _, item := range response.Data {
+		if item.Index < 0 || item.Index >= len(texts) || embeddings[item.Index] != nil {
+			return nil, fmt.Errorf("embedding provider returned an invalid index %d", item.Index)
+		}
+		embeddings[item.Index] = item.Embedding
+	}
+	return embeddings, nil
+}
@@ -0,0 +1,63 @@
+package embed
+
+import (
+	"hash/fnv"
+	"math"
+	"strings"
+	"unicode"
+)
+
+const DefaultStubDimensions = 64
+
+// Stub hashes the words of each text into a fixed number of dimensions.
+// It needs no model, so tests and local development can run without one;
+// texts sharing words come out similar, but it captures no meaning.
+type Stub struct {
+	dimensions int
+}
+
+func NewStub(dimensions int) *Stub {
+	if dimensions <= 0 {
+		dimensions = DefaultStubDimensions
+	}
+	return &Stub{dimensions: dimensions}
+}
+
+func (s *Stub) Embed(texts []string) ([][]float64, error) {
+	embeddings := make([][]float64, len(texts))
+	for n, text := range texts {
+		embeddings[n] = s.embed(text)
+	}
+	return embeddings, nil
+}
+
+func (s *Stub) embed(text string) []float64 {
+	embedding := make([]float64, s.dimensions)
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for _, word := range words {
+		hash := fnv.New64a()
+		hash.Write([]byte(word))
+		sum := hash.Sum64()
+		if sum&(1<<63) != 0 {
+			embedding[sum%uint64(s.dimensions)]--
+		} else {
+			embedding[sum%uint64(s.dimensions)]++
+		}
+	}
+
+	var norm float64
+	for _, value := range embedding {
+		norm += value * value
+	}
+	if norm == 0 {
+		embedding[0] = 1
+		return embedding
+	}
+	norm = math.Sqrt(norm)
+	for i := range embedding {
+		embedding[i] /= norm
+	}
+	return embedding
+}
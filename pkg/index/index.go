@@ -3,48 +3,182 @@ package index
 import (
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"math"
+	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/0xnu/kikiola/pkg/db"
+	"github.com/0xnu/kikiola/pkg/segment"
 	"github.com/agnivade/levenshtein"
 )
 
+const SegmentDir = "segments"
+
 type Index struct {
-	storage *db.DistributedStorage
-	index   map[string][]*db.Vector
-	mutex   sync.RWMutex
+	storage  *db.DistributedStorage
+	segments *segment.Store
+	index    map[string][]segment.Ref
+	fields   map[string][]string
+	objects  map[string]string
+	linked   map[string]map[string]bool
+	merging  int32
+	merges   sync.WaitGroup
+	mutex    sync.RWMutex
+
+	// embeddings is held for writing while a write changes a vector record
+	// and its segment records, so readers loading embeddings from the
+	// segments see both or neither.
+	embeddings sync.RWMutex
+}
+
+type CompactionResult struct {
+	SegmentsMerged int
+	RecordsPurged  int
+	BytesReclaimed int64
+	BucketsRemoved int
 }
 
 func NewIndex(storage *db.DistributedStorage) (*Index, error) {
+	segments, err := segment.Open(filepath.Join(storage.DataDir(), SegmentDir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open vector segments: %v", err)
+	}
+
 	index := &Index{
-		storage: storage,
-		index:   make(map[string][]*db.Vector),
+		storage:  storage,
+		segments: segments,
+		index:    make(map[string][]segment.Ref),
+		fields:   make(map[string][]string),
+		objects:  make(map[string]string),
+		linked:   make(map[string]map[string]bool),
 	}
-	err := index.buildIndex()
+	storage.SetEmbeddingStore(index)
+	err = index.buildIndex()
 	if err != nil {
+		storage.SetEmbeddingStore(nil)
+		segments.Close()
 		return nil, err
 	}
 	return index, nil
 }
 
 func (i *Index) Insert(vector *db.Vector) error {
+	_, err := i.Put(vector, db.WriteUpsert, "")
+	return err
+}
+
+func (i *Index) Put(vector *db.Vector, mode db.WriteMode, ifMatch string) (bool, error) {
 	i.mutex.Lock()
 	defer i.mutex.Unlock()
 
-	err := i.storage.InsertVector(vector)
+	err := i.checkObject(vector)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	for _, value := range vector.Embedding {
-		key := i.getKey(value)
-		i.index[key] = append(i.index[key], vector)
+	previous, err := i.previousVector(vector.ID)
+	if err != nil {
+		return false, err
 	}
 
-	return nil
+	i.embeddings.Lock()
+	defer i.embeddings.Unlock()
+
+	created, err := i.storage.PutVector(vector, mode, ifMatch)
+	if err != nil {
+		return false, err
+	}
+
+	err = i.putInSegments(vector)
+	if err != nil {
+		i.rollback(vector.ID, previous)
+		return false, err
+	}
+
+	if !created {
+		i.scheduleMerge()
+	}
+
+	return created, nil
+}
+
+func (i *Index) WriteVectors(vectors []*db.Vector, mode db.WriteMode) []error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	results := make([]error, len(vectors))
+	var linked, previous []*db.Vector
+	var positions []int
+	for n, vector := range vectors {
+		results[n] = i.checkObject(vector)
+		var old *db.Vector
+		if results[n] == nil {
+			old, results[n] = i.previousVector(vector.ID)
+		}
+		if results[n] == nil {
+			linked = append(linked, vector)
+			previous = append(previous, old)
+			positions = append(positions, n)
+		}
+	}
+
+	i.embeddings.Lock()
+	defer i.embeddings.Unlock()
+
+	for n, err := range i.storage.WriteVectors(linked, mode) {
+		if err == nil {
+			err = i.putInSegments(linked[n])
+			if err != nil {
+				i.rollback(linked[n].ID, previous[n])
+			}
+		}
+		results[positions[n]] = err
+	}
+
+	i.scheduleMerge()
+
+	return results
+}
+
+func (i *Index) DeleteVectors(ids []string) []error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	previous, err := i.storage.GetVectors(ids)
+	if err != nil {
+		results := make([]error, len(ids))
+		for n := range results {
+			results[n] = err
+		}
+		return results
+	}
+	byID := make(map[string]*db.Vector, len(previous))
+	for _, vector := range previous {
+		byID[vector.ID] = vector
+	}
+
+	i.embeddings.Lock()
+	defer i.embeddings.Unlock()
+
+	results := i.storage.DeleteVectors(ids)
+	for n, id := range ids {
+		if results[n] != nil {
+			continue
+		}
+		results[n] = i.removeFromSegments(id)
+		if results[n] != nil {
+			i.rollback(id, byID[id])
+		}
+	}
+
+	i.scheduleMerge()
+
+	return results
 }
 
 func (i *Index) Delete(id string) error {
@@ -56,102 +190,421 @@ func (i *Index) Delete(id string) error {
 		return err
 	}
 
-	for _, value := range vector.Embedding {
-		key := i.getKey(value)
-		i.index[key] = removeVector(i.index[key], vector)
-	}
+	i.embeddings.Lock()
+	defer i.embeddings.Unlock()
 
 	err = i.storage.DeleteVector(id)
 	if err != nil {
 		return err
 	}
 
+	err = i.removeFromSegments(id)
+	if err != nil {
+		i.rollback(id, vector)
+		return err
+	}
+
+	i.scheduleMerge()
+
 	return nil
 }
 
-func (i *Index) Search(vector *db.Vector, k int) ([]*db.Vector, error) {
-	i.mutex.RLock()
-	defer i.mutex.RUnlock()
+// previousVector returns the stored vector a write would replace, or nil
+// if there is none.
+func (i *Index) previousVector(id string) (*db.Vector, error) {
+	vector, err := i.storage.GetVector(id)
+	if errors.Is(err, db.ErrVectorNotFound) {
+		return nil, nil
+	}
+	return vector, err
+}
 
-	if k <= 0 {
-		return nil, errors.New("invalid value of k")
+// rollback undoes a storage write whose segment update failed, restoring
+// the previous vector in storage and segments, or removing the vector if
+// there was none, so storage and the index agree again.
+func (i *Index) rollback(id string, previous *db.Vector) {
+	var err error
+	if previous == nil {
+		err = i.storage.DeleteVector(id)
+		if err == nil || errors.Is(err, db.ErrVectorNotFound) {
+			err = i.removeFromSegments(id)
+		}
+	} else {
+		_, err = i.storage.PutVector(previous, db.WriteUpsert, "")
+		if err == nil {
+			err = i.putInSegments(previous)
+		}
 	}
+	if err != nil {
+		log.Printf("Error rolling back vector %s: %v", id, err)
+	}
+}
 
-	var candidates []*db.Vector
-	for _, value := range vector.Embedding {
-		key := i.getKey(value)
-		candidates = append(candidates, i.index[key]...)
+func (i *Index) putInSegments(vector *db.Vector) error {
+	err := i.removeFromSegments(vector.ID)
+	if err != nil {
+		return err
 	}
 
-	sort.Slice(candidates, func(i, j int) bool {
-		simI, _ := cosineSimilarity(*vector, *candidates[i])
-		simJ, _ := cosineSimilarity(*vector, *candidates[j])
-		return simI > simJ
-	})
+	if len(vector.Embedding) > 0 {
+		ref, err := i.segments.Put(segment.RecordFromVector(vector.ID, vector))
+		if err != nil {
+			return fmt.Errorf("failed to append vector to segment: %v", err)
+		}
+		i.addPostings("", vector.Embedding, ref)
+	}
+
+	for n, embedding := range vector.Embeddings {
+		ref, err := i.segments.Put(segment.Record{Key: tokenKey(vector.ID, n), Embedding: embedding})
+		if err != nil {
+			return fmt.Errorf("failed to append token embedding to segment: %v", err)
+		}
+		i.addPostings("", embedding, ref)
+	}
 
-	uniqueCandidates := make([]*db.Vector, 0, len(candidates))
-	seenIDs := make(map[string]bool)
+	// The names are recorded first so that a failed write can still
+	// remove the named embeddings written before it.
+	if len(vector.Vectors) > 0 {
+		i.fields[vector.ID] = sortedNames(vector.Vectors)
+	}
+	for _, name := range sortedNames(vector.Vectors) {
+		ref, err := i.segments.Put(segment.Record{Key: namedKey(vector.ID, name), Embedding: vector.Vectors[name]})
+		if err != nil {
+			return fmt.Errorf("failed to append named embedding to segment: %v", err)
+		}
+		i.addPostings(name, vector.Vectors[name], ref)
+	}
+	i.link(vector)
+
+	return nil
+}
 
-	for _, candidate := range candidates {
-		if !seenIDs[candidate.ID] {
-			uniqueCandidates = append(uniqueCandidates, candidate)
-			seenIDs[candidate.ID] = true
+func (i *Index) removeFromSegments(id string) error {
+	for _, key := range i.segmentKeys(id) {
+		err := i.removePostings(key)
+		if err != nil {
+			return err
+		}
+		err = i.segments.Delete(key)
+		if err != nil {
+			return err
 		}
 	}
+	delete(i.fields, id)
+	i.unlink(id)
+	return nil
+}
 
-	if len(uniqueCandidates) > k {
-		uniqueCandidates = uniqueCandidates[:k]
+func (i *Index) removePostings(key string) error {
+	ref, ok := i.segments.Lookup(key)
+	if !ok {
+		return nil
 	}
 
-	results, err := i.storage.GetVectors(getIDs(uniqueCandidates))
+	record, err := i.segments.Get(ref)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get vectors: %v", err)
+		return fmt.Errorf("failed to read vector segment: %v", err)
+	}
+	field := fieldOf(key)
+	for _, value := range record.Embedding {
+		bucket := i.bucketKey(field, value)
+		i.index[bucket] = removeRef(i.index[bucket], ref)
 	}
 
-	Rerank(results, vector.Text)
+	return nil
+}
+
+func (i *Index) MergeSegments() (*segment.MergeResult, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	return i.mergeSegments()
+}
 
-	if len(results) > k {
-		results = results[:k]
+func (i *Index) Compact() (*CompactionResult, error) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	merge, err := i.mergeSegments()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &CompactionResult{
+		SegmentsMerged: len(merge.Segments),
+		RecordsPurged:  merge.RecordsPurged,
+		BytesReclaimed: merge.BytesReclaimed,
+	}
+
+	for key, refs := range i.index {
+		if len(refs) == 0 {
+			delete(i.index, key)
+			result.BucketsRemoved++
+			continue
+		}
+		if cap(refs) > len(refs) {
+			compacted := make([]segment.Ref, len(refs))
+			copy(compacted, refs)
+			i.index[key] = compacted
+		}
+	}
+
+	return result, nil
+}
+
+func (i *Index) mergeSegments() (*segment.MergeResult, error) {
+	i.embeddings.Lock()
+	defer i.embeddings.Unlock()
+
+	result, err := i.segments.Merge()
+	if err != nil {
+		return nil, fmt.Errorf("failed to merge segments: %v", err)
+	}
+
+	merged := make(map[uint32]bool, len(result.Segments))
+	for _, id := range result.Segments {
+		merged[id] = true
+	}
+	if len(merged) == 0 {
+		return result, nil
+	}
+
+	for key, refs := range i.index {
+		kept := refs[:0]
+		for _, ref := range refs {
+			if !merged[ref.Segment] {
+				kept = append(kept, ref)
+			} else if newRef, ok := result.Remap[ref]; ok {
+				kept = append(kept, newRef)
+			}
+		}
+		if len(kept) == 0 {
+			delete(i.index, key)
+		} else {
+			i.index[key] = kept
+		}
+	}
+
+	return result, nil
+}
+
+func (i *Index) scheduleMerge() {
+	if !i.segments.NeedsMerge() || !atomic.CompareAndSwapInt32(&i.merging, 0, 1) {
+		return
+	}
+
+	i.merges.Add(1)
+	go func() {
+		defer i.merges.Done()
+		defer atomic.StoreInt32(&i.merging, 0)
+		_, err := i.MergeSegments()
+		if err != nil {
+			log.Printf("Error merging vector segments: %v", err)
+		}
+	}()
+}
+
+// Close waits for a background merge to finish before closing the
+// segments it would otherwise write to.
+func (i *Index) Close() error {
+	i.merges.Wait()
+	i.storage.SetEmbeddingStore(nil)
+	return i.segments.Close()
+}
+
+// ViewEmbeddings calls fn while no write can change vector records and
+// their segment records.
+func (i *Index) ViewEmbeddings(fn func() error) error {
+	i.embeddings.RLock()
+	defer i.embeddings.RUnlock()
+
+	return fn()
+}
+
+// LoadEmbeddings reads the embeddings a vector record left to the
+// segments.
+func (i *Index) LoadEmbeddings(vector *db.Vector, detached *db.DetachedEmbeddings) error {
+	embedding, err := i.loadEmbedding(vector.ID)
+	if err != nil && !errors.Is(err, segment.ErrNotFound) {
+		return err
+	}
+	vector.Embedding = embedding
+
+	if detached.Tokens > 0 {
+		vector.Embeddings = make([][]float64, detached.Tokens)
+	}
+	for n := range vector.Embeddings {
+		vector.Embeddings[n], err = i.loadEmbedding(tokenKey(vector.ID, n))
+		if err != nil {
+			return fmt.Errorf("token embedding %d: %v", n, err)
+		}
+	}
+
+	if len(detached.Fields) > 0 {
+		vector.Vectors = make(map[string][]float64, len(detached.Fields))
+	}
+	for _, name := range detached.Fields {
+		vector.Vectors[name], err = i.loadEmbedding(namedKey(vector.ID, name))
+		if err != nil {
+			return fmt.Errorf("named embedding %s: %v", name, err)
+		}
 	}
 
-	return results, nil
+	return nil
 }
 
-func getIDs(vectors []*db.Vector) []string {
-	ids := make([]string, len(vectors))
-	for i, vector := range vectors {
-		ids[i] = vector.ID
+func (i *Index) loadEmbedding(key string) ([]float64, error) {
+	ref, ok := i.segments.Lookup(key)
+	if !ok {
+		return nil, segment.ErrNotFound
+	}
+	record, err := i.segments.Get(ref)
+	if err != nil {
+		return nil, err
 	}
-	return ids
+	return record.Embedding, nil
 }
 
+// Snapshot writes every node database and a copy of the vector segments
+// through the writers the open functions return, while no write can change
+// them, and pins the blob chunks, which it returns for the caller to
+// unpin.
+func (i *Index) Snapshot(openNode func(address string) (io.WriteCloser, error), openSegment func(name string) (io.WriteCloser, error)) ([]string, error) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	chunks, err := i.storage.Snapshot(openNode)
+	if err != nil {
+		return nil, err
+	}
+
+	err = i.segments.Save(openSegment)
+	if err != nil {
+		i.storage.Blobs().Unpin(chunks)
+		return nil, fmt.Errorf("failed to snapshot vector segments: %v", err)
+	}
+	return chunks, nil
+}
+
+// buildIndex loads the postings from the segments, which hold every
+// embedding. Records written before the segments held the embeddings are
+// copied into them and rewritten without the embeddings, and segment
+// records no vector record refers to are removed.
 func (i *Index) buildIndex() error {
-	vectors, err := i.storage.GetAllVectors()
+	stored := make(map[string]bool)
+	err := i.storage.EachVectorRecord(func(vector *db.Vector, detached *db.DetachedEmbeddings) error {
+		i.link(vector)
+
+		if detached != nil {
+			stored[vector.ID] = true
+			for n := 0; n < detached.Tokens; n++ {
+				stored[tokenKey(vector.ID, n)] = true
+			}
+			for _, name := range detached.Fields {
+				stored[namedKey(vector.ID, name)] = true
+			}
+			return nil
+		}
+
+		records := make([]segment.Record, 0, len(vector.Embeddings)+1)
+		if len(vector.Embedding) > 0 {
+			records = append(records, segment.RecordFromVector(vector.ID, vector))
+		}
+		for n, embedding := range vector.Embeddings {
+			records = append(records, segment.Record{Key: tokenKey(vector.ID, n), Embedding: embedding})
+		}
+		for name, embedding := range vector.Vectors {
+			records = append(records, segment.Record{Key: namedKey(vector.ID, name), Embedding: embedding})
+		}
+
+		for _, record := range records {
+			stored[record.Key] = true
+
+			if ref, ok := i.segments.Lookup(record.Key); ok {
+				existing, err := i.segments.Get(ref)
+				if err == nil && sameRecord(existing, record.Vector(record.Key)) {
+					continue
+				}
+			}
+
+			_, err := i.segments.Put(record)
+			if err != nil {
+				return fmt.Errorf("failed to append vector to segment: %v", err)
+			}
+		}
+
+		_, err := i.storage.PutVector(vector, db.WriteUpsert, "")
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
-	for _, vector := range vectors {
-		for _, value := range vector.Embedding {
-			key := i.getKey(value)
-			i.index[key] = append(i.index[key], vector)
+	for _, key := range i.segments.Keys() {
+		if !stored[key] {
+			err := i.segments.Delete(key)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
-	return nil
+	var buildErr error
+	i.segments.Each(func(key string, ref segment.Ref) bool {
+		record, err := i.segments.Get(ref)
+		if err != nil {
+			buildErr = fmt.Errorf("failed to read vector segment: %v", err)
+			return false
+		}
+		field := fieldOf(key)
+		i.addPostings(field, record.Embedding, ref)
+		if field != "" {
+			id := recordID(key)
+			i.fields[id] = append(i.fields[id], field)
+		}
+		return true
+	})
+
+	return buildErr
+}
+
+func (i *Index) addPostings(field string, embedding []float64, ref segment.Ref) {
+	for _, value := range embedding {
+		key := i.bucketKey(field, value)
+		i.index[key] = append(i.index[key], ref)
+	}
+}
+
+func sameRecord(record segment.Record, vector *db.Vector) bool {
+	if record.Compressed != vector.Compressed || len(record.Embedding) != len(vector.Embedding) {
+		return false
+	}
+	if (record.QuantizationParams == nil) != (vector.QuantizationParams == nil) {
+		return false
+	}
+	if record.QuantizationParams != nil && *record.QuantizationParams != *vector.QuantizationParams {
+		return false
+	}
+	for n := range record.Embedding {
+		if record.Embedding[n] != vector.Embedding[n] {
+			return false
+		}
+	}
+	return true
 }
 
 func (i *Index) getKey(value float64) string {
 	return fmt.Sprintf("%.2f", value)
 }
 
-func removeVector(vectors []*db.Vector, vector *db.Vector) []*db.Vector {
-	for i, v := range vectors {
-		if v.ID == vector.ID {
-			return append(vectors[:i], vectors[i+1:]...)
+func removeRef(refs []segment.Ref, ref segment.Ref) []segment.Ref {
+	kept := refs[:0]
+	for _, r := range refs {
+		if r != ref {
+			kept = append(kept, r)
 		}
 	}
-	return vectors
+	return kept
 }
 
 func cosineSimilarity(v1, v2 db.Vector) (float64, error) {
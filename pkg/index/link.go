@@ -0,0 +1,128 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+
+	"github.com/0xnu/kikiola/pkg/db"
+)
+
+// LinkedObject describes the object a hit is linked to. The content is not
+// included; clients fetch it from ContentURL.
+type LinkedObject struct {
+	ID          string            `json:"id"`
+	Metadata    map[string]string `json:"metadata"`
+	ContentType string            `json:"content_type,omitempty"`
+	Version     int               `json:"version,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	Size        int64             `json:"size"`
+	ContentURL  string            `json:"content_url"`
+}
+
+func (i *Index) link(vector *db.Vector) {
+	if vector.ObjectID == "" {
+		return
+	}
+	i.objects[vector.ID] = vector.ObjectID
+	if i.linked[vector.ObjectID] == nil {
+		i.linked[vector.ObjectID] = make(map[string]bool)
+	}
+	i.linked[vector.ObjectID][vector.ID] = true
+}
+
+func (i *Index) unlink(id string) {
+	objectID, ok := i.objects[id]
+	if !ok {
+		return
+	}
+	delete(i.objects, id)
+	delete(i.linked[objectID], id)
+	if len(i.linked[objectID]) == 0 {
+		delete(i.linked, objectID)
+	}
+}
+
+func (i *Index) checkObject(vector *db.Vector) error {
+	if vector.ObjectID == "" {
+		return nil
+	}
+	_, err := i.storage.GetObject(vector.ObjectID)
+	if errors.Is(err, db.ErrObjectNotFound) {
+		return fmt.Errorf("linked %w: %s", db.ErrObjectNotFound, vector.ObjectID)
+	}
+	return err
+}
+
+func (i *Index) LinkedVectors(objectID string) []string {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	return i.linkedVectors(objectID)
+}
+
+func (i *Index) linkedVectors(objectID string) []string {
+	ids := make([]string, 0, len(i.linked[objectID]))
+	for id := range i.linked[objectID] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// DeleteObject removes an object together with every vector linked to it.
+func (i *Index) DeleteObject(id string) error {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	err := i.storage.DeleteObject(id)
+	if err != nil {
+		return err
+	}
+
+	ids := i.linkedVectors(id)
+	for n, err := range i.storage.DeleteVectors(ids) {
+		if err != nil && !errors.Is(err, db.ErrVectorNotFound) {
+			return fmt.Errorf("failed to delete linked vector %s: %v", ids[n], err)
+		}
+		err = i.removeFromSegments(ids[n])
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(ids) > 0 {
+		i.scheduleMerge()
+	}
+
+	return nil
+}
+
+func (i *Index) attachObject(result *Result) error {
+	if result.ObjectID == "" {
+		return nil
+	}
+	object, err := i.storage.GetObject(result.ObjectID)
+	if errors.Is(err, db.ErrObjectNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to retrieve linked object: %v", err)
+	}
+
+	linked := &LinkedObject{
+		ID:          object.ID,
+		Metadata:    object.Metadata,
+		ContentType: object.ContentType,
+		Version:     object.Version,
+		Size:        int64(len(object.Object)),
+		ContentURL:  "/objects/" + url.PathEscape(object.ID) + "/content",
+	}
+	if object.Blob != nil {
+		linked.Digest = object.Blob.Digest
+		linked.Size = object.Blob.Size
+	}
+	result.LinkedObject = linked
+	return nil
+}
@@ -0,0 +1,165 @@
+package index
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/0xnu/kikiola/pkg/db"
+)
+
+const (
+	tokenSeparator = "\x00"
+	fieldSeparator = "\x01"
+)
+
+func tokenKey(id string, n int) string {
+	return fmt.Sprintf("%s%s%d", id, tokenSeparator, n)
+}
+
+func namedKey(id, name string) string {
+	return id + fieldSeparator + name
+}
+
+func recordID(key string) string {
+	if n := strings.IndexAny(key, tokenSeparator+fieldSeparator); n >= 0 {
+		return key[:n]
+	}
+	return key
+}
+
+func fieldOf(key string) string {
+	if n := strings.Index(key, fieldSeparator); n >= 0 {
+		return key[n+1:]
+	}
+	return ""
+}
+
+func (i *Index) bucketKey(field string, value float64) string {
+	if field == "" {
+		return i.getKey(value)
+	}
+	return field + fieldSeparator + i.getKey(value)
+}
+
+func sortedNames(vectors map[string][]float64) []string {
+	names := make([]string, 0, len(vectors))
+	for name := range vectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (i *Index) segmentKeys(id string) []string {
+	var keys []string
+	if _, ok := i.segments.Lookup(id); ok {
+		keys = append(keys, id)
+	}
+	for n := 0; ; n++ {
+		key := tokenKey(id, n)
+		if _, ok := i.segments.Lookup(key); !ok {
+			break
+		}
+		keys = append(keys, key)
+	}
+	for _, name := range i.fields[id] {
+		if _, ok := i.segments.Lookup(namedKey(id, name)); ok {
+			keys = append(keys, namedKey(id, name))
+		}
+	}
+	return keys
+}
+
+func (i *Index) documentEmbeddings(id string) ([]*db.Vector, error) {
+	var embeddings []*db.Vector
+	for n := 0; ; n++ {
+		ref, ok := i.segments.Lookup(tokenKey(id, n))
+		if !ok {
+			break
+		}
+		record, err := i.segments.Get(ref)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read vector segment: %v", err)
+		}
+		embeddings = append(embeddings, record.Vector(id))
+	}
+	if len(embeddings) > 0 {
+		return embeddings, nil
+	}
+
+	ref, ok := i.segments.Lookup(id)
+	if !ok {
+		return nil, nil
+	}
+	record, err := i.segments.Get(ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vector segment: %v", err)
+	}
+	return []*db.Vector{record.Vector(id)}, nil
+}
+
+func queryTokens(vector *db.Vector) []*db.Vector {
+	tokens := make([]*db.Vector, len(vector.Embeddings))
+	for n, embedding := range vector.Embeddings {
+		tokens[n] = &db.Vector{Embedding: embedding}
+	}
+	return tokens
+}
+
+func maxSim(query, document []*db.Vector) float64 {
+	if len(query) == 0 || len(document) == 0 {
+		return 0
+	}
+
+	total := 0.0
+	for _, q := range query {
+		best := -1.0
+		for _, d := range document {
+			similarity, err := cosineSimilarity(*q, *d)
+			if err == nil && similarity > best {
+				best = similarity
+			}
+		}
+		total += best
+	}
+	return total / float64(len(query))
+}
+
+func (i *Index) collectDocumentCandidates(vector *db.Vector, all bool) ([]*candidate, error) {
+	tokens := queryTokens(vector)
+
+	ids := make(map[string]bool)
+	if all {
+		for _, key := range i.segments.Keys() {
+			ids[recordID(key)] = true
+		}
+	} else {
+		for _, token := range tokens {
+			for _, value := range token.Embedding {
+				for _, ref := range i.index[i.getKey(value)] {
+					record, err := i.segments.Get(ref)
+					if err != nil {
+						return nil, fmt.Errorf("failed to read vector segment: %v", err)
+					}
+					ids[recordID(record.Key)] = true
+				}
+			}
+		}
+	}
+
+	candidates := make([]*candidate, 0, len(ids))
+	for id := range ids {
+		embeddings, err := i.documentEmbeddings(id)
+		if err != nil {
+			return nil, err
+		}
+		if len(embeddings) == 0 {
+			continue
+		}
+		score := maxSim(tokens, embeddings)
+		candidates = append(candidates, &candidate{id: id, score: score, distance: 1 - score})
+	}
+
+	return candidates, nil
+}
@@ -0,0 +1,58 @@
+package index
+
+import (
+	"fmt"
+
+	"github.com/0xnu/kikiola/pkg/db"
+)
+
+func fieldQuery(vector *db.Vector, field string) (*db.Vector, error) {
+	if field == "" {
+		return vector, nil
+	}
+
+	embedding, ok := vector.Vectors[field]
+	if !ok {
+		embedding = vector.Embedding
+	}
+	if len(embedding) == 0 {
+		return nil, fmt.Errorf("query has no embedding for field %s", field)
+	}
+	return &db.Vector{Embedding: embedding}, nil
+}
+
+func (i *Index) fuseCandidates(vector *db.Vector, fields map[string]float64, all bool) ([]*candidate, error) {
+	fused := make(map[string]float64)
+	for field, weight := range fields {
+		fieldVector, err := fieldQuery(vector, field)
+		if err != nil {
+			return nil, err
+		}
+
+		var candidates []*candidate
+		if all {
+			candidates, err = i.scanCandidates(fieldVector, field, cosineScore, func(*candidate) bool { return true })
+		} else {
+			candidates, err = i.collectCandidates(fieldVector, field, cosineScore)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		best := make(map[string]float64)
+		for _, candidate := range candidates {
+			if score, ok := best[candidate.id]; !ok || candidate.score > score {
+				best[candidate.id] = candidate.score
+			}
+		}
+		for id, score := range best {
+			fused[id] += weight * score
+		}
+	}
+
+	candidates := make([]*candidate, 0, len(fused))
+	for id, score := range fused {
+		candidates = append(candidates, &candidate{id: id, score: score, distance: 1 - score})
+	}
+	return candidates, nil
+}
@@ -0,0 +1,412 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/0xnu/kikiola/pkg/db"
+)
+
+const (
+	RerankerNone     = "none"
+	RerankerText     = "text"
+	RerankerBM25     = "bm25"
+	RerankerMMR      = "mmr"
+	RerankerMetadata = "metadata"
+	RerankerCross    = "cross-encoder"
+)
+
+type Reranker interface {
+	Rerank(request *RerankRequest) ([]*Result, error)
+}
+
+type RerankFunc func(request *RerankRequest) ([]*Result, error)
+
+func (f RerankFunc) Rerank(request *RerankRequest) ([]*Result, error) {
+	return f(request)
+}
+
+// RerankRequest carries the hits of a query to a reranker. Field and
+// Fields are the named embeddings the query scored the hits by.
+type RerankRequest struct {
+	Query   *db.Vector
+	Field   string
+	Fields  map[string]float64
+	Results []*Result
+	Params  json.RawMessage
+}
+
+var ErrInvalidRerank = errors.New("invalid rerank request")
+
+var (
+	rerankers     = make(map[string]Reranker)
+	rerankerMutex sync.RWMutex
+)
+
+func init() {
+	RegisterReranker(RerankerText, RerankFunc(rerankText))
+	RegisterReranker(RerankerBM25, RerankFunc(rerankBM25))
+	RegisterReranker(RerankerMMR, RerankFunc(rerankMMR))
+	RegisterReranker(RerankerMetadata, RerankFunc(rerankMetadata))
+}
+
+func RegisterReranker(name string, reranker Reranker) {
+	rerankerMutex.Lock()
+	defer rerankerMutex.Unlock()
+
+	rerankers[name] = reranker
+}
+
+func LookupReranker(name string) (Reranker, bool) {
+	rerankerMutex.RLock()
+	defer rerankerMutex.RUnlock()
+
+	reranker, ok := rerankers[name]
+	return reranker, ok
+}
+
+func Rerankers() []string {
+	rerankerMutex.RLock()
+	defer rerankerMutex.RUnlock()
+
+	names := make([]string, 0, len(rerankers))
+	for name := range rerankers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func setRerankScore(result *Result, score float64) {
+	result.RerankScore = &score
+	result.FinalScore = score
+}
+
+func sortByFinalScore(results []*Result) {
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].FinalScore > results[j].FinalScore
+	})
+}
+
+func rerankText(request *RerankRequest) ([]*Result, error) {
+	for _, result := range request.Results {
+		relevance := calculateRelevanceScore(result.Vector, request.Query.Text)
+		result.Relevance = relevance
+		setRerankScore(result, relevance)
+	}
+	sortByFinalScore(request.Results)
+	return request.Results, nil
+}
+
+func rerankBM25(request *RerankRequest) ([]*Result, error) {
+	params := struct {
+		K1 float64 `json:"k1"`
+		B  float64 `json:"b"`
+	}{K1: 1.2, B: 0.75}
+	err := decodeParams(request.Params, &params)
+	if err != nil {
+		return nil, err
+	}
+
+	terms := tokenize(request.Query.Text)
+	if len(terms) == 0 {
+		return nil, fmt.Errorf("%w: bm25 reranking requires query text", ErrInvalidRerank)
+	}
+
+	documents := make([][]string, len(request.Results))
+	frequencies := make(map[string]int)
+	totalLength := 0
+	for n, result := range request.Results {
+		documents[n] = tokenize(documentText(result.Vector))
+		totalLength += len(documents[n])
+		seen := make(map[string]bool)
+		for _, token := range documents[n] {
+			if !seen[token] {
+				seen[token] = true
+				frequencies[token]++
+			}
+		}
+	}
+	if len(documents) == 0 {
+		return request.Results, nil
+	}
+	averageLength := float64(totalLength) / float64(len(documents))
+
+	for n, result := range request.Results {
+		counts := make(map[string]int)
+		for _, token := range documents[n] {
+			counts[token]++
+		}
+
+		score := 0.0
+		for _, term := range terms {
+			tf := float64(counts[term])
+			if tf == 0 {
+				continue
+			}
+			df := float64(frequencies[term])
+			idf := math.Log(1 + (float64(len(documents))-df+0.5)/(df+0.5))
+			norm := 1 - params.B
+			if averageLength > 0 {
+				norm += params.B * float64(len(documents[n])) / averageLength
+			}
+			score += idf * tf * (params.K1 + 1) / (tf + params.K1*norm)
+		}
+		setRerankScore(result, score)
+	}
+
+	sortByFinalScore(request.Results)
+	return request.Results, nil
+}
+
+func rerankMMR(request *RerankRequest) ([]*Result, error) {
+	params := struct {
+		Lambda *float64 `json:"lambda"`
+	}{}
+	err := decodeParams(request.Params, &params)
+	if err != nil {
+		return nil, err
+	}
+	lambda := defaultMMRLambda
+	if params.Lambda != nil {
+		lambda = *params.Lambda
+	}
+	if lambda < 0 || lambda > 1 {
+		return nil, fmt.Errorf("%w: mmr lambda must be between 0 and 1", ErrInvalidRerank)
+	}
+
+	similarity := mmrSimilarity(request.Query, request.Field, request.Fields)
+	return selectMMR(request.Results, len(request.Results), lambda, similarity), nil
+}
+
+// similarityFunc compares two hits for MMR redundancy.
+type similarityFunc func(a, b *db.Vector) (float64, bool)
+
+// mmrSimilarity compares hits on the embeddings the query scored them by:
+// the weighted named fields, a single named field, the token embeddings of
+// a multi-vector query, or the default embedding.
+func mmrSimilarity(query *db.Vector, field string, fields map[string]float64) similarityFunc {
+	switch {
+	case len(fields) > 0:
+		return func(a, b *db.Vector) (float64, bool) {
+			total, found := 0.0, false
+			for name, weight := range fields {
+				similarity, ok := fieldSimilarity(a, b, name)
+				if ok {
+					total += weight * similarity
+					found = true
+				}
+			}
+			return total, found
+		}
+	case field != "":
+		return func(a, b *db.Vector) (float64, bool) {
+			return fieldSimilarity(a, b, field)
+		}
+	case query != nil && len(query.Embeddings) > 0:
+		return func(a, b *db.Vector) (float64, bool) {
+			tokensA, tokensB := documentTokens(a), documentTokens(b)
+			if len(tokensA) == 0 || len(tokensB) == 0 {
+				return 0, false
+			}
+			return (maxSim(tokensA, tokensB) + maxSim(tokensB, tokensA)) / 2, true
+		}
+	default:
+		return func(a, b *db.Vector) (float64, bool) {
+			similarity, err := a.Distance(*b)
+			return similarity, err == nil
+		}
+	}
+}
+
+func fieldSimilarity(a, b *db.Vector, field string) (float64, bool) {
+	if field == "" {
+		similarity, err := a.Distance(*b)
+		return similarity, err == nil
+	}
+	embeddingA, embeddingB := a.Vectors[field], b.Vectors[field]
+	if len(embeddingA) == 0 || len(embeddingB) == 0 {
+		return 0, false
+	}
+	similarity, err := cosineSimilarity(db.Vector{Embedding: embeddingA}, db.Vector{Embedding: embeddingB})
+	return similarity, err == nil
+}
+
+// documentTokens returns the token embeddings of a stored vector, or its
+// default embedding as a single token.
+func documentTokens(vector *db.Vector) []*db.Vector {
+	if len(vector.Embeddings) > 0 {
+		return queryTokens(vector)
+	}
+	if len(vector.Embedding) == 0 {
+		return nil
+	}
+	return []*db.Vector{{Embedding: vector.Embedding}}
+}
+
+func selectMMR(results []*Result, k int, lambda float64, similarity similarityFunc) []*Result {
+	remaining := make([]*Result, len(results))
+	copy(remaining, results)
+	selected := make([]*Result, 0, k)
+
+	for len(selected) < k && len(remaining) > 0 {
+		best, bestScore := 0, math.Inf(-1)
+		for n, result := range remaining {
+			redundancy := 0.0
+			for _, chosen := range selected {
+				value, ok := similarity(result.Vector, chosen.Vector)
+				if ok && value > redundancy {
+					redundancy = value
+				}
+			}
+			score := lambda*result.Score - (1-lambda)*redundancy
+			if score > bestScore {
+				best, bestScore = n, score
+			}
+		}
+
+		setRerankScore(remaining[best], bestScore)
+		selected = append(selected, remaining[best])
+		remaining = append(remaining[:best], remaining[best+1:]...)
+	}
+
+	return selected
+}
+
+func rerankMetadata(request *RerankRequest) ([]*Result, error) {
+	var params struct {
+		Boosts []struct {
+			Key    string  `json:"key"`
+			Value  string  `json:"value"`
+			Weight float64 `json:"weight"`
+		} `json:"boosts"`
+	}
+	err := decodeParams(request.Params, &params)
+	if err != nil {
+		return nil, err
+	}
+	if len(params.Boosts) == 0 {
+		return nil, fmt.Errorf("%w: metadata reranking requires at least one boost", ErrInvalidRerank)
+	}
+
+	for _, boost := range params.Boosts {
+		if boost.Weight <= 0 {
+			return nil, fmt.Errorf("%w: metadata boost weights must be positive", ErrInvalidRerank)
+		}
+	}
+
+	// A weight above 1 raises a score whatever its sign, so negative
+	// scores are divided by the weight rather than multiplied.
+	for _, result := range request.Results {
+		score := result.Score
+		for _, boost := range params.Boosts {
+			if result.Metadata[boost.Key] != boost.Value {
+				continue
+			}
+			if score < 0 {
+				score /= boost.Weight
+			} else {
+				score *= boost.Weight
+			}
+		}
+		setRerankScore(result, score)
+	}
+
+	sortByFinalScore(request.Results)
+	return request.Results, nil
+}
+
+type CrossEncoder struct {
+	url    string
+	client *http.Client
+}
+
+func NewCrossEncoder(url string, timeout time.Duration) *CrossEncoder {
+	return &CrossEncoder{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+func (c *CrossEncoder) Rerank(request *RerankRequest) ([]*Result, error) {
+	if request.Query.Text == "" {
+		return nil, fmt.Errorf("%w: cross-encoder reranking requires query text", ErrInvalidRerank)
+	}
+
+	payload := struct {
+		Query     string   `json:"query"`
+		Documents []string `json:"documents"`
+	}{
+		Query:     request.Query.Text,
+		Documents: make([]string, len(request.Results)),
+	}
+	for n, result := range request.Results {
+		payload.Documents[n] = result.Text
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal cross-encoder request: %v", err)
+	}
+
+	resp, err := c.client.Post(c.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to call cross-encoder: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cross-encoder returned status %d", resp.StatusCode)
+	}
+
+	var response struct {
+		Scores []float64 `json:"scores"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode cross-encoder response: %v", err)
+	}
+	if len(response.Scores) != len(request.Results) {
+		return nil, fmt.Errorf("cross-encoder returned %d scores for %d documents", len(response.Scores), len(request.Results))
+	}
+
+	for n, result := range request.Results {
+		setRerankScore(result, response.Scores[n])
+	}
+
+	sortByFinalScore(request.Results)
+	return request.Results, nil
+}
+
+func decodeParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 {
+		return nil
+	}
+	err := json.Unmarshal(params, v)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidRerank, err)
+	}
+	return nil
+}
+
+func documentText(vector *db.Vector) string {
+	var builder strings.Builder
+	builder.WriteString(vector.Text)
+	for _, value := range vector.Metadata {
+		builder.WriteByte(' ')
+		builder.WriteString(value)
+	}
+	return builder.String()
+}
+
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
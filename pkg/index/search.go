@@ -0,0 +1,639 @@
+package index
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/0xnu/kikiola/pkg/db"
+	"github.com/0xnu/kikiola/pkg/segment"
+)
+
+var errStopFetch = errors.New("stop fetching candidates")
+
+const (
+	maxFilterBatch       = 256
+	defaultMMRLambda     = 0.5
+	defaultMMRPoolFactor = 4
+)
+
+const (
+	MetricCosine    = "cosine"
+	MetricEuclidean = "euclidean"
+)
+
+type Query struct {
+	ID     string            `json:"id,omitempty"`
+	Vector *db.Vector        `json:"vector"`
+	K      int               `json:"k"`
+	Filter map[string]string `json:"filter,omitempty"`
+
+	Metric     string   `json:"metric,omitempty"`
+	Threshold  *float64 `json:"threshold,omitempty"`
+	MaxResults int      `json:"max_results,omitempty"`
+
+	Field  string             `json:"field,omitempty"`
+	Fields map[string]float64 `json:"fields,omitempty"`
+
+	MMR *MMROptions `json:"mmr,omitempty"`
+
+	GroupBy   string `json:"group_by,omitempty"`
+	GroupSize int    `json:"group_size,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+
+	Reranker     string          `json:"reranker,omitempty"`
+	RerankParams json.RawMessage `json:"rerank_params,omitempty"`
+
+	OmitEmbedding bool `json:"omit_embedding,omitempty"`
+	OmitText      bool `json:"omit_text,omitempty"`
+	IncludeObject bool `json:"include_object,omitempty"`
+}
+
+type MMROptions struct {
+	Lambda *float64 `json:"lambda,omitempty"`
+	FetchK int      `json:"fetch_k,omitempty"`
+}
+
+type Group struct {
+	Value string    `json:"group"`
+	Hits  []*Result `json:"hits"`
+}
+
+type Result struct {
+	*db.Vector
+	Score       float64  `json:"score"`
+	Distance    float64  `json:"distance"`
+	RerankScore *float64 `json:"rerank_score,omitempty"`
+	FinalScore  float64  `json:"final_score"`
+
+	LinkedObject *LinkedObject `json:"linked_object,omitempty"`
+}
+
+type candidate struct {
+	id       string
+	ref      segment.Ref
+	score    float64
+	distance float64
+}
+
+func (i *Index) Search(vector *db.Vector, k int) ([]*db.Vector, error) {
+	results, err := i.Query(&Query{Vector: vector, K: k})
+	if err != nil {
+		return nil, err
+	}
+
+	vectors := make([]*db.Vector, len(results))
+	for n, result := range results {
+		vectors[n] = result.Vector
+	}
+	return vectors, nil
+}
+
+// Query ranks and fetches the hits under the read lock, then reranks them
+// after releasing it, so a slow reranker does not hold up writers.
+func (i *Index) Query(query *Query) ([]*Result, error) {
+	i.mutex.RLock()
+	vector, results, err := i.collect(query)
+	i.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return i.rerank(query, vector, results)
+}
+
+// QueryEach calls fn with each hit as it is fetched. Queries that are
+// diversified or reranked need every hit first, so they are buffered and
+// give the same hits in the same order as Query.
+func (i *Index) QueryEach(query *Query, fn func(*Result) error) error {
+	i.mutex.RLock()
+	vector, candidates, err := i.rankCandidates(query)
+	i.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if query.MMR != nil || query.rerankerFor(vector) != "" {
+		results, err := i.gather(query, vector, candidates)
+		if err != nil {
+			return err
+		}
+		results, err = i.rerank(query, vector, results)
+		if err != nil {
+			return err
+		}
+		for _, result := range results {
+			err = fn(result)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return i.fetchMatching(candidates, query.limit(), query.Filter, func(result *Result) error {
+		err := i.finish(query, result)
+		if err != nil {
+			return err
+		}
+		return fn(result)
+	})
+}
+
+// SearchBatch answers every query under a single read lock, then reranks
+// the hits once the lock is released so slow rerankers do not hold up
+// writers.
+func (i *Index) SearchBatch(queries []*Query) ([][]*Result, []error) {
+	vectors := make([]*db.Vector, len(queries))
+	results := make([][]*Result, len(queries))
+	errs := make([]error, len(queries))
+
+	i.mutex.RLock()
+	eachQuery(len(queries), func(position int) {
+		vectors[position], results[position], errs[position] = i.collect(queries[position])
+	})
+	i.mutex.RUnlock()
+
+	eachQuery(len(queries), func(position int) {
+		if errs[position] != nil {
+			return
+		}
+		results[position], errs[position] = i.rerank(queries[position], vectors[position], results[position])
+	})
+
+	return results, errs
+}
+
+// eachQuery calls fn with every position below count, spread across
+// GOMAXPROCS workers, and returns once all calls have.
+func eachQuery(count int, fn func(position int)) {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > count {
+		workers = count
+	}
+
+	positions := make(chan int)
+	var wg sync.WaitGroup
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for position := range positions {
+				fn(position)
+			}
+		}()
+	}
+	for position := 0; position < count; position++ {
+		positions <- position
+	}
+	close(positions)
+	wg.Wait()
+}
+
+func (q *Query) Validate() error {
+	if q.Vector == nil && q.ID == "" {
+		return errors.New("missing query vector")
+	}
+	if q.NeedsK() && q.K <= 0 {
+		return errors.New("invalid value of k")
+	}
+	if q.GroupBy != "" {
+		if q.IsRange() || q.MMR != nil {
+			return errors.New("group_by cannot be combined with a threshold or mmr")
+		}
+		if q.GroupSize < 0 || q.Limit < 0 {
+			return errors.New("invalid value of group_size or limit")
+		}
+	}
+	if q.MaxResults < 0 {
+		return errors.New("invalid value of max_results")
+	}
+	switch q.Metric {
+	case "", MetricCosine, MetricEuclidean:
+	default:
+		return fmt.Errorf("unknown metric: %s", q.Metric)
+	}
+	if len(q.Fields) > 0 {
+		if q.Field != "" {
+			return errors.New("field and fields cannot be combined")
+		}
+		if q.Metric == MetricEuclidean {
+			return errors.New("fused queries only support the cosine metric")
+		}
+	}
+	if q.MMR != nil {
+		if q.IsRange() {
+			return errors.New("mmr cannot be combined with a threshold")
+		}
+		if q.MMR.Lambda != nil && (*q.MMR.Lambda < 0 || *q.MMR.Lambda > 1) {
+			return errors.New("mmr lambda must be between 0 and 1")
+		}
+		if q.MMR.FetchK < 0 {
+			return errors.New("invalid value of fetch_k")
+		}
+	}
+	if q.Reranker != "" && q.Reranker != RerankerNone {
+		if _, ok := LookupReranker(q.Reranker); !ok {
+			return fmt.Errorf("unknown reranker: %s", q.Reranker)
+		}
+	}
+	return nil
+}
+
+func (q *Query) rerankerFor(vector *db.Vector) string {
+	if q.Reranker == RerankerNone {
+		return ""
+	}
+	if q.Reranker == "" && vector.Text != "" && !q.IsRange() && q.MMR == nil {
+		return RerankerText
+	}
+	return q.Reranker
+}
+
+func (q *Query) NeedsK() bool {
+	return !q.IsRange() && !(q.GroupBy != "" && q.Limit > 0)
+}
+
+func (q *Query) IsRange() bool {
+	return q.Threshold != nil
+}
+
+func (q *Query) limit() int {
+	if q.IsRange() {
+		return q.MaxResults
+	}
+	if q.MMR != nil {
+		return q.MMR.fetchK(q.K)
+	}
+	return q.K
+}
+
+func (o *MMROptions) fetchK(k int) int {
+	if o.FetchK == 0 {
+		return k * defaultMMRPoolFactor
+	}
+	if o.FetchK < k {
+		return k
+	}
+	return o.FetchK
+}
+
+func (o *MMROptions) lambda() float64 {
+	if o.Lambda == nil {
+		return defaultMMRLambda
+	}
+	return *o.Lambda
+}
+
+func (q *Query) trim(result *Result) {
+	if q.OmitEmbedding {
+		result.Embedding = nil
+	}
+	if q.OmitText {
+		result.Text = ""
+	}
+}
+
+func (i *Index) finish(query *Query, result *Result) error {
+	query.trim(result)
+	if query.IncludeObject {
+		return i.attachObject(result)
+	}
+	return nil
+}
+
+func (i *Index) QueryGroups(query *Query) ([]*Group, error) {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	if query.GroupBy == "" {
+		return nil, errors.New("missing group_by")
+	}
+
+	_, candidates, err := i.rankCandidates(query)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := query.Limit
+	if limit == 0 {
+		limit = query.K
+	}
+	groupSize := query.GroupSize
+	if groupSize == 0 {
+		groupSize = 1
+	}
+
+	var groups []*Group
+	byValue := make(map[string]*Group)
+	full := 0
+	err = i.fetchMatching(candidates, 0, query.Filter, func(result *Result) error {
+		value, ok := result.Metadata[query.GroupBy]
+		if !ok {
+			return nil
+		}
+
+		group := byValue[value]
+		if group == nil {
+			if len(groups) == limit {
+				return nil
+			}
+			group = &Group{Value: value}
+			byValue[value] = group
+			groups = append(groups, group)
+		}
+		if len(group.Hits) == groupSize {
+			return nil
+		}
+
+		err := i.finish(query, result)
+		if err != nil {
+			return err
+		}
+		group.Hits = append(group.Hits, result)
+		if len(group.Hits) == groupSize {
+			full++
+			if full == limit {
+				return errStopFetch
+			}
+		}
+		return nil
+	})
+	if err != nil && err != errStopFetch {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+// collect ranks, fetches and diversifies the hits of a query. The caller
+// holds the read lock.
+func (i *Index) collect(query *Query) (*db.Vector, []*Result, error) {
+	if query.GroupBy != "" {
+		return nil, nil, errors.New("grouped queries must use QueryGroups")
+	}
+
+	vector, candidates, err := i.rankCandidates(query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	results, err := i.gather(query, vector, candidates)
+	if err != nil {
+		return nil, nil, err
+	}
+	return vector, results, nil
+}
+
+func (i *Index) gather(query *Query, vector *db.Vector, candidates []*candidate) ([]*Result, error) {
+	var results []*Result
+	err := i.fetchMatching(candidates, query.limit(), query.Filter, func(result *Result) error {
+		results = append(results, result)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if query.MMR != nil {
+		results = selectMMR(results, query.K, query.MMR.lambda(), mmrSimilarity(vector, query.Field, query.Fields))
+	}
+	return results, nil
+}
+
+// rerank applies the query's reranker and finishes each hit. It runs
+// without the lock.
+func (i *Index) rerank(query *Query, vector *db.Vector, results []*Result) ([]*Result, error) {
+	var err error
+	if name := query.rerankerFor(vector); name != "" && len(results) > 0 {
+		reranker, _ := LookupReranker(name)
+		results, err = reranker.Rerank(&RerankRequest{Query: vector, Field: query.Field, Fields: query.Fields, Results: results, Params: query.RerankParams})
+		if err != nil {
+			return nil, fmt.Errorf("failed to rerank results: %w", err)
+		}
+	}
+
+	for _, result := range results {
+		err = i.finish(query, result)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+func (i *Index) rankCandidates(query *Query) (*db.Vector, []*candidate, error) {
+	err := query.Validate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	distance := cosineScore
+	if query.Metric == MetricEuclidean {
+		distance = euclideanScore
+	}
+
+	vector := query.Vector
+	if vector == nil {
+		stored, err := i.storage.GetVector(query.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		stored.Text = ""
+		vector = stored
+	}
+
+	keep := func(c *candidate) bool {
+		if query.Metric == MetricEuclidean {
+			return c.distance <= *query.Threshold
+		}
+		return c.score >= *query.Threshold
+	}
+
+	var candidates []*candidate
+	switch {
+	case len(query.Fields) > 0:
+		candidates, err = i.fuseCandidates(vector, query.Fields, query.IsRange())
+		if err == nil && query.IsRange() {
+			candidates = keepCandidates(candidates, keep)
+		}
+	case len(vector.Embeddings) > 0 && query.Field == "":
+		if query.Metric == MetricEuclidean {
+			return nil, nil, errors.New("multi-vector queries only support the cosine metric")
+		}
+		candidates, err = i.collectDocumentCandidates(vector, query.IsRange())
+		if err == nil && query.IsRange() {
+			candidates = keepCandidates(candidates, keep)
+		}
+	default:
+		var fieldVector *db.Vector
+		fieldVector, err = fieldQuery(vector, query.Field)
+		if err != nil {
+			return nil, nil, err
+		}
+		if query.IsRange() {
+			candidates, err = i.scanCandidates(fieldVector, query.Field, distance, keep)
+		} else {
+			candidates, err = i.collectCandidates(fieldVector, query.Field, distance)
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].score > candidates[j].score
+	})
+
+	uniqueCandidates := make([]*candidate, 0, len(candidates))
+	seenIDs := make(map[string]bool)
+
+	if query.ID != "" {
+		seenIDs[query.ID] = true
+	}
+
+	for _, candidate := range candidates {
+		if !seenIDs[candidate.id] {
+			uniqueCandidates = append(uniqueCandidates, candidate)
+			seenIDs[candidate.id] = true
+		}
+	}
+
+	return vector, uniqueCandidates, nil
+}
+
+func (i *Index) fetchMatching(candidates []*candidate, limit int, filter map[string]string, emit func(*Result) error) error {
+	emitted := 0
+	for start, end := 0, 0; start < len(candidates) && (limit == 0 || emitted < limit); start = end {
+		end = start + maxFilterBatch
+		if len(filter) == 0 && limit > 0 && end > start+limit-emitted {
+			end = start + limit - emitted
+		}
+		if end > len(candidates) {
+			end = len(candidates)
+		}
+
+		byID := make(map[string]*candidate, end-start)
+		for _, candidate := range candidates[start:end] {
+			byID[candidate.id] = candidate
+		}
+
+		vectors, err := i.storage.GetVectors(getIDs(candidates[start:end]))
+		if err != nil {
+			return fmt.Errorf("failed to get vectors: %v", err)
+		}
+		for _, vector := range vectors {
+			if !db.MatchesMetadata(vector.Metadata, filter) {
+				continue
+			}
+			candidate := byID[vector.ID]
+			err := emit(&Result{Vector: vector, Score: candidate.score, Distance: candidate.distance, FinalScore: candidate.score})
+			if err != nil {
+				return err
+			}
+			emitted++
+			if emitted == limit {
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+func (i *Index) collectCandidates(vector *db.Vector, field string, distance func(v1, v2 db.Vector) (float64, float64)) ([]*candidate, error) {
+	var candidates []*candidate
+	seenRefs := make(map[segment.Ref]bool)
+
+	for _, value := range vector.Embedding {
+		key := i.bucketKey(field, value)
+		for _, ref := range i.index[key] {
+			if seenRefs[ref] {
+				continue
+			}
+			seenRefs[ref] = true
+
+			record, err := i.segments.Get(ref)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read vector segment: %v", err)
+			}
+			score, d := distance(*vector, *record.Vector(record.Key))
+			candidates = append(candidates, &candidate{id: recordID(record.Key), ref: ref, score: score, distance: d})
+		}
+	}
+
+	return candidates, nil
+}
+
+func (i *Index) scanCandidates(vector *db.Vector, field string, distance func(v1, v2 db.Vector) (float64, float64), keep func(*candidate) bool) ([]*candidate, error) {
+	var candidates []*candidate
+	var scanErr error
+
+	i.segments.Each(func(key string, ref segment.Ref) bool {
+		if fieldOf(key) != field {
+			return true
+		}
+		record, err := i.segments.Get(ref)
+		if err != nil {
+			scanErr = fmt.Errorf("failed to read vector segment: %v", err)
+			return false
+		}
+		score, d := distance(*vector, *record.Vector(key))
+		candidate := &candidate{id: recordID(key), ref: ref, score: score, distance: d}
+		if keep(candidate) {
+			candidates = append(candidates, candidate)
+		}
+		return true
+	})
+
+	return candidates, scanErr
+}
+
+func keepCandidates(candidates []*candidate, keep func(*candidate) bool) []*candidate {
+	kept := candidates[:0]
+	for _, candidate := range candidates {
+		if keep(candidate) {
+			kept = append(kept, candidate)
+		}
+	}
+	return kept
+}
+
+func cosineScore(v1, v2 db.Vector) (float64, float64) {
+	score, _ := cosineSimilarity(v1, v2)
+	return score, 1 - score
+}
+
+func euclideanScore(v1, v2 db.Vector) (float64, float64) {
+	if len(v1.Embedding) != len(v2.Embedding) {
+		return 0, math.Inf(1)
+	}
+
+	sum := 0.0
+	for n := range v1.Embedding {
+		a, b := v1.Embedding[n], v2.Embedding[n]
+		if v1.Compressed && v1.QuantizationParams != nil {
+			a = v1.QuantizationParams.Dequantize(a)
+		}
+		if v2.Compressed && v2.QuantizationParams != nil {
+			b = v2.QuantizationParams.Dequantize(b)
+		}
+		sum += (a - b) * (a - b)
+	}
+
+	distance := math.Sqrt(sum)
+	return 1 / (1 + distance), distance
+}
+
+func getIDs(candidates []*candidate) []string {
+	ids := make([]string, len(candidates))
+	for i, candidate := range candidates {
+		ids[i] = candidate.id
+	}
+	return ids
+}
@@ -0,0 +1,21 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+
+package segment
+
+import (
+	"io"
+	"os"
+)
+
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	data := make([]byte, size)
+	_, err := io.ReadFull(io.NewSectionReader(file, 0, size), data)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,267 @@
+package segment
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+
+	"github.com/0xnu/kikiola/pkg/db"
+)
+
+// Segment files start with an 8 byte header (magic and format version)
+// followed by records laid out as:
+//
+//	uint32 payload length | uint32 crc32 of payload | payload
+//
+// where the payload is:
+//
+//	uint16 key length | key | uint8 flags | [float64 min | float64 max | int32 bits] | uint32 dim | dim * float64
+//
+// All integers are little endian.
+
+const (
+	headerSize       = 8
+	recordHeaderSize = 8
+	formatVersion    = 1
+
+	flagCompressed   = 1 << 0
+	flagQuantization = 1 << 1
+)
+
+var magic = []byte("KSEG")
+
+var ErrCorruptRecord = errors.New("corrupt segment record")
+
+type Ref struct {
+	Segment uint32
+	Offset  uint32
+}
+
+type Record struct {
+	Key                string
+	Embedding          []float64
+	Compressed         bool
+	QuantizationParams *db.QuantizationParams
+}
+
+func RecordFromVector(key string, vector *db.Vector) Record {
+	return Record{
+		Key:                key,
+		Embedding:          vector.Embedding,
+		Compressed:         vector.Compressed,
+		QuantizationParams: vector.QuantizationParams,
+	}
+}
+
+func (r Record) Vector(id string) *db.Vector {
+	return &db.Vector{
+		ID:                 id,
+		Embedding:          r.Embedding,
+		Compressed:         r.Compressed,
+		QuantizationParams: r.QuantizationParams,
+	}
+}
+
+type segment struct {
+	id     uint32
+	path   string
+	file   *os.File
+	data   []byte
+	size   int64
+	sealed bool
+}
+
+func segmentFileName(id uint32) string {
+	return fmt.Sprintf("%08d.seg", id)
+}
+
+func encodeHeader() []byte {
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	binary.LittleEndian.PutUint16(header[4:], formatVersion)
+	return header
+}
+
+func checkHeader(header []byte) error {
+	if len(header) < headerSize || string(header[:4]) != string(magic) {
+		return errors.New("invalid segment header")
+	}
+	if version := binary.LittleEndian.Uint16(header[4:]); version != formatVersion {
+		return fmt.Errorf("unsupported segment format version %d", version)
+	}
+	return nil
+}
+
+func encodeRecord(record Record) ([]byte, error) {
+	if len(record.Key) > math.MaxUint16 {
+		return nil, fmt.Errorf("record key too long: %d bytes", len(record.Key))
+	}
+
+	payloadSize := 2 + len(record.Key) + 1 + 4 + 8*len(record.Embedding)
+	if record.QuantizationParams != nil {
+		payloadSize += 20
+	}
+
+	buf := make([]byte, recordHeaderSize+payloadSize)
+	payload := buf[recordHeaderSize:]
+
+	offset := 0
+	binary.LittleEndian.PutUint16(payload[offset:], uint16(len(record.Key)))
+	offset += 2
+	offset += copy(payload[offset:], record.Key)
+
+	var flags byte
+	if record.Compressed {
+		flags |= flagCompressed
+	}
+	if record.QuantizationParams != nil {
+		flags |= flagQuantization
+	}
+	payload[offset] = flags
+	offset++
+
+	if record.QuantizationParams != nil {
+		binary.LittleEndian.PutUint64(payload[offset:], math.Float64bits(record.QuantizationParams.Min))
+		binary.LittleEndian.PutUint64(payload[offset+8:], math.Float64bits(record.QuantizationParams.Max))
+		binary.LittleEndian.PutUint32(payload[offset+16:], uint32(int32(record.QuantizationParams.Bits)))
+		offset += 20
+	}
+
+	binary.LittleEndian.PutUint32(payload[offset:], uint32(len(record.Embedding)))
+	offset += 4
+	for _, value := range record.Embedding {
+		binary.LittleEndian.PutUint64(payload[offset:], math.Float64bits(value))
+		offset += 8
+	}
+
+	binary.LittleEndian.PutUint32(buf[0:], uint32(payloadSize))
+	binary.LittleEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(payload))
+
+	return buf, nil
+}
+
+func decodeRecord(payload []byte) (Record, error) {
+	var record Record
+
+	if len(payload) < 2 {
+		return record, ErrCorruptRecord
+	}
+	keyLen := int(binary.LittleEndian.Uint16(payload))
+	offset := 2
+	if len(payload) < offset+keyLen+1 {
+		return record, ErrCorruptRecord
+	}
+	record.Key = string(payload[offset : offset+keyLen])
+	offset += keyLen
+
+	flags := payload[offset]
+	offset++
+	record.Compressed = flags&flagCompressed != 0
+
+	if flags&flagQuantization != 0 {
+		if len(payload) < offset+20 {
+			return record, ErrCorruptRecord
+		}
+		record.QuantizationParams = &db.QuantizationParams{
+			Min:  math.Float64frombits(binary.LittleEndian.Uint64(payload[offset:])),
+			Max:  math.Float64frombits(binary.LittleEndian.Uint64(payload[offset+8:])),
+			Bits: int(int32(binary.LittleEndian.Uint32(payload[offset+16:]))),
+		}
+		offset += 20
+	}
+
+	if len(payload) < offset+4 {
+		return record, ErrCorruptRecord
+	}
+	dim := int(binary.LittleEndian.Uint32(payload[offset:]))
+	offset += 4
+	if len(payload) != offset+8*dim {
+		return record, ErrCorruptRecord
+	}
+
+	record.Embedding = make([]float64, dim)
+	for i := range record.Embedding {
+		record.Embedding[i] = math.Float64frombits(binary.LittleEndian.Uint64(payload[offset:]))
+		offset += 8
+	}
+
+	return record, nil
+}
+
+func (s *segment) readRecord(offset uint32) (Record, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	if err := s.readAt(header, int64(offset)); err != nil {
+		return Record{}, 0, err
+	}
+
+	payloadSize := int64(binary.LittleEndian.Uint32(header))
+	if int64(offset)+recordHeaderSize+payloadSize > s.size {
+		return Record{}, 0, ErrCorruptRecord
+	}
+
+	payload := make([]byte, payloadSize)
+	if err := s.readAt(payload, int64(offset)+recordHeaderSize); err != nil {
+		return Record{}, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:]) {
+		return Record{}, 0, ErrCorruptRecord
+	}
+
+	record, err := decodeRecord(payload)
+	if err != nil {
+		return Record{}, 0, err
+	}
+
+	return record, recordHeaderSize + payloadSize, nil
+}
+
+func (s *segment) readAt(buf []byte, offset int64) error {
+	if offset+int64(len(buf)) > s.size {
+		return ErrCorruptRecord
+	}
+	if s.data != nil {
+		copy(buf, s.data[offset:])
+		return nil
+	}
+	_, err := s.file.ReadAt(buf, offset)
+	return err
+}
+
+func (s *segment) append(buf []byte) (uint32, error) {
+	offset := s.size
+	_, err := s.file.WriteAt(buf, offset)
+	if err != nil {
+		return 0, err
+	}
+	s.size += int64(len(buf))
+	return uint32(offset), nil
+}
+
+func (s *segment) seal() error {
+	if s.sealed {
+		return nil
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	data, err := mmapFile(s.file, s.size)
+	if err != nil {
+		return err
+	}
+	s.data = data
+	s.sealed = true
+	return nil
+}
+
+func (s *segment) close() error {
+	if s.data != nil {
+		if err := munmapFile(s.data); err != nil {
+			return err
+		}
+		s.data = nil
+	}
+	return s.file.Close()
+}
@@ -0,0 +1,636 @@
+package segment
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultMaxSegmentSize = 64 << 20
+	tombstoneFileName     = "tombstones"
+	tombstoneSize         = 8
+	mergeDeadRatio        = 0.3
+)
+
+var ErrNotFound = errors.New("record not found")
+
+type Store struct {
+	dir            string
+	maxSegmentSize int64
+	segments       map[uint32]*segment
+	active         *segment
+	nextID         uint32
+	live           map[string]Ref
+	dead           map[Ref]bool
+	tombstones     *os.File
+	mutex          sync.RWMutex
+}
+
+type Stats struct {
+	Segments   int   `json:"segments"`
+	Records    int   `json:"records"`
+	Tombstones int   `json:"tombstones"`
+	Bytes      int64 `json:"bytes"`
+}
+
+type MergeResult struct {
+	Segments       []uint32
+	Remap          map[Ref]Ref
+	RecordsPurged  int
+	BytesReclaimed int64
+}
+
+func Open(dir string) (*Store, error) {
+	return OpenWithMaxSize(dir, DefaultMaxSegmentSize)
+}
+
+func OpenWithMaxSize(dir string, maxSegmentSize int64) (*Store, error) {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create segment directory: %v", err)
+	}
+
+	store := &Store{
+		dir:            dir,
+		maxSegmentSize: maxSegmentSize,
+		segments:       make(map[uint32]*segment),
+		live:           make(map[string]Ref),
+		dead:           make(map[Ref]bool),
+	}
+
+	err = store.load()
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (s *Store) load() error {
+	tombstones, err := os.OpenFile(filepath.Join(s.dir, tombstoneFileName), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open tombstones: %v", err)
+	}
+	s.tombstones = tombstones
+
+	data, err := io.ReadAll(tombstones)
+	if err != nil {
+		return fmt.Errorf("failed to read tombstones: %v", err)
+	}
+	for offset := 0; offset+tombstoneSize <= len(data); offset += tombstoneSize {
+		s.dead[Ref{
+			Segment: binary.LittleEndian.Uint32(data[offset:]),
+			Offset:  binary.LittleEndian.Uint32(data[offset+4:]),
+		}] = true
+	}
+
+	ids, err := s.segmentIDs()
+	if err != nil {
+		return err
+	}
+
+	for n, id := range ids {
+		last := n == len(ids)-1
+		seg, err := s.openSegment(id, last)
+		if err != nil {
+			return err
+		}
+		s.segments[id] = seg
+		if last {
+			s.active = seg
+		}
+		s.nextID = id + 1
+	}
+
+	if s.active == nil {
+		return s.rotate()
+	}
+
+	return nil
+}
+
+func (s *Store) segmentIDs() ([]uint32, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list segments: %v", err)
+	}
+
+	var ids []uint32
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, ".seg.tmp") {
+			os.Remove(filepath.Join(s.dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, ".seg") {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, ".seg"), 10, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids, nil
+}
+
+func (s *Store) openSegment(id uint32, active bool) (*segment, error) {
+	path := filepath.Join(s.dir, segmentFileName(id))
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open segment %d: %v", id, err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to stat segment %d: %v", id, err)
+	}
+
+	seg := &segment{id: id, path: path, file: file, size: info.Size()}
+
+	header := make([]byte, headerSize)
+	if err := seg.readAt(header, 0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read segment %d header: %v", id, err)
+	}
+	if err := checkHeader(header); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("segment %d: %v", id, err)
+	}
+
+	offset := int64(headerSize)
+	for offset < seg.size {
+		record, n, err := seg.readRecord(uint32(offset))
+		if err != nil {
+			if !active {
+				file.Close()
+				return nil, fmt.Errorf("segment %d at offset %d: %v", id, offset, err)
+			}
+			// A torn write at the tail of the active segment is discarded.
+			if err := file.Truncate(offset); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("failed to truncate segment %d: %v", id, err)
+			}
+			seg.size = offset
+			break
+		}
+
+		ref := Ref{Segment: id, Offset: uint32(offset)}
+		if !s.dead[ref] {
+			if previous, ok := s.live[record.Key]; ok {
+				s.dead[previous] = true
+			}
+			s.live[record.Key] = ref
+		}
+		offset += n
+	}
+
+	if !active {
+		if err := seg.seal(); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to map segment %d: %v", id, err)
+		}
+	}
+
+	return seg, nil
+}
+
+func (s *Store) createSegment(id uint32, path string) (*segment, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create segment %d: %v", id, err)
+	}
+
+	seg := &segment{id: id, path: path, file: file}
+	if _, err := seg.append(encodeHeader()); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write segment %d header: %v", id, err)
+	}
+
+	return seg, nil
+}
+
+func (s *Store) rotate() error {
+	if s.active != nil {
+		if err := s.active.seal(); err != nil {
+			return fmt.Errorf("failed to seal segment %d: %v", s.active.id, err)
+		}
+	}
+
+	id := s.nextID
+	seg, err := s.createSegment(id, filepath.Join(s.dir, segmentFileName(id)))
+	if err != nil {
+		return err
+	}
+	s.segments[id] = seg
+	s.active = seg
+	s.nextID = id + 1
+
+	return nil
+}
+
+func (s *Store) Put(record Record) (Ref, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	buf, err := encodeRecord(record)
+	if err != nil {
+		return Ref{}, err
+	}
+
+	if s.active.size > headerSize && s.active.size+int64(len(buf)) > s.maxSegmentSize {
+		if err := s.rotate(); err != nil {
+			return Ref{}, err
+		}
+	}
+
+	offset, err := s.active.append(buf)
+	if err != nil {
+		return Ref{}, fmt.Errorf("failed to append record: %v", err)
+	}
+	ref := Ref{Segment: s.active.id, Offset: offset}
+
+	if previous, ok := s.live[record.Key]; ok {
+		if err := s.tombstone(previous); err != nil {
+			return Ref{}, err
+		}
+	}
+	s.live[record.Key] = ref
+
+	return ref, nil
+}
+
+func (s *Store) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ref, ok := s.live[key]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(s.live, key)
+
+	return s.tombstone(ref)
+}
+
+func (s *Store) tombstone(ref Ref) error {
+	buf := make([]byte, tombstoneSize)
+	binary.LittleEndian.PutUint32(buf, ref.Segment)
+	binary.LittleEndian.PutUint32(buf[4:], ref.Offset)
+	if _, err := s.tombstones.Write(buf); err != nil {
+		return fmt.Errorf("failed to write tombstone: %v", err)
+	}
+	s.dead[ref] = true
+	return nil
+}
+
+func (s *Store) Get(ref Ref) (Record, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	seg, ok := s.segments[ref.Segment]
+	if !ok {
+		return Record{}, ErrNotFound
+	}
+	record, _, err := seg.readRecord(ref.Offset)
+	return record, err
+}
+
+func (s *Store) Lookup(key string) (Ref, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	ref, ok := s.live[key]
+	return ref, ok
+}
+
+func (s *Store) Keys() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	keys := make([]string, 0, len(s.live))
+	for key := range s.live {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (s *Store) Each(fn func(key string, ref Ref) bool) {
+	s.mutex.RLock()
+	refs := make(map[string]Ref, len(s.live))
+	for key, ref := range s.live {
+		refs[key] = ref
+	}
+	s.mutex.RUnlock()
+
+	for key, ref := range refs {
+		if !fn(key, ref) {
+			return
+		}
+	}
+}
+
+func (s *Store) Stats() Stats {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	stats := Stats{
+		Segments:   len(s.segments),
+		Records:    len(s.live),
+		Tombstones: len(s.dead),
+	}
+	for _, seg := range s.segments {
+		stats.Bytes += seg.size
+	}
+	return stats
+}
+
+// Save writes a copy of every segment file and of the tombstones through
+// the writers open returns for each file name, so a store opened from the
+// copies holds the same records.
+func (s *Store) Save(open func(name string) (io.WriteCloser, error)) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	ids := make([]uint32, 0, len(s.segments))
+	for id := range s.segments {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		seg := s.segments[id]
+		err := saveFile(open, segmentFileName(id), io.NewSectionReader(seg.file, 0, seg.size))
+		if err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, 0, len(s.dead)*tombstoneSize)
+	for ref := range s.dead {
+		entry := make([]byte, tombstoneSize)
+		binary.LittleEndian.PutUint32(entry, ref.Segment)
+		binary.LittleEndian.PutUint32(entry[4:], ref.Offset)
+		buf = append(buf, entry...)
+	}
+	return saveFile(open, tombstoneFileName, bytes.NewReader(buf))
+}
+
+func saveFile(open func(name string) (io.WriteCloser, error), name string, r io.Reader) error {
+	w, err := open(name)
+	if err != nil {
+		return fmt.Errorf("failed to save %s: %v", name, err)
+	}
+	_, err = io.Copy(w, r)
+	if err != nil {
+		w.Close()
+		return fmt.Errorf("failed to save %s: %v", name, err)
+	}
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("failed to save %s: %v", name, err)
+	}
+	return nil
+}
+
+// IsFileName reports whether name is a file a store keeps in its
+// directory.
+func IsFileName(name string) bool {
+	if name == tombstoneFileName {
+		return true
+	}
+	id := strings.TrimSuffix(name, ".seg")
+	if id == name || id == "" {
+		return false
+	}
+	_, err := strconv.ParseUint(id, 10, 32)
+	return err == nil
+}
+
+func (s *Store) NeedsMerge() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	total := len(s.live) + len(s.dead)
+	return total > 0 && float64(len(s.dead))/float64(total) >= mergeDeadRatio
+}
+
+// Merge seals the active segment and rewrites every segment holding dead
+// records into fresh segments containing only live records. The returned
+// remap translates the refs of moved records to their new location; refs of
+// purged records are absent from it.
+func (s *Store) Merge() (*MergeResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result := &MergeResult{Remap: make(map[Ref]Ref)}
+	if len(s.dead) == 0 {
+		return result, nil
+	}
+
+	if err := s.rotate(); err != nil {
+		return nil, err
+	}
+
+	var victims []*segment
+	for _, seg := range s.segments {
+		if seg == s.active {
+			continue
+		}
+		for ref := range s.dead {
+			if ref.Segment == seg.id {
+				victims = append(victims, seg)
+				break
+			}
+		}
+	}
+	if len(victims) == 0 {
+		return result, nil
+	}
+	sort.Slice(victims, func(i, j int) bool { return victims[i].id < victims[j].id })
+	for _, victim := range victims {
+		result.Segments = append(result.Segments, victim.id)
+	}
+
+	liveRefs := make(map[Ref]bool, len(s.live))
+	for _, ref := range s.live {
+		liveRefs[ref] = true
+	}
+
+	var written []*segment
+	var output *segment
+	abort := func(err error) (*MergeResult, error) {
+		for _, seg := range written {
+			seg.close()
+			os.Remove(seg.path)
+		}
+		return nil, err
+	}
+
+	var reclaimed int64
+	for _, victim := range victims {
+		reclaimed += victim.size
+		offset := int64(headerSize)
+		for offset < victim.size {
+			record, n, err := victim.readRecord(uint32(offset))
+			if err != nil {
+				return abort(fmt.Errorf("failed to read segment %d: %v", victim.id, err))
+			}
+			ref := Ref{Segment: victim.id, Offset: uint32(offset)}
+			offset += n
+
+			if !liveRefs[ref] {
+				result.RecordsPurged++
+				continue
+			}
+
+			buf, err := encodeRecord(record)
+			if err != nil {
+				return abort(err)
+			}
+			if output == nil || (output.size > headerSize && output.size+int64(len(buf)) > s.maxSegmentSize) {
+				id := s.nextID
+				s.nextID++
+				output, err = s.createSegment(id, filepath.Join(s.dir, segmentFileName(id)+".tmp"))
+				if err != nil {
+					return abort(err)
+				}
+				written = append(written, output)
+			}
+			newOffset, err := output.append(buf)
+			if err != nil {
+				return abort(fmt.Errorf("failed to write merged segment: %v", err))
+			}
+			result.Remap[ref] = Ref{Segment: output.id, Offset: newOffset}
+		}
+	}
+
+	for _, seg := range written {
+		finalPath := filepath.Join(s.dir, segmentFileName(seg.id))
+		if err := seg.seal(); err != nil {
+			return abort(err)
+		}
+		if err := os.Rename(seg.path, finalPath); err != nil {
+			return abort(fmt.Errorf("failed to install merged segment: %v", err))
+		}
+		seg.path = finalPath
+		reclaimed -= seg.size
+	}
+
+	for _, victim := range victims {
+		victim.close()
+		os.Remove(victim.path)
+		delete(s.segments, victim.id)
+	}
+	for _, seg := range written {
+		s.segments[seg.id] = seg
+	}
+
+	// The merged segments were allocated after the active segment, so a fresh
+	// active segment keeps newer writes ordered after the merged records.
+	if err := s.rotate(); err != nil {
+		return nil, err
+	}
+
+	for id, seg := range s.segments {
+		if seg != s.active && seg.size == headerSize {
+			reclaimed += seg.size
+			seg.close()
+			os.Remove(seg.path)
+			delete(s.segments, id)
+		}
+	}
+
+	for key, ref := range s.live {
+		if newRef, ok := result.Remap[ref]; ok {
+			s.live[key] = newRef
+		}
+	}
+
+	err := s.rewriteTombstones()
+	if err != nil {
+		return nil, err
+	}
+
+	result.BytesReclaimed = reclaimed
+	return result, nil
+}
+
+func (s *Store) rewriteTombstones() error {
+	for ref := range s.dead {
+		if _, ok := s.segments[ref.Segment]; !ok {
+			delete(s.dead, ref)
+		}
+	}
+
+	path := filepath.Join(s.dir, tombstoneFileName)
+	file, err := os.OpenFile(path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to rewrite tombstones: %v", err)
+	}
+
+	buf := make([]byte, 0, len(s.dead)*tombstoneSize)
+	for ref := range s.dead {
+		entry := make([]byte, tombstoneSize)
+		binary.LittleEndian.PutUint32(entry, ref.Segment)
+		binary.LittleEndian.PutUint32(entry[4:], ref.Offset)
+		buf = append(buf, entry...)
+	}
+	if _, err := file.Write(buf); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to rewrite tombstones: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to rewrite tombstones: %v", err)
+	}
+	file.Close()
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to install tombstones: %v", err)
+	}
+
+	s.tombstones.Close()
+	s.tombstones, err = os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to reopen tombstones: %v", err)
+	}
+
+	return nil
+}
+
+func (s *Store) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var firstErr error
+	for _, seg := range s.segments {
+		if err := seg.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.segments = make(map[uint32]*segment)
+	s.active = nil
+
+	if s.tombstones != nil {
+		if err := s.tombstones.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		s.tombstones = nil
+	}
+
+	return firstErr
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/0xnu/kikiola/pkg/db"
+)
+
+const maxBatchSize = 10000
+
+type batchItemResult struct {
+	ID     string `json:"id"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Results   []batchItemResult `json:"results"`
+}
+
+func (s *Server) handleInsertVectorsBatch(w http.ResponseWriter, r *http.Request) {
+	s.writeVectorsBatch(w, r, db.WriteCreate, http.StatusCreated)
+}
+
+func (s *Server) handleUpsertVectorsBatch(w http.ResponseWriter, r *http.Request) {
+	s.writeVectorsBatch(w, r, db.WriteUpsert, http.StatusOK)
+}
+
+func (s *Server) writeVectorsBatch(w http.ResponseWriter, r *http.Request, mode db.WriteMode, successStatus int) {
+	var batchReq struct {
+		Vectors []*db.Vector `json:"vectors"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&batchReq)
+	if err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if len(batchReq.Vectors) == 0 {
+		http.Error(w, "Missing vectors in request", http.StatusBadRequest)
+		return
+	}
+	if len(batchReq.Vectors) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("Batch exceeds %d vectors", maxBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	results := make([]batchItemResult, len(batchReq.Vectors))
+	var valid []*db.Vector
+	var positions []int
+	seenIDs := make(map[string]bool)
+
+	for n, vector := range batchReq.Vectors {
+		if vector == nil {
+			results[n] = batchItemResult{Status: http.StatusBadRequest, Error: "missing vector"}
+			continue
+		}
+		results[n].ID = vector.ID
+
+		err := vector.Validate()
+		if err != nil {
+			results[n].Status = http.StatusBadRequest
+			results[n].Error = err.Error()
+			continue
+		}
+		if seenIDs[vector.ID] {
+			results[n].Status = http.StatusBadRequest
+			results[n].Error = "duplicate vector ID in batch"
+			continue
+		}
+		seenIDs[vector.ID] = true
+
+		valid = append(valid, vector)
+		positions = append(positions, n)
+	}
+
+	embedErrs := s.embedVectors(valid)
+	var embedded []*db.Vector
+	var embeddedPositions []int
+	for n, err := range embedErrs {
+		if err != nil {
+			results[positions[n]] = itemResult(valid[n].ID, err, successStatus)
+			continue
+		}
+		embedded = append(embedded, valid[n])
+		embeddedPositions = append(embeddedPositions, positions[n])
+	}
+	valid, positions = embedded, embeddedPositions
+
+	if len(valid) > 0 {
+		for n, err := range s.index.WriteVectors(valid, mode) {
+			results[positions[n]] = itemResult(valid[n].ID, err, successStatus)
+		}
+	}
+
+	writeBatchResponse(w, results)
+}
+
+func (s *Server) handleDeleteVectorsBatch(w http.ResponseWriter, r *http.Request) {
+	var batchReq struct {
+		IDs []string `json:"ids"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&batchReq)
+	if err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if len(batchReq.IDs) == 0 {
+		http.Error(w, "Missing ids in request", http.StatusBadRequest)
+		return
+	}
+	if len(batchReq.IDs) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("Batch exceeds %d vectors", maxBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	results := make([]batchItemResult, len(batchReq.IDs))
+	var ids []string
+	var positions []int
+	seenIDs := make(map[string]bool)
+
+	for n, id := range batchReq.IDs {
+		results[n].ID = id
+		if id == "" || seenIDs[id] {
+			results[n].Status = http.StatusBadRequest
+			results[n].Error = "missing or duplicate vector ID"
+			continue
+		}
+		seenIDs[id] = true
+		ids = append(ids, id)
+		positions = append(positions, n)
+	}
+
+	if len(ids) > 0 {
+		for n, err := range s.index.DeleteVectors(ids) {
+			results[positions[n]] = itemResult(ids[n], err, http.StatusNoContent)
+		}
+	}
+
+	writeBatchResponse(w, results)
+}
+
+func itemResult(id string, err error, successStatus int) batchItemResult {
+	result := batchItemResult{ID: id, Status: successStatus}
+	if err == nil {
+		return result
+	}
+
+	result.Error = err.Error()
+	switch {
+	case errors.Is(err, db.ErrVectorExists):
+		result.Status = http.StatusConflict
+	case errors.Is(err, db.ErrVectorNotFound):
+		result.Status = http.StatusNotFound
+	default:
+		result.Status = embeddingStatus(err)
+	}
+	return result
+}
+
+func writeBatchResponse(w http.ResponseWriter, results []batchItemResult) {
+	response := batchResponse{Results: results}
+	for _, result := range results {
+		if result.Error == "" {
+			response.Succeeded++
+		} else {
+			response.Failed++
+		}
+	}
+
+	status := http.StatusOK
+	if response.Failed > 0 {
+		status = http.StatusMultiStatus
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
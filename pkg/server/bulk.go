@@ -0,0 +1,236 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/0xnu/kikiola/pkg/bulk"
+	"github.com/0xnu/kikiola/pkg/db"
+)
+
+type importResponse struct {
+	Imported int    `json:"imported"`
+	Error    string `json:"error,omitempty"`
+	Row      *int   `json:"row,omitempty"`
+}
+
+func (s *Server) handleImportVectors(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = bulk.FormatJSONL
+	}
+
+	batchSize := bulk.DefaultBatchSize
+	if value := r.URL.Query().Get("batch"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			http.Error(w, "Invalid batch size", http.StatusBadRequest)
+			return
+		}
+		batchSize = n
+	}
+
+	spooled, err := spoolImport(r, format)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read import: %v", err), http.StatusBadRequest)
+		return
+	}
+	defer spooled.cleanup()
+
+	options := bulk.Options{IDPrefix: r.URL.Query().Get("id_prefix")}
+	if spooled.ids != nil {
+		options.IDs = spooled.ids
+	}
+	if spooled.metadata != nil {
+		options.Metadata = spooled.metadata
+	}
+
+	var reader bulk.Reader
+	if spooled.vectors != nil {
+		reader, err = bulk.OpenReader(format, spooled.vectors, options)
+	} else {
+		reader, err = streamingReader(format, r.Body, options)
+	}
+	if err != nil {
+		if errors.Is(err, bulk.ErrUnknownFormat) {
+			http.Error(w, fmt.Sprintf("Unsupported import format: %s", format), http.StatusBadRequest)
+		} else {
+			http.Error(w, fmt.Sprintf("Failed to read import: %v", err), http.StatusBadRequest)
+		}
+		return
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	count, err := bulk.Import(reader, batchSize, func(vectors []*db.Vector) []error {
+		return s.index.WriteVectors(vectors, db.WriteUpsert)
+	})
+	response := importResponse{Imported: count}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		log.Printf("Error importing vectors: %v", err)
+		response.Error = err.Error()
+		status := http.StatusBadRequest
+		var importErr *bulk.ImportError
+		var writeErr *bulk.WriteError
+		switch {
+		case errors.As(err, &importErr):
+			response.Row = &importErr.Row
+		case errors.As(err, &writeErr):
+			response.Row = &writeErr.Row
+			if !errors.Is(err, db.ErrObjectNotFound) {
+				status = http.StatusInternalServerError
+			}
+		}
+		w.WriteHeader(status)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func streamingReader(format string, body io.Reader, options bulk.Options) (bulk.Reader, error) {
+	switch format {
+	case bulk.FormatJSONL:
+		return bulk.NewJSONLReader(body), nil
+	case bulk.FormatFvecs:
+		return bulk.NewFvecsReader(body, options), nil
+	case bulk.FormatIvecs:
+		return bulk.NewIvecsReader(body, options), nil
+	case bulk.FormatNPY:
+		return bulk.NewNPYReader(body, options)
+	default:
+		return nil, fmt.Errorf("%w: %s", bulk.ErrUnknownFormat, format)
+	}
+}
+
+type spooledImport struct {
+	vectors  *os.File
+	ids      *os.File
+	metadata *os.File
+}
+
+// spoolImport copies multipart uploads and npz archives to temporary files:
+// the sidecar parts must be readable alongside the vectors, and npz archives
+// need random access. Other request bodies are streamed without spooling.
+func spoolImport(r *http.Request, format string) (*spooledImport, error) {
+	spooled := &spooledImport{}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		if format != bulk.FormatNPZ {
+			return spooled, nil
+		}
+		file, err := spoolFile(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		spooled.vectors = file
+		return spooled, nil
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			spooled.cleanup()
+			return nil, err
+		}
+
+		var target **os.File
+		switch part.FormName() {
+		case "file", "vectors":
+			target = &spooled.vectors
+		case "ids":
+			target = &spooled.ids
+		case "metadata":
+			target = &spooled.metadata
+		default:
+			part.Close()
+			continue
+		}
+
+		file, err := spoolFile(part)
+		part.Close()
+		if err != nil {
+			spooled.cleanup()
+			return nil, err
+		}
+		*target = file
+	}
+
+	if spooled.vectors == nil {
+		spooled.cleanup()
+		return nil, errors.New("missing file part")
+	}
+
+	return spooled, nil
+}
+
+func spoolFile(r io.Reader) (*os.File, error) {
+	file, err := os.CreateTemp("", "kikiola-import-")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(file, r)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *spooledImport) cleanup() {
+	for _, file := range []*os.File{s.vectors, s.ids, s.metadata} {
+		if file != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}
+}
+
+func (s *Server) handleExportVectors(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = bulk.FormatJSONL
+	}
+
+	if !bulk.KeepsIDs(format) {
+		http.Error(w, fmt.Sprintf("Unsupported export format: %s, use jsonl or npz to keep vector IDs and metadata", format), http.StatusBadRequest)
+		return
+	}
+
+	writer, err := bulk.NewWriter(format, w, nil)
+	if err != nil {
+		if errors.Is(err, bulk.ErrUnknownFormat) {
+			http.Error(w, fmt.Sprintf("Unsupported export format: %s", format), http.StatusBadRequest)
+		} else {
+			http.Error(w, "Failed to export vectors", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", bulk.ContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "vectors."+format))
+
+	_, err = bulk.Export(s.storage.IterateVectors(db.ListOptions{}), writer)
+	if err != nil {
+		log.Printf("Error exporting vectors: %v", err)
+	}
+}
@@ -0,0 +1,288 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/0xnu/kikiola/pkg/chunk"
+	"github.com/0xnu/kikiola/pkg/db"
+	"github.com/0xnu/kikiola/pkg/embed"
+)
+
+const maxDocumentSize = 16 << 20
+
+type documentRequest struct {
+	ID          string            `json:"id"`
+	Text        string            `json:"text,omitempty"`
+	ObjectID    string            `json:"object_id,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Chunker     string            `json:"chunker,omitempty"`
+	chunk.Options
+}
+
+type documentChunk struct {
+	ID      string `json:"id"`
+	Start   int    `json:"start"`
+	End     int    `json:"end"`
+	Heading string `json:"heading,omitempty"`
+}
+
+type documentResponse struct {
+	ID      string          `json:"id"`
+	Version int             `json:"version"`
+	Chunker string          `json:"chunker"`
+	Chunks  []documentChunk `json:"chunks"`
+}
+
+// handleInsertDocument stores a text document as an object, splits it into
+// chunks and stores an embedded vector linked to the object for each one.
+// The text comes from the request, an uploaded file or an existing object.
+func (s *Server) handleInsertDocument(w http.ResponseWriter, r *http.Request) {
+	if s.embedder == nil {
+		http.Error(w, "No embedding provider is configured", http.StatusNotImplemented)
+		return
+	}
+
+	var req documentRequest
+	var content *objectContent
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		var ok bool
+		content, ok = s.readDocumentForm(w, r, &req)
+		if !ok {
+			return
+		}
+	} else {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.ObjectID != "" {
+		if req.ID == "" {
+			req.ID = req.ObjectID
+		}
+		if req.ID != req.ObjectID || req.Text != "" || content != nil {
+			http.Error(w, "object_id cannot be combined with another document source", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.ID == "" {
+		http.Error(w, "Missing document ID in request", http.StatusBadRequest)
+		return
+	}
+	if req.Text != "" && content != nil {
+		http.Error(w, "text cannot be combined with an uploaded file", http.StatusBadRequest)
+		return
+	}
+
+	chunker, err := chunk.New(req.Chunker, req.Options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Chunker == "" {
+		req.Chunker = chunk.ChunkerFixed
+	}
+
+	object, text, err := s.documentSource(&req, content)
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+
+	chunks := chunker.Split(text)
+	if len(chunks) == 0 {
+		http.Error(w, "Document has no text to chunk", http.StatusBadRequest)
+		return
+	}
+
+	vectors := make([]*db.Vector, len(chunks))
+	for n, piece := range chunks {
+		vectors[n] = chunkVector(object, &req, piece, n, len(chunks))
+	}
+	for _, err := range s.embedVectors(vectors) {
+		if err != nil {
+			writeEmbeddingError(w, err)
+			return
+		}
+	}
+
+	if req.ObjectID == "" {
+		err = s.storage.InsertObject(object)
+		if err != nil {
+			http.Error(w, "Failed to insert document", http.StatusInternalServerError)
+			log.Printf("Error inserting document: %v", err)
+			return
+		}
+	}
+
+	for _, err := range s.index.WriteVectors(vectors, db.WriteUpsert) {
+		if err != nil {
+			http.Error(w, "Failed to insert document chunks", http.StatusInternalServerError)
+			log.Printf("Error inserting document chunks: %v", err)
+			return
+		}
+	}
+
+	err = s.removeStaleChunks(object.ID, len(chunks))
+	if err != nil {
+		log.Printf("Error removing stale document chunks: %v", err)
+	}
+
+	response := documentResponse{ID: object.ID, Version: object.Version, Chunker: req.Chunker, Chunks: make([]documentChunk, len(chunks))}
+	for n, piece := range chunks {
+		response.Chunks[n] = documentChunk{ID: vectors[n].ID, Start: piece.Start, End: piece.End, Heading: piece.Heading}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) readDocumentForm(w http.ResponseWriter, r *http.Request, req *documentRequest) (*objectContent, bool) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Failed to parse multipart form", http.StatusBadRequest)
+		return nil, false
+	}
+
+	var content *objectContent
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "Failed to parse multipart form", http.StatusBadRequest)
+			return nil, false
+		}
+
+		switch part.FormName() {
+		case "data":
+			err = json.NewDecoder(io.LimitReader(part, maxObjectDataSize)).Decode(req)
+			if err != nil {
+				http.Error(w, "Invalid JSON data", http.StatusBadRequest)
+				return nil, false
+			}
+		case "object":
+			content, err = s.storeContent(part)
+			if err != nil {
+				http.Error(w, "Failed to store object file", http.StatusInternalServerError)
+				log.Printf("Error storing object file: %v", err)
+				return nil, false
+			}
+		}
+		part.Close()
+	}
+	return content, true
+}
+
+// documentSource returns the object holding the document and its text.
+// Unless the request names an existing object, the object is not saved.
+func (s *Server) documentSource(req *documentRequest, content *objectContent) (*db.Object, string, error) {
+	if req.ObjectID != "" {
+		object, err := s.storage.GetObject(req.ObjectID)
+		if err != nil {
+			return nil, "", err
+		}
+		text, err := s.objectText(object, maxDocumentSize)
+		return object, text, err
+	}
+
+	object := &db.Object{ID: req.ID, Metadata: req.Metadata, ContentType: req.ContentType}
+	if content != nil {
+		content.apply(object)
+		text, err := s.objectText(object, maxDocumentSize)
+		return object, text, err
+	}
+
+	if req.Text == "" {
+		return nil, "", fmt.Errorf("%w: missing text, object or object_id", embed.ErrInvalidInput)
+	}
+	if len(req.Text) > maxDocumentSize {
+		return nil, "", fmt.Errorf("%w: document exceeds %d bytes", embed.ErrInvalidInput, maxDocumentSize)
+	}
+	if object.ContentType == "" {
+		object.ContentType = "text/plain; charset=utf-8"
+	}
+	object.Object = []byte(req.Text)
+	return object, req.Text, nil
+}
+
+func chunkVector(object *db.Object, req *documentRequest, piece chunk.Chunk, n, count int) *db.Vector {
+	metadata := make(map[string]string, len(object.Metadata)+6)
+	for key, value := range object.Metadata {
+		metadata[key] = value
+	}
+	metadata["doc_id"] = object.ID
+	metadata["chunker"] = req.Chunker
+	metadata["chunk"] = strconv.Itoa(n)
+	metadata["chunks"] = strconv.Itoa(count)
+	metadata["start"] = strconv.Itoa(piece.Start)
+	metadata["end"] = strconv.Itoa(piece.End)
+	if piece.Heading != "" {
+		metadata["heading"] = piece.Heading
+	}
+
+	return &db.Vector{
+		ID:       chunkID(object.ID, n),
+		Text:     piece.Text,
+		Metadata: metadata,
+		ObjectID: object.ID,
+	}
+}
+
+func chunkID(documentID string, n int) string {
+	return fmt.Sprintf("%s:%d", documentID, n)
+}
+
+// removeStaleChunks deletes the chunks an earlier ingestion of the
+// document left beyond the new chunk count.
+func (s *Server) removeStaleChunks(documentID string, count int) error {
+	var stale []string
+	for _, id := range s.index.LinkedVectors(documentID) {
+		n, err := strconv.Atoi(strings.TrimPrefix(id, documentID+":"))
+		if err != nil || n < count || chunkID(documentID, n) != id {
+			continue
+		}
+		vector, err := s.storage.GetVector(id)
+		if err != nil || vector.Metadata["doc_id"] != documentID {
+			continue
+		}
+		stale = append(stale, id)
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+
+	for _, err := range s.index.DeleteVectors(stale) {
+		if err != nil && !errors.Is(err, db.ErrVectorNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeDocumentError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, db.ErrObjectNotFound):
+		http.Error(w, "Object not found", http.StatusNotFound)
+	case errors.Is(err, embed.ErrInvalidInput):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, "Failed to read document", http.StatusInternalServerError)
+		log.Printf("Error reading document: %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/0xnu/kikiola/pkg/db"
+	"github.com/0xnu/kikiola/pkg/embed"
+)
+
+const maxEmbedObjectSize = 1 << 20
+
+// SetEmbedder configures the provider used to embed vectors and queries
+// sent with text or a linked object instead of an embedding.
+func (s *Server) SetEmbedder(provider embed.Provider) {
+	s.embedder = provider
+}
+
+// embedVectors fills in the embedding of every vector that has text or a
+// linked object but no embeddings of any kind, calling the provider once
+// for all of them. Errors are returned per vector.
+func (s *Server) embedVectors(vectors []*db.Vector) []error {
+	errs := make([]error, len(vectors))
+	if s.embedder == nil {
+		return errs
+	}
+
+	var texts []string
+	var pending []int
+	for n, vector := range vectors {
+		if !needsEmbedding(vector) {
+			continue
+		}
+		text, err := s.embeddingText(vector)
+		if err != nil {
+			errs[n] = err
+			continue
+		}
+		texts = append(texts, text)
+		pending = append(pending, n)
+	}
+	if len(texts) == 0 {
+		return errs
+	}
+
+	embeddings, err := s.embedder.Embed(texts)
+	if err == nil && len(embeddings) != len(texts) {
+		err = fmt.Errorf("provider returned %d embeddings for %d texts", len(embeddings), len(texts))
+	}
+	for i, n := range pending {
+		if err == nil {
+			errs[n] = checkEmbedding(embeddings[i], len(embeddings[0]))
+		} else {
+			errs[n] = fmt.Errorf("%w: %v", embed.ErrProvider, err)
+		}
+		if errs[n] == nil {
+			vectors[n].Embedding = embeddings[i]
+		}
+	}
+	return errs
+}
+
+// checkEmbedding rejects an embedding a provider returned empty, with a
+// dimension other than the first of its batch, or with NaN or infinite
+// values. Custom providers are not guaranteed to check their output.
+func checkEmbedding(embedding []float64, dimensions int) error {
+	if len(embedding) == 0 {
+		return fmt.Errorf("%w: provider returned an empty embedding", embed.ErrProvider)
+	}
+	if len(embedding) != dimensions {
+		return fmt.Errorf("%w: provider returned an embedding of %d dimensions, expected %d", embed.ErrProvider, len(embedding), dimensions)
+	}
+	for _, value := range embedding {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return fmt.Errorf("%w: provider returned NaN or infinite values", embed.ErrProvider)
+		}
+	}
+	return nil
+}
+
+func needsEmbedding(vector *db.Vector) bool {
+	if len(vector.Embedding) > 0 || len(vector.Embeddings) > 0 || len(vector.Vectors) > 0 {
+		return false
+	}
+	return vector.Text != "" || vector.ObjectID != ""
+}
+
+func (s *Server) embeddingText(vector *db.Vector) (string, error) {
+	if vector.Text != "" {
+		return vector.Text, nil
+	}
+
+	object, err := s.storage.GetObject(vector.ObjectID)
+	if err != nil {
+		return "", fmt.Errorf("linked %w: %s", err, vector.ObjectID)
+	}
+	return s.objectText(object, maxEmbedObjectSize)
+}
+
+// objectText reads the content of an object as UTF-8 text of at most
+// limit bytes.
+func (s *Server) objectText(object *db.Object, limit int64) (string, error) {
+	contentType := object.ContentType
+	if contentType == "" {
+		contentType = object.Metadata["content_type"]
+	}
+	if contentType != "" && !isTextContent(contentType) {
+		return "", fmt.Errorf("%w: object %s has content type %s", embed.ErrInvalidInput, object.ID, contentType)
+	}
+
+	content, err := s.storage.OpenObject(object)
+	if err != nil {
+		return "", err
+	}
+	defer content.Close()
+
+	data, err := io.ReadAll(io.LimitReader(content, limit+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to read object content: %v", err)
+	}
+	if int64(len(data)) > limit {
+		return "", fmt.Errorf("%w: object %s exceeds %d bytes", embed.ErrInvalidInput, object.ID, limit)
+	}
+	if len(data) == 0 || !utf8.Valid(data) {
+		return "", fmt.Errorf("%w: object %s has no text content", embed.ErrInvalidInput, object.ID)
+	}
+	return string(data), nil
+}
+
+func isTextContent(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "text/"):
+		return true
+	case mediaType == "application/json", mediaType == "application/xml", mediaType == "application/x-ndjson":
+		return true
+	case strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	return false
+}
+
+func embeddingStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrObjectNotFound), errors.Is(err, embed.ErrInvalidInput):
+		return http.StatusBadRequest
+	case errors.Is(err, embed.ErrProvider):
+		return http.StatusBadGateway
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeEmbeddingError(w http.ResponseWriter, err error) {
+	switch embeddingStatus(err) {
+	case http.StatusBadRequest:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case http.StatusBadGateway:
+		http.Error(w, "Failed to generate embedding", http.StatusBadGateway)
+		log.Printf("Error generating embedding: %v", err)
+	default:
+		http.Error(w, "Failed to generate embedding", http.StatusInternalServerError)
+		log.Printf("Error generating embedding: %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/0xnu/kikiola/pkg/db"
+)
+
+const streamFlushInterval = 100
+
+func (s *Server) handleListVectors(w http.ResponseWriter, r *http.Request) {
+	options, ok := listOptions(w, r)
+	if !ok {
+		return
+	}
+
+	vectors, cursor, err := s.storage.ListVectors(options)
+	if err != nil {
+		http.Error(w, "Failed to list vectors", http.StatusInternalServerError)
+		log.Printf("Error listing vectors: %v", err)
+		return
+	}
+
+	items := make([]interface{}, len(vectors))
+	for n, vector := range vectors {
+		items[n] = vector
+	}
+	writeListResponse(w, r, "vectors", items, cursor)
+}
+
+func (s *Server) handleListObjects(w http.ResponseWriter, r *http.Request) {
+	options, ok := listOptions(w, r)
+	if !ok {
+		return
+	}
+
+	objects, cursor, err := s.storage.ListObjects(options)
+	if err != nil {
+		http.Error(w, "Failed to list objects", http.StatusInternalServerError)
+		log.Printf("Error listing objects: %v", err)
+		return
+	}
+
+	items := make([]interface{}, len(objects))
+	for n, object := range objects {
+		object.History = nil
+		items[n] = object
+	}
+	writeListResponse(w, r, "objects", items, cursor)
+}
+
+func (s *Server) handleStreamVectors(w http.ResponseWriter, r *http.Request) {
+	options, ok := listOptions(w, r)
+	if !ok {
+		return
+	}
+	options.After = ""
+	options.Limit = 0
+
+	var fields []string
+	if value := r.URL.Query().Get("fields"); value != "" {
+		fields = strings.Split(value, ",")
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+
+	vectors := s.storage.IterateVectors(options)
+	for count := 1; ; count++ {
+		vector, err := vectors.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Error streaming vectors: %v", err)
+			return
+		}
+
+		var item interface{} = vector
+		if len(fields) > 0 {
+			item, err = project(vector, fields)
+			if err != nil {
+				log.Printf("Error projecting fields: %v", err)
+				return
+			}
+		}
+
+		err = encoder.Encode(item)
+		if err != nil {
+			log.Printf("Error streaming vectors: %v", err)
+			return
+		}
+		if flusher != nil && count%streamFlushInterval == 0 {
+			flusher.Flush()
+		}
+	}
+}
+
+func listOptions(w http.ResponseWriter, r *http.Request) (db.ListOptions, bool) {
+	query := r.URL.Query()
+	options := db.ListOptions{After: query.Get("cursor")}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			http.Error(w, "Invalid value of limit", http.StatusBadRequest)
+			return options, false
+		}
+		options.Limit = limit
+	}
+
+	for _, filter := range query["filter"] {
+		key, value, found := strings.Cut(filter, ":")
+		if !found || key == "" {
+			http.Error(w, "Invalid filter, expected key:value", http.StatusBadRequest)
+			return options, false
+		}
+		if options.Filter == nil {
+			options.Filter = make(map[string]string)
+		}
+		options.Filter[key] = value
+	}
+
+	return options, true
+}
+
+func writeListResponse(w http.ResponseWriter, r *http.Request, name string, items []interface{}, cursor string) {
+	var fields []string
+	if value := r.URL.Query().Get("fields"); value != "" {
+		fields = strings.Split(value, ",")
+	}
+
+	if len(fields) > 0 {
+		for n, item := range items {
+			projected, err := project(item, fields)
+			if err != nil {
+				http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+				log.Printf("Error projecting fields: %v", err)
+				return
+			}
+			items[n] = projected
+		}
+	}
+
+	response := map[string]interface{}{
+		name:          items,
+		"next_cursor": cursor,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+func project(item interface{}, fields []string) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+
+	var all map[string]json.RawMessage
+	err = json.Unmarshal(data, &all)
+	if err != nil {
+		return nil, err
+	}
+
+	projected := make(map[string]json.RawMessage, len(fields))
+	for key, value := range all {
+		for _, field := range fields {
+			if strings.EqualFold(key, strings.TrimSpace(field)) {
+				projected[key] = value
+				break
+			}
+		}
+	}
+	return projected, nil
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"time"
+
+	"github.com/0xnu/kikiola/pkg/blob"
+	"github.com/0xnu/kikiola/pkg/db"
+)
+
+const maxObjectDataSize = 1 << 20
+
+type objectContentResponse struct {
+	ID         string `json:"id"`
+	Version    int    `json:"version"`
+	Digest     string `json:"digest"`
+	Size       int64  `json:"size"`
+	References int    `json:"references"`
+}
+
+type objectContent struct {
+	blob        *blob.Blob
+	contentType string
+}
+
+func (s *Server) storeContent(part *multipart.Part) (*objectContent, error) {
+	stored, err := s.storage.StoreContent(part)
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := part.Header.Get("Content-Type")
+	if contentType == "application/octet-stream" {
+		contentType = ""
+	}
+	return &objectContent{blob: stored, contentType: contentType}, nil
+}
+
+func (c *objectContent) apply(object *db.Object) {
+	object.Object = nil
+	object.Blob = c.blob
+	if c.contentType != "" {
+		object.ContentType = c.contentType
+	}
+}
+
+func (s *Server) writeObjectContent(w http.ResponseWriter, object *db.Object, status int) {
+	response := objectContentResponse{ID: object.ID, Version: object.Version}
+	if object.Blob != nil {
+		response.Digest = object.Blob.Digest
+		response.Size = object.Blob.Size
+		response.References = s.storage.Blobs().Refs(object.Blob.Digest)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) serveObjectContent(w http.ResponseWriter, r *http.Request, id string) {
+	object, err := s.storage.GetObject(id)
+	if err != nil {
+		if errors.Is(err, db.ErrObjectNotFound) {
+			http.Error(w, "Object not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to retrieve object", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	s.serveContent(w, r, object)
+}
+
+func (s *Server) serveContent(w http.ResponseWriter, r *http.Request, object *db.Object) {
+	contentType := object.ContentType
+	if contentType == "" {
+		contentType = object.Metadata["content_type"]
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if object.Blob != nil {
+		w.Header().Set("ETag", `"`+object.Blob.Digest+`"`)
+	}
+
+	content, err := s.storage.OpenObject(object)
+	if err != nil {
+		http.Error(w, "Failed to read object content", http.StatusInternalServerError)
+		log.Printf("Error reading object content: %v", err)
+		return
+	}
+	defer content.Close()
+
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
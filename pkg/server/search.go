@@ -0,0 +1,250 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/0xnu/kikiola/pkg/db"
+	"github.com/0xnu/kikiola/pkg/index"
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxSearchBatchSize = 1000
+	defaultSimilarK    = 10
+)
+
+type searchBatchResult struct {
+	Results []*index.Result `json:"results"`
+	Error   string          `json:"error,omitempty"`
+}
+
+func (s *Server) handleSearchVectors(w http.ResponseWriter, r *http.Request) {
+	var searchReq index.Query
+
+	err := json.NewDecoder(r.Body).Decode(&searchReq)
+	if err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	if searchReq.Vector == nil && searchReq.ID == "" {
+		http.Error(w, "Missing vector in request", http.StatusBadRequest)
+		return
+	}
+
+	s.search(w, r, &searchReq)
+}
+
+func (s *Server) handleSimilarVectors(w http.ResponseWriter, r *http.Request) {
+	searchReq := index.Query{K: defaultSimilarK}
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&searchReq)
+		if err != nil && err != io.EOF {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+	}
+	searchReq.ID = mux.Vars(r)["id"]
+	searchReq.Vector = nil
+
+	s.search(w, r, &searchReq)
+}
+
+func (s *Server) search(w http.ResponseWriter, r *http.Request, searchReq *index.Query) {
+	if searchReq.NeedsK() && searchReq.K <= 0 {
+		http.Error(w, "Invalid value of k", http.StatusBadRequest)
+		return
+	}
+	err := searchReq.Validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if searchReq.Vector != nil {
+		err = s.embedVectors([]*db.Vector{searchReq.Vector})[0]
+		if err != nil {
+			writeEmbeddingError(w, err)
+			return
+		}
+	}
+
+	if searchReq.GroupBy != "" {
+		s.searchGroups(w, searchReq)
+		return
+	}
+
+	if r.Header.Get("Accept") == "application/x-ndjson" {
+		s.streamSearch(w, searchReq)
+		return
+	}
+
+	results, err := s.index.Query(searchReq)
+	if err != nil {
+		writeSearchError(w, err)
+		return
+	}
+
+	response := struct {
+		Results []*index.Result `json:"results"`
+	}{
+		Results: results,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		log.Printf("Error encoding response: %v", err)
+		return
+	}
+}
+
+func (s *Server) searchGroups(w http.ResponseWriter, searchReq *index.Query) {
+	groups, err := s.index.QueryGroups(searchReq)
+	if err != nil {
+		writeSearchError(w, err)
+		return
+	}
+
+	response := struct {
+		Groups []*index.Group `json:"groups"`
+	}{
+		Groups: groups,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+func (s *Server) streamSearch(w http.ResponseWriter, searchReq *index.Query) {
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	started := false
+
+	err := s.index.QueryEach(searchReq, func(result *index.Result) error {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			started = true
+		}
+		err := encoder.Encode(result)
+		if err == nil && flusher != nil {
+			flusher.Flush()
+		}
+		return err
+	})
+	if err != nil {
+		if !started {
+			writeSearchError(w, err)
+			return
+		}
+		log.Printf("Error streaming search results: %v", err)
+		return
+	}
+
+	if !started {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func writeSearchError(w http.ResponseWriter, err error) {
+	if errors.Is(err, db.ErrVectorNotFound) {
+		http.Error(w, "Vector not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, index.ErrInvalidRerank) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, "Failed to search vectors", http.StatusInternalServerError)
+	log.Printf("Error searching vectors: %v", err)
+}
+
+func (s *Server) handleSearchBatch(w http.ResponseWriter, r *http.Request) {
+	var batchReq struct {
+		Queries []*index.Query `json:"queries"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&batchReq)
+	if err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if len(batchReq.Queries) == 0 {
+		http.Error(w, "Missing queries in request", http.StatusBadRequest)
+		return
+	}
+	if len(batchReq.Queries) > maxSearchBatchSize {
+		http.Error(w, fmt.Sprintf("Batch exceeds %d queries", maxSearchBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	for n, query := range batchReq.Queries {
+		if query == nil {
+			batchReq.Queries[n] = &index.Query{}
+		}
+	}
+
+	results, errs := s.searchBatch(batchReq.Queries)
+
+	response := struct {
+		Results []searchBatchResult `json:"results"`
+	}{
+		Results: make([]searchBatchResult, len(results)),
+	}
+	status := http.StatusOK
+	for n := range results {
+		response.Results[n].Results = results[n]
+		if errs[n] != nil {
+			response.Results[n].Error = errs[n].Error()
+			status = http.StatusMultiStatus
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// searchBatch embeds the query vectors that need it and runs the queries
+// whose embedding succeeded.
+func (s *Server) searchBatch(queries []*index.Query) ([][]*index.Result, []error) {
+	var vectors []*db.Vector
+	var positions []int
+	for n, query := range queries {
+		if query.Vector != nil {
+			vectors = append(vectors, query.Vector)
+			positions = append(positions, n)
+		}
+	}
+
+	results := make([][]*index.Result, len(queries))
+	errs := make([]error, len(queries))
+	for n, err := range s.embedVectors(vectors) {
+		errs[positions[n]] = err
+	}
+
+	var ready []*index.Query
+	positions = positions[:0]
+	for n, query := range queries {
+		if errs[n] == nil {
+			ready = append(ready, query)
+			positions = append(positions, n)
+		}
+	}
+	if len(ready) == 0 {
+		return results, errs
+	}
+
+	readyResults, readyErrs := s.index.SearchBatch(ready)
+	for n, position := range positions {
+		results[position], errs[position] = readyResults[n], readyErrs[n]
+	}
+	return results, errs
+}
@@ -4,19 +4,26 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"io/ioutil"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"strings"
 
+	"github.com/0xnu/kikiola/pkg/compaction"
 	"github.com/0xnu/kikiola/pkg/db"
+	"github.com/0xnu/kikiola/pkg/embed"
 	"github.com/0xnu/kikiola/pkg/index"
+	"github.com/0xnu/kikiola/pkg/snapshot"
 	"github.com/gorilla/mux"
 )
 
 type Server struct {
-	storage *db.DistributedStorage
-	index   *index.Index
-	server  *http.Server
+	storage   *db.DistributedStorage
+	index     *index.Index
+	compactor *compaction.Compactor
+	embedder  embed.Provider
+	server    *http.Server
 }
 
 type Object struct {
@@ -27,11 +34,16 @@ type Object struct {
 
 func NewServer(storage *db.DistributedStorage, index *index.Index) *Server {
 	return &Server{
-		storage: storage,
-		index:   index,
+		storage:   storage,
+		index:     index,
+		compactor: compaction.NewCompactor(storage, index),
 	}
 }
 
+func (s *Server) Compactor() *compaction.Compactor {
+	return s.compactor
+}
+
 func (s *Server) Start(addr string) error {
 	router := s.Router()
 	return http.ListenAndServe(addr, router)
@@ -45,16 +57,42 @@ func (s *Server) Router() *mux.Router {
 	router := mux.NewRouter()
 
 	router.HandleFunc("/vectors", s.handleInsertVector).Methods("POST")
+	router.HandleFunc("/vectors", s.handleListVectors).Methods("GET")
+	router.HandleFunc("/vectors/stream", s.handleStreamVectors).Methods("GET")
+	router.HandleFunc("/vectors/batch", s.handleInsertVectorsBatch).Methods("POST")
+	router.HandleFunc("/vectors/batch", s.handleUpsertVectorsBatch).Methods("PUT")
+	router.HandleFunc("/vectors/batch", s.handleDeleteVectorsBatch).Methods("DELETE")
 	router.HandleFunc("/vectors/{id}", s.handleGetVector).Methods("GET")
+	router.HandleFunc("/vectors/{id}", s.handlePutVector).Methods("PUT")
 	router.HandleFunc("/vectors/{id}", s.handleDeleteVector).Methods("DELETE")
 	router.HandleFunc("/vectors/{id}/metadata", s.handleUpdateVectorMetadata).Methods("PATCH")
+	router.HandleFunc("/vectors/{id}/similar", s.handleSimilarVectors).Methods("POST")
+	router.HandleFunc("/vectors/{id}/object", s.handleGetVectorObject).Methods("GET")
 	router.HandleFunc("/query/{id}", s.handleQueryVector).Methods("GET")
 	router.HandleFunc("/search", s.handleSearchVectors).Methods("POST")
+	router.HandleFunc("/search/batch", s.handleSearchBatch).Methods("POST")
 	router.HandleFunc("/objects", s.handleInsertObject).Methods("POST")
+	router.HandleFunc("/objects", s.handleListObjects).Methods("GET")
+	router.HandleFunc("/objects/uploads", s.handleCreateUpload).Methods("POST")
+	router.HandleFunc("/objects/uploads/{upload}", s.handleGetUpload).Methods("GET")
+	router.HandleFunc("/objects/uploads/{upload}", s.handleAbortUpload).Methods("DELETE")
+	router.HandleFunc("/objects/uploads/{upload}/parts/{part}", s.handleUploadPart).Methods("PUT")
+	router.HandleFunc("/objects/uploads/{upload}/complete", s.handleCompleteUpload).Methods("POST")
 	router.HandleFunc("/objects/{id}", s.handleGetObject).Methods("GET")
 	router.HandleFunc("/objects/{id}", s.handleDeleteObject).Methods("DELETE")
 	router.HandleFunc("/objects/{id}/metadata", s.handleUpdateObjectMetadata).Methods("PATCH")
+	router.HandleFunc("/objects/{id}/content", s.handleGetObjectContent).Methods("GET")
+	router.HandleFunc("/objects/{id}/versions", s.handleListObjectVersions).Methods("GET")
+	router.HandleFunc("/objects/{id}/versions/{version}", s.handleGetObjectVersion).Methods("GET")
+	router.HandleFunc("/objects/{id}/versions/{version}/content", s.handleGetObjectVersionContent).Methods("GET")
+	router.HandleFunc("/objects/{id}/versions/{version}/restore", s.handleRestoreObjectVersion).Methods("POST")
 	router.HandleFunc("/objects/{id}/content", s.handleUpdateObjectContent).Methods("PATCH")
+	router.HandleFunc("/documents", s.handleInsertDocument).Methods("POST")
+	router.HandleFunc("/import", s.handleImportVectors).Methods("POST")
+	router.HandleFunc("/export", s.handleExportVectors).Methods("GET")
+	router.HandleFunc("/admin/compact", s.handleCompact).Methods("POST")
+	router.HandleFunc("/admin/compact", s.handleGetCompactionReport).Methods("GET")
+	router.HandleFunc("/admin/snapshot", s.handleSnapshot).Methods("GET")
 
 	return router
 }
@@ -67,13 +105,88 @@ func (s *Server) handleInsertVector(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = s.index.Insert(&vector)
+	mode := db.WriteUpsert
+	if r.URL.Query().Get("mode") == "create" || r.Header.Get("If-None-Match") == "*" {
+		mode = db.WriteCreate
+	}
+
+	_, ok := s.putVector(w, r, &vector, mode)
+	if ok {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (s *Server) handlePutVector(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var vector db.Vector
+	err := json.NewDecoder(r.Body).Decode(&vector)
 	if err != nil {
-		http.Error(w, "Failed to insert vector", http.StatusInternalServerError)
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	if vector.ID == "" {
+		vector.ID = id
+	} else if vector.ID != id {
+		http.Error(w, "Vector ID does not match the request path", http.StatusBadRequest)
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
+	mode := db.WriteUpsert
+	if r.Header.Get("If-None-Match") == "*" {
+		mode = db.WriteCreate
+	}
+
+	created, ok := s.putVector(w, r, &vector, mode)
+	if !ok {
+		return
+	}
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func (s *Server) putVector(w http.ResponseWriter, r *http.Request, vector *db.Vector, mode db.WriteMode) (bool, bool) {
+	err := vector.Validate()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false, false
+	}
+
+	err = s.embedVectors([]*db.Vector{vector})[0]
+	if err != nil {
+		writeEmbeddingError(w, err)
+		return false, false
+	}
+
+	created, err := s.index.Put(vector, mode, strings.Trim(r.Header.Get("If-Match"), `"`))
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrVectorExists):
+			http.Error(w, "Vector already exists", http.StatusConflict)
+		case errors.Is(err, db.ErrVersionMismatch):
+			http.Error(w, "Vector version does not match", http.StatusPreconditionFailed)
+		case errors.Is(err, db.ErrObjectNotFound):
+			http.Error(w, "Linked object not found", http.StatusBadRequest)
+		default:
+			http.Error(w, "Failed to insert vector", http.StatusInternalServerError)
+			log.Printf("Error inserting vector: %v", err)
+		}
+		return false, false
+	}
+
+	setVersion(w, vector)
+	return created, true
+}
+
+func setVersion(w http.ResponseWriter, vector *db.Vector) {
+	version, err := vector.Version()
+	if err == nil {
+		w.Header().Set("ETag", `"`+version+`"`)
+	}
 }
 
 func (s *Server) handleQueryVector(w http.ResponseWriter, r *http.Request) {
@@ -136,6 +249,7 @@ func (s *Server) handleGetVector(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	setVersion(w, vector)
 	json.NewEncoder(w).Encode(vector)
 }
 
@@ -151,80 +265,56 @@ func (s *Server) handleDeleteVector(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func (s *Server) handleSearchVectors(w http.ResponseWriter, r *http.Request) {
-	var searchReq struct {
-		Vector *db.Vector `json:"vector"`
-		K      int        `json:"k"`
-	}
-
-	err := json.NewDecoder(r.Body).Decode(&searchReq)
-	if err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
-		return
-	}
-
-	if searchReq.Vector == nil {
-		http.Error(w, "Missing vector in request", http.StatusBadRequest)
-		return
-	}
-
-	if searchReq.K <= 0 {
-		http.Error(w, "Invalid value of k", http.StatusBadRequest)
-		return
-	}
-
-	results, err := s.index.Search(searchReq.Vector, searchReq.K)
-	if err != nil {
-		http.Error(w, "Failed to search vectors", http.StatusInternalServerError)
-		log.Printf("Error searching vectors: %v", err)
-		return
-	}
-
-	response := struct {
-		Results []*db.Vector `json:"results"`
-	}{
-		Results: results,
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(response)
-	if err != nil {
-		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
-		log.Printf("Error encoding response: %v", err)
-		return
-	}
-}
-
 func (s *Server) handleInsertObject(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseMultipartForm(32 << 20)
+	reader, err := r.MultipartReader()
 	if err != nil {
 		http.Error(w, "Failed to parse multipart form", http.StatusBadRequest)
 		return
 	}
 
-	jsonData := r.FormValue("data")
 	var object db.Object
+	var content *objectContent
+	hasData := false
 
-	err = json.Unmarshal([]byte(jsonData), &object)
-	if err != nil {
-		http.Error(w, "Invalid JSON data", http.StatusBadRequest)
-		return
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "Failed to parse multipart form", http.StatusBadRequest)
+			return
+		}
+
+		switch part.FormName() {
+		case "data":
+			err = json.NewDecoder(io.LimitReader(part, maxObjectDataSize)).Decode(&object)
+			if err != nil {
+				http.Error(w, "Invalid JSON data", http.StatusBadRequest)
+				return
+			}
+			hasData = true
+		case "object":
+			content, err = s.storeContent(part)
+			if err != nil {
+				http.Error(w, "Failed to store object file", http.StatusInternalServerError)
+				log.Printf("Error storing object file: %v", err)
+				return
+			}
+		}
+		part.Close()
 	}
 
-	file, _, err := r.FormFile("object")
-	if err != nil {
-		http.Error(w, "Failed to retrieve object file", http.StatusBadRequest)
+	if !hasData {
+		http.Error(w, "Invalid JSON data", http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
-
-	objectData, err := ioutil.ReadAll(file)
-	if err != nil {
-		http.Error(w, "Failed to read object file", http.StatusBadRequest)
+	if content == nil {
+		http.Error(w, "Failed to retrieve object file", http.StatusBadRequest)
 		return
 	}
 
-	object.Object = objectData
+	content.apply(&object)
 
 	err = s.storage.InsertObject(&object)
 	if err != nil {
@@ -233,7 +323,7 @@ func (s *Server) handleInsertObject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.WriteHeader(http.StatusCreated)
+	s.writeObjectContent(w, &object, http.StatusCreated)
 }
 
 func (s *Server) handleGetObject(w http.ResponseWriter, r *http.Request) {
@@ -249,13 +339,38 @@ func (s *Server) handleGetObject(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	object.History = nil
 	json.NewEncoder(w).Encode(object)
 }
 
+func (s *Server) handleGetVectorObject(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	vector, err := s.storage.GetVector(id)
+	if err != nil {
+		if errors.Is(err, db.ErrVectorNotFound) {
+			http.Error(w, "Vector not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to retrieve vector", http.StatusInternalServerError)
+		}
+		return
+	}
+	if vector.ObjectID == "" {
+		http.Error(w, "Vector has no linked object", http.StatusNotFound)
+		return
+	}
+
+	s.serveObjectContent(w, r, vector.ObjectID)
+}
+
+func (s *Server) handleGetObjectContent(w http.ResponseWriter, r *http.Request) {
+	s.serveObjectContent(w, r, mux.Vars(r)["id"])
+}
+
 func (s *Server) handleDeleteObject(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	err := s.storage.DeleteObject(id)
+	err := s.index.DeleteObject(id)
 	if err != nil {
 		if errors.Is(err, db.ErrObjectNotFound) {
 			http.Error(w, "Object not found", http.StatusNotFound)
@@ -298,44 +413,99 @@ func (s *Server) handleUpdateObjectMetadata(w http.ResponseWriter, r *http.Reque
 func (s *Server) handleUpdateObjectContent(w http.ResponseWriter, r *http.Request) {
 	id := mux.Vars(r)["id"]
 
-	err := r.ParseMultipartForm(32 << 20)
+	object, err := s.storage.GetObject(id)
+	if err != nil {
+		if errors.Is(err, db.ErrObjectNotFound) {
+			http.Error(w, "Object not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Failed to retrieve object", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	reader, err := r.MultipartReader()
 	if err != nil {
 		http.Error(w, "Failed to parse multipart form", http.StatusBadRequest)
 		return
 	}
 
-	file, _, err := r.FormFile("object")
+	var content *objectContent
+	for content == nil {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			http.Error(w, "Failed to retrieve object file", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to parse multipart form", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() == "object" {
+			content, err = s.storeContent(part)
+			if err != nil {
+				http.Error(w, "Failed to store object file", http.StatusInternalServerError)
+				log.Printf("Error storing object file: %v", err)
+				return
+			}
+		}
+		part.Close()
+	}
+
+	content.apply(object)
+
+	err = s.storage.InsertObject(object)
 	if err != nil {
-		http.Error(w, "Failed to retrieve object file", http.StatusBadRequest)
+		http.Error(w, "Failed to update object content", http.StatusInternalServerError)
 		return
 	}
-	defer file.Close()
 
-	objectData, err := ioutil.ReadAll(file)
+	s.writeObjectContent(w, object, http.StatusOK)
+}
+
+func (s *Server) handleCompact(w http.ResponseWriter, r *http.Request) {
+	report, err := s.compactor.Run()
 	if err != nil {
-		http.Error(w, "Failed to read object file", http.StatusBadRequest)
+		http.Error(w, "Failed to run compaction", http.StatusInternalServerError)
+		log.Printf("Error running compaction: %v", err)
 		return
 	}
 
-	object, err := s.storage.GetObject(id)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func (s *Server) handleGetCompactionReport(w http.ResponseWriter, r *http.Request) {
+	report := s.compactor.LastReport()
+	if report == nil {
+		http.Error(w, "No compaction has run yet", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+func (s *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	staged, err := snapshot.Stage(s.storage, s.index)
 	if err != nil {
-		if errors.Is(err, db.ErrObjectNotFound) {
-			http.Error(w, "Object not found", http.StatusNotFound)
+		if errors.Is(err, db.ErrSnapshotUnsupported) {
+			http.Error(w, "Storage engine does not support snapshots", http.StatusNotImplemented)
 		} else {
-			http.Error(w, "Failed to retrieve object", http.StatusInternalServerError)
+			http.Error(w, "Failed to create snapshot", http.StatusInternalServerError)
 		}
+		log.Printf("Error creating snapshot: %v", err)
 		return
 	}
+	defer staged.Close()
 
-	object.Object = objectData
+	filename := fmt.Sprintf("kikiola-snapshot-%s.tar", staged.Manifest.CreatedAt.Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
 
-	err = s.storage.InsertObject(object)
+	err = staged.Stream(w)
 	if err != nil {
-		http.Error(w, "Failed to update object content", http.StatusInternalServerError)
-		return
+		log.Printf("Error streaming snapshot: %v", err)
 	}
-
-	w.WriteHeader(http.StatusOK)
 }
 
 type SearchRequest struct {
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/0xnu/kikiola/pkg/db"
+	"github.com/gorilla/mux"
+)
+
+type uploadPart struct {
+	Part   int    `json:"part"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest"`
+}
+
+type uploadResponse struct {
+	UploadID  string       `json:"upload_id"`
+	ObjectID  string       `json:"object_id"`
+	Parts     []uploadPart `json:"parts"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+func (s *Server) handleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	var object db.Object
+	err := json.NewDecoder(r.Body).Decode(&object)
+	if err != nil {
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if object.ID == "" {
+		http.Error(w, "Missing object ID in request", http.StatusBadRequest)
+		return
+	}
+
+	upload, err := s.storage.CreateUpload(&object)
+	if err != nil {
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		log.Printf("Error creating upload: %v", err)
+		return
+	}
+
+	writeUpload(w, upload, http.StatusCreated)
+}
+
+func (s *Server) handleGetUpload(w http.ResponseWriter, r *http.Request) {
+	upload, err := s.storage.GetUpload(mux.Vars(r)["upload"])
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	writeUpload(w, upload, http.StatusOK)
+}
+
+func (s *Server) handleUploadPart(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	number, err := strconv.Atoi(vars["part"])
+	if err != nil {
+		http.Error(w, "Invalid part number", http.StatusBadRequest)
+		return
+	}
+
+	part, err := s.storage.PutUploadPart(vars["upload"], number, r.Body)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(uploadPart{Part: number, Size: part.Size, Digest: part.Digest})
+}
+
+func (s *Server) handleCompleteUpload(w http.ResponseWriter, r *http.Request) {
+	object, err := s.storage.CompleteUpload(mux.Vars(r)["upload"])
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	s.writeObjectContent(w, object, http.StatusCreated)
+}
+
+func (s *Server) handleAbortUpload(w http.ResponseWriter, r *http.Request) {
+	err := s.storage.AbortUpload(mux.Vars(r)["upload"])
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeUpload(w http.ResponseWriter, upload *db.Upload, status int) {
+	response := uploadResponse{
+		UploadID:  upload.ID,
+		ObjectID:  upload.Object.ID,
+		Parts:     []uploadPart{},
+		CreatedAt: upload.CreatedAt,
+		UpdatedAt: upload.UpdatedAt,
+	}
+	for _, number := range upload.PartNumbers() {
+		part := upload.Parts[number]
+		response.Parts = append(response.Parts, uploadPart{Part: number, Size: part.Size, Digest: part.Digest})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+func writeUploadError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, db.ErrUploadNotFound):
+		http.Error(w, "Upload not found", http.StatusNotFound)
+	case errors.Is(err, db.ErrInvalidPart), errors.Is(err, db.ErrUploadIncomplete):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, db.ErrUploadConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "Failed to process upload", http.StatusInternalServerError)
+		log.Printf("Error processing upload: %v", err)
+	}
+}
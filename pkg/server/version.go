@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/0xnu/kikiola/pkg/db"
+	"github.com/gorilla/mux"
+)
+
+type objectVersionResponse struct {
+	Version     int               `json:"version"`
+	Metadata    map[string]string `json:"metadata"`
+	ContentType string            `json:"content_type,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	Size        int64             `json:"size"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+	Current     bool              `json:"current"`
+}
+
+func newObjectVersionResponse(version *db.ObjectVersion, current bool) objectVersionResponse {
+	response := objectVersionResponse{
+		Version:     version.Version,
+		Metadata:    version.Metadata,
+		ContentType: version.ContentType,
+		Size:        int64(len(version.Object)),
+		UpdatedAt:   version.UpdatedAt,
+		Current:     current,
+	}
+	if version.Blob != nil {
+		response.Digest = version.Blob.Digest
+		response.Size = version.Blob.Size
+	}
+	return response
+}
+
+func (s *Server) handleListObjectVersions(w http.ResponseWriter, r *http.Request) {
+	object, err := s.storage.GetObject(mux.Vars(r)["id"])
+	if err != nil {
+		writeObjectVersionError(w, err)
+		return
+	}
+
+	response := struct {
+		Versions []objectVersionResponse `json:"versions"`
+	}{}
+	for n, version := range object.Versions() {
+		response.Versions = append(response.Versions, newObjectVersionResponse(version, n == 0))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) handleGetObjectVersion(w http.ResponseWriter, r *http.Request) {
+	id, version, ok := objectVersionVars(w, r)
+	if !ok {
+		return
+	}
+
+	object, err := s.storage.GetObject(id)
+	if err != nil {
+		writeObjectVersionError(w, err)
+		return
+	}
+	for n, entry := range object.Versions() {
+		if entry.Version == version {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(newObjectVersionResponse(entry, n == 0))
+			return
+		}
+	}
+
+	http.Error(w, "Object version not found", http.StatusNotFound)
+}
+
+func (s *Server) handleGetObjectVersionContent(w http.ResponseWriter, r *http.Request) {
+	id, version, ok := objectVersionVars(w, r)
+	if !ok {
+		return
+	}
+
+	entry, err := s.storage.GetObjectVersion(id, version)
+	if err != nil {
+		writeObjectVersionError(w, err)
+		return
+	}
+
+	s.serveContent(w, r, entry.AsObject(id))
+}
+
+func (s *Server) handleRestoreObjectVersion(w http.ResponseWriter, r *http.Request) {
+	id, version, ok := objectVersionVars(w, r)
+	if !ok {
+		return
+	}
+
+	object, err := s.storage.RestoreObjectVersion(id, version)
+	if err != nil {
+		writeObjectVersionError(w, err)
+		return
+	}
+	s.writeObjectContent(w, object, http.StatusOK)
+}
+
+func objectVersionVars(w http.ResponseWriter, r *http.Request) (string, int, bool) {
+	vars := mux.Vars(r)
+	version, err := strconv.Atoi(vars["version"])
+	if err != nil || version < 1 {
+		http.Error(w, "Invalid object version", http.StatusBadRequest)
+		return "", 0, false
+	}
+	return vars["id"], version, true
+}
+
+func writeObjectVersionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, db.ErrObjectNotFound):
+		http.Error(w, "Object not found", http.StatusNotFound)
+	case errors.Is(err, db.ErrObjectVersionNotFound):
+		http.Error(w, "Object version not found", http.StatusNotFound)
+	default:
+		http.Error(w, "Failed to retrieve object version", http.StatusInternalServerError)
+		log.Printf("Error retrieving object version: %v", err)
+	}
+}
@@ -0,0 +1,540 @@
+package snapshot
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/0xnu/kikiola/pkg/blob"
+	"github.com/0xnu/kikiola/pkg/db"
+	"github.com/0xnu/kikiola/pkg/index"
+	"github.com/0xnu/kikiola/pkg/segment"
+)
+
+// FormatVersion 2 added the vector segments, which hold the embeddings
+// the node databases leave out.
+const (
+	FormatVersion = 2
+	manifestName  = "manifest.json"
+	nodesDir      = "nodes"
+	blobsDir      = "blobs"
+	segmentsDir   = "segments"
+)
+
+var ErrChecksumMismatch = errors.New("snapshot checksum mismatch")
+
+type Manifest struct {
+	Version   int         `json:"version"`
+	CreatedAt time.Time   `json:"created_at"`
+	Nodes     []NodeEntry `json:"nodes"`
+	Segments  []FileEntry `json:"segments,omitempty"`
+	Chunks    []string    `json:"chunks,omitempty"`
+}
+
+type NodeEntry struct {
+	Address string `json:"address"`
+	File    string `json:"file"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+}
+
+type FileEntry struct {
+	File   string `json:"file"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Staged is a snapshot whose node databases and vector segments have been
+// written to a staging directory under the data directory and whose blob
+// chunks are pinned, ready to be streamed. Close releases both.
+type Staged struct {
+	Manifest *Manifest
+
+	storage *db.DistributedStorage
+	dir     string
+	paths   map[string]string
+}
+
+// Create stages a snapshot of storage and its index and streams it to w as
+// a tar archive.
+func Create(storage *db.DistributedStorage, idx *index.Index, w io.Writer) (*Manifest, error) {
+	staged, err := Stage(storage, idx)
+	if err != nil {
+		return nil, err
+	}
+	defer staged.Close()
+
+	err = staged.Stream(w)
+	if err != nil {
+		return nil, err
+	}
+	return staged.Manifest, nil
+}
+
+// Stage writes every node database and the vector segments to a staging
+// directory under the data directory and pins the blob chunks, so a
+// snapshot that cannot be taken fails before anything is streamed.
+func Stage(storage *db.DistributedStorage, idx *index.Index) (*Staged, error) {
+	tempDir, err := os.MkdirTemp(storage.DataDir(), ".snapshot-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshot staging directory: %v", err)
+	}
+	err = os.Mkdir(filepath.Join(tempDir, segmentsDir), os.ModePerm)
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return nil, fmt.Errorf("failed to create snapshot staging directory: %v", err)
+	}
+
+	staged := &Staged{
+		Manifest: &Manifest{
+			Version:   FormatVersion,
+			CreatedAt: time.Now().UTC(),
+		},
+		storage: storage,
+		dir:     tempDir,
+		paths:   make(map[string]string),
+	}
+
+	var segments []string
+	chunks, err := idx.Snapshot(func(address string) (io.WriteCloser, error) {
+		filePath := filepath.Join(tempDir, db.NodeFileName(address))
+		file, err := os.Create(filePath)
+		if err != nil {
+			return nil, err
+		}
+		staged.paths[address] = filePath
+		return file, nil
+	}, func(name string) (io.WriteCloser, error) {
+		segments = append(segments, name)
+		return os.Create(filepath.Join(tempDir, segmentsDir, name))
+	})
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return nil, err
+	}
+	staged.Manifest.Chunks = chunks
+
+	for _, address := range storage.NodeAddresses() {
+		size, checksum, err := checksumFile(staged.paths[address])
+		if err != nil {
+			staged.Close()
+			return nil, err
+		}
+		staged.Manifest.Nodes = append(staged.Manifest.Nodes, NodeEntry{
+			Address: address,
+			File:    path.Join(nodesDir, db.NodeFileName(address)),
+			Size:    size,
+			SHA256:  checksum,
+		})
+	}
+
+	for _, name := range segments {
+		size, checksum, err := checksumFile(filepath.Join(tempDir, segmentsDir, name))
+		if err != nil {
+			staged.Close()
+			return nil, err
+		}
+		staged.Manifest.Segments = append(staged.Manifest.Segments, FileEntry{
+			File:   path.Join(segmentsDir, name),
+			Size:   size,
+			SHA256: checksum,
+		})
+	}
+
+	return staged, nil
+}
+
+// Stream writes the staged snapshot to w as a tar archive.
+func (s *Staged) Stream(w io.Writer) error {
+	manifest := s.Manifest
+	tw := tar.NewWriter(w)
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal manifest: %v", err)
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    manifestName,
+		Mode:    0644,
+		Size:    int64(len(manifestData)),
+		ModTime: manifest.CreatedAt,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	if _, err := tw.Write(manifestData); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+
+	for _, node := range manifest.Nodes {
+		err := writeFile(tw, node.File, node.Size, s.paths[node.Address], manifest.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range manifest.Segments {
+		err := writeFile(tw, entry.File, entry.Size, filepath.Join(s.dir, filepath.FromSlash(entry.File)), manifest.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, digest := range manifest.Chunks {
+		err := writeChunk(tw, s.storage.Blobs(), digest, manifest.CreatedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return fmt.Errorf("failed to finish snapshot archive: %v", err)
+	}
+	return nil
+}
+
+// Close unpins the snapshot's blob chunks and removes its staging
+// directory.
+func (s *Staged) Close() error {
+	s.storage.Blobs().Unpin(s.Manifest.Chunks)
+	err := os.RemoveAll(s.dir)
+	if err != nil {
+		return fmt.Errorf("failed to remove snapshot staging directory: %v", err)
+	}
+	return nil
+}
+
+func writeFile(tw *tar.Writer, name string, size int64, filePath string, modTime time.Time) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot of %s: %v", name, err)
+	}
+	defer file.Close()
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: modTime,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot of %s: %v", name, err)
+	}
+
+	_, err = io.Copy(tw, file)
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot of %s: %v", name, err)
+	}
+
+	return nil
+}
+
+func writeChunk(tw *tar.Writer, blobs *blob.Store, digest string, modTime time.Time) error {
+	file, err := blobs.OpenChunk(digest)
+	if err != nil {
+		return fmt.Errorf("failed to open blob chunk %s: %v", digest, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat blob chunk %s: %v", digest, err)
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    path.Join(blobsDir, digest),
+		Mode:    0644,
+		Size:    info.Size(),
+		ModTime: modTime,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write blob chunk %s: %v", digest, err)
+	}
+
+	_, err = io.Copy(tw, file)
+	if err != nil {
+		return fmt.Errorf("failed to write blob chunk %s: %v", digest, err)
+	}
+
+	return nil
+}
+
+func checksumFile(filePath string) (int64, string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to open snapshot file: %v", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to checksum snapshot file: %v", err)
+	}
+
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Restore unpacks a snapshot archive into dataDir, replacing the node
+// databases it contains and removing any others. Nodes, vector segments
+// and blob chunks are staged and checked against the manifest before
+// anything in dataDir is touched; the chunks are then added to the blob
+// store and the segments replace the index's. Snapshots from before the
+// segments were included hold the embeddings in their node databases, so
+// the segments are removed and the index rebuilds them from the restored
+// databases the next time it is opened.
+func Restore(r io.Reader, dataDir string) (*Manifest, error) {
+	err := os.MkdirAll(dataDir, os.ModePerm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %v", err)
+	}
+
+	stagingDir, err := os.MkdirTemp(dataDir, ".restore-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create restore staging directory: %v", err)
+	}
+	defer os.RemoveAll(stagingDir)
+
+	for _, dir := range []string{nodesDir, blobsDir, segmentsDir} {
+		err = os.Mkdir(filepath.Join(stagingDir, dir), os.ModePerm)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create restore staging directory: %v", err)
+		}
+	}
+
+	var manifest *Manifest
+	checksums := make(map[string]string)
+	chunks := make(map[string]bool)
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read snapshot archive: %v", err)
+		}
+
+		if header.Name == manifestName {
+			manifest = &Manifest{}
+			err := json.NewDecoder(tr).Decode(manifest)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read manifest: %v", err)
+			}
+			continue
+		}
+
+		dir, name := path.Dir(header.Name), path.Base(header.Name)
+		switch dir {
+		case blobsDir:
+			if !validDigest(name) {
+				return nil, fmt.Errorf("snapshot archive has an invalid blob chunk %s", header.Name)
+			}
+			checksum, err := stage(tr, filepath.Join(stagingDir, blobsDir, name))
+			if err != nil {
+				return nil, err
+			}
+			if checksum != name {
+				return nil, fmt.Errorf("%w: %s", ErrChecksumMismatch, header.Name)
+			}
+			chunks[name] = true
+		case nodesDir:
+			checksum, err := stage(tr, filepath.Join(stagingDir, nodesDir, name))
+			if err != nil {
+				return nil, err
+			}
+			checksums[header.Name] = checksum
+		case segmentsDir:
+			if !segment.IsFileName(name) {
+				return nil, fmt.Errorf("snapshot archive has an invalid segment file %s", header.Name)
+			}
+			checksum, err := stage(tr, filepath.Join(stagingDir, segmentsDir, name))
+			if err != nil {
+				return nil, err
+			}
+			checksums[header.Name] = checksum
+		}
+	}
+
+	if manifest == nil {
+		return nil, errors.New("snapshot archive has no manifest")
+	}
+	if manifest.Version < 1 || manifest.Version > FormatVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", manifest.Version)
+	}
+
+	for _, node := range manifest.Nodes {
+		if !validNodeFile(node.File) {
+			return nil, fmt.Errorf("snapshot manifest has an invalid node file %q", node.File)
+		}
+		checksum, ok := checksums[node.File]
+		if !ok {
+			return nil, fmt.Errorf("snapshot archive is missing %s", node.File)
+		}
+		if checksum != node.SHA256 {
+			return nil, fmt.Errorf("%w: %s", ErrChecksumMismatch, node.File)
+		}
+	}
+
+	for _, entry := range manifest.Segments {
+		dir, name := path.Split(entry.File)
+		if dir != segmentsDir+"/" || !segment.IsFileName(name) {
+			return nil, fmt.Errorf("snapshot manifest has an invalid segment file %q", entry.File)
+		}
+		checksum, ok := checksums[entry.File]
+		if !ok {
+			return nil, fmt.Errorf("snapshot archive is missing %s", entry.File)
+		}
+		if checksum != entry.SHA256 {
+			return nil, fmt.Errorf("%w: %s", ErrChecksumMismatch, entry.File)
+		}
+	}
+
+	expected := make(map[string]bool, len(manifest.Chunks))
+	for _, digest := range manifest.Chunks {
+		if !chunks[digest] {
+			return nil, fmt.Errorf("snapshot archive is missing blob chunk %s", digest)
+		}
+		expected[digest] = true
+	}
+	for digest := range chunks {
+		if !expected[digest] {
+			return nil, fmt.Errorf("snapshot archive has blob chunk %s not listed in its manifest", digest)
+		}
+	}
+
+	blobs, err := blob.Open(filepath.Join(dataDir, db.BlobDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, digest := range manifest.Chunks {
+		err := restoreChunk(blobs, digest, filepath.Join(stagingDir, blobsDir, digest))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = removeStaleNodes(dataDir, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, node := range manifest.Nodes {
+		name := path.Base(node.File)
+		err := os.Rename(filepath.Join(stagingDir, nodesDir, name), filepath.Join(dataDir, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %v", name, err)
+		}
+	}
+
+	segmentDir := filepath.Join(dataDir, index.SegmentDir)
+	err = os.RemoveAll(segmentDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reset vector segments: %v", err)
+	}
+	if len(manifest.Segments) > 0 {
+		err = os.MkdirAll(segmentDir, os.ModePerm)
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore vector segments: %v", err)
+		}
+	}
+	for _, entry := range manifest.Segments {
+		name := path.Base(entry.File)
+		err := os.Rename(filepath.Join(stagingDir, segmentsDir, name), filepath.Join(segmentDir, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore segment %s: %v", name, err)
+		}
+	}
+
+	return manifest, nil
+}
+
+// stage copies an archive entry to filePath and returns its SHA-256.
+func stage(r io.Reader, filePath string) (string, error) {
+	name := filepath.Base(filePath)
+	file, err := os.Create(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to stage %s: %v", name, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), r)
+	if err != nil {
+		return "", fmt.Errorf("failed to stage %s: %v", name, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func restoreChunk(blobs *blob.Store, digest, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to restore blob chunk %s: %v", digest, err)
+	}
+	defer file.Close()
+
+	err = blobs.PutChunk(digest, file)
+	if err != nil {
+		return fmt.Errorf("failed to restore blob chunk %s: %v", digest, err)
+	}
+	return nil
+}
+
+// removeStaleNodes deletes node databases in dataDir for addresses the
+// manifest does not list, so they are not opened alongside the snapshot.
+func removeStaleNodes(dataDir string, manifest *Manifest) error {
+	restored := make(map[string]bool, len(manifest.Nodes))
+	for _, node := range manifest.Nodes {
+		restored[path.Base(node.File)] = true
+	}
+
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		return fmt.Errorf("failed to list data directory: %v", err)
+	}
+	pattern := db.NodeFileName("*")
+	for _, entry := range entries {
+		matched, _ := path.Match(pattern, entry.Name())
+		if !matched || entry.IsDir() || restored[entry.Name()] {
+			continue
+		}
+		err := os.Remove(filepath.Join(dataDir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to remove stale node %s: %v", entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+// validNodeFile reports whether a manifest node file names a node
+// database directly under the nodes directory, so joining its base name to
+// the data directory cannot escape it.
+func validNodeFile(file string) bool {
+	if strings.Contains(file, "\\") || strings.Contains(file, "..") {
+		return false
+	}
+	dir, name := path.Split(file)
+	if dir != nodesDir+"/" {
+		return false
+	}
+	matched, _ := path.Match(db.NodeFileName("*"), name)
+	return matched
+}
+
+func validDigest(digest string) bool {
+	if len(digest) != sha256.Size*2 {
+		return false
+	}
+	return strings.Trim(digest, "0123456789abcdef") == ""
+}